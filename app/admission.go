@@ -0,0 +1,398 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aau-network-security/haaukins/store"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	admissionReservedMemoryMB = 2048
+	admissionMaxLoad          = 1.0
+	admissionMinDiskMB        = 5120
+	admissionExerciseMemoryMB = 256
+	admissionFrontendMemoryMB = 4096
+	admissionQueueSize        = 10
+	admissionQueueTimeout     = 5 * time.Minute
+	admissionTicker           = 5 * time.Second
+)
+
+var (
+	ErrAdmissionQueueFull = errors.New("the host is busy, too many labs are waiting")
+	ErrAdmissionTimeout   = errors.New("the host had no room for the lab in time")
+	ErrLabTooLarge        = errors.New("the lab needs more memory than the host has")
+)
+
+func (c *AdmissionConfig) setDefaults(ovaDir string) {
+	if c.ReservedMemoryMB == 0 {
+		c.ReservedMemoryMB = admissionReservedMemoryMB
+	}
+	if c.MaxLoad == 0 {
+		c.MaxLoad = admissionMaxLoad
+	}
+	if c.DiskPath == "" {
+		c.DiskPath = ovaDir
+	}
+	if c.MinDiskMB == 0 {
+		c.MinDiskMB = admissionMinDiskMB
+	}
+	if c.ExerciseMemoryMB == 0 {
+		c.ExerciseMemoryMB = admissionExerciseMemoryMB
+	}
+	if c.FrontendMemoryMB == 0 {
+		c.FrontendMemoryMB = admissionFrontendMemoryMB
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = admissionQueueSize
+	}
+	if c.QueueTimeout == 0 {
+		c.QueueTimeout = admissionQueueTimeout
+	}
+}
+
+// labCost is the estimated amount of resources a lab uses
+type labCost struct {
+	MemoryMB uint64  `json:"memory_mb"`
+	CPU      float64 `json:"cpu"`
+}
+
+func (c labCost) add(o labCost) labCost {
+	return labCost{MemoryMB: c.MemoryMB + o.MemoryMB, CPU: c.CPU + o.CPU}
+}
+
+func (c labCost) sub(o labCost) labCost {
+	if o.MemoryMB > c.MemoryMB {
+		o.MemoryMB = c.MemoryMB
+	}
+	return labCost{MemoryMB: c.MemoryMB - o.MemoryMB, CPU: c.CPU - o.CPU}
+}
+
+// hostStats are the resources of the host at some time
+type hostStats struct {
+	MemTotalMB     uint64  `json:"mem_total_mb"`
+	MemAvailableMB uint64  `json:"mem_available_mb"`
+	Load1          float64 `json:"load1"`
+	CPUs           int     `json:"cpus"`
+	DiskFreeMB     uint64  `json:"disk_free_mb"`
+}
+
+// Read the resources of the host from /proc, the free disk is the one of the file system of diskPath
+func readHostStats(diskPath string) (hostStats, error) {
+	stats := hostStats{CPUs: runtime.NumCPU()}
+
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return stats, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			stats.MemTotalMB = kb / 1024
+		case "MemAvailable:":
+			stats.MemAvailableMB = kb / 1024
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return stats, err
+	}
+
+	raw, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return stats, err
+	}
+	fields := strings.Fields(string(raw))
+	if len(fields) == 0 {
+		return stats, errors.New("unexpected /proc/loadavg format")
+	}
+	if stats.Load1, err = strconv.ParseFloat(fields[0], 64); err != nil {
+		return stats, err
+	}
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(diskPath, &fs); err != nil {
+		return stats, err
+	}
+	stats.DiskFreeMB = fs.Bavail * uint64(fs.Bsize) / (1024 * 1024)
+	return stats, nil
+}
+
+// admission admits the labs only when the host has room for them, the labs which don't fit
+// wait in a queue. The cost of the admitted labs is tracked so that the labs still being
+// created, which the host stats don't show yet, are not admitted twice over the same memory
+type admission struct {
+	conf  AdmissionConfig
+	stats func() (hostStats, error)
+
+	m         sync.Mutex
+	committed labCost //labs admitted and not closed yet
+	pending   labCost //labs admitted and still being created
+	labs      int
+	queued    int
+	last      hostStats     //last host stats read, used when they can't be read
+	freed     chan struct{} //closed whenever resources are released
+}
+
+// admittance is a lab admitted by the admission, released when the lab is closed
+type admittance struct {
+	a       *admission
+	cost    labCost
+	once    sync.Once
+	started bool
+}
+
+func newAdmission(conf AdmissionConfig) *admission {
+	if !conf.Enabled {
+		return nil
+	}
+	return &admission{
+		conf:  conf,
+		stats: func() (hostStats, error) { return readHostStats(conf.DiskPath) },
+		freed: make(chan struct{}),
+	}
+}
+
+// Estimate the cost of a lab from the instances of its exercises and its frontends,
+// the configured estimates are used for the ones without memory
+func (a *admission) LabCost(exers []store.Exercise, frontends []labFrontend) labCost {
+	if a == nil {
+		return labCost{}
+	}
+	var cost labCost
+	for _, e := range exers {
+		for _, i := range e.Instance {
+			mem := i.MemoryMB
+			if mem == 0 {
+				mem = a.conf.ExerciseMemoryMB
+			}
+			cost = cost.add(labCost{MemoryMB: uint64(mem), CPU: i.CPU})
+		}
+	}
+	for _, f := range frontends {
+		mem := f.conf.MemoryMB
+		if mem == 0 {
+			mem = a.conf.FrontendMemoryMB
+		}
+		cost = cost.add(labCost{MemoryMB: uint64(mem), CPU: f.conf.CPU})
+	}
+	return cost
+}
+
+// Check whether a lab of the given cost fits, the reason is returned when it doesn't
+func (a *admission) fits(stats hostStats, live bool, cost labCost) (bool, string) {
+	if live {
+		if stats.MemAvailableMB < a.pending.MemoryMB+cost.MemoryMB+a.conf.ReservedMemoryMB {
+			return false, "not enough free memory"
+		}
+		if stats.CPUs > 0 && stats.Load1/float64(stats.CPUs) > a.conf.MaxLoad {
+			return false, "cpu load too high"
+		}
+		if stats.DiskFreeMB < a.conf.MinDiskMB {
+			return false, "not enough free disk"
+		}
+	}
+	if capacity := a.capacity(stats); capacity > 0 && a.committed.MemoryMB+cost.MemoryMB > capacity {
+		return false, "memory committed to the running labs"
+	}
+	return true, ""
+}
+
+// Memory the labs can use, 0 when the host stats are not known
+func (a *admission) capacity(stats hostStats) uint64 {
+	if stats.MemTotalMB <= a.conf.ReservedMemoryMB {
+		return 0
+	}
+	return stats.MemTotalMB - a.conf.ReservedMemoryMB
+}
+
+// Queue is full when no more labs can wait for resources, the requests are rejected straight away
+func (a *admission) QueueFull() bool {
+	if a == nil {
+		return false
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.queued >= a.conf.QueueSize
+}
+
+// Admit a lab of the given cost, waiting in the queue until the host has room for it. The
+// admittance must be released once the lab is closed
+func (a *admission) Admit(ctx context.Context, cost labCost) (*admittance, error) {
+	if a == nil {
+		return nil, nil
+	}
+
+	deadline := time.NewTimer(a.conf.QueueTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(admissionTicker)
+	defer ticker.Stop()
+
+	queued := false
+	dequeue := func() {
+		if queued {
+			a.m.Lock()
+			a.queued--
+			a.m.Unlock()
+		}
+	}
+	for {
+		stats, err := a.stats()
+		live := err == nil
+		if !live {
+			log.Warn().Msgf("Error reading the host resources, admitting by the estimates only: %v", err)
+		}
+
+		a.m.Lock()
+		if live {
+			a.last = stats
+		} else {
+			stats = a.last
+		}
+		if capacity := a.capacity(stats); live && cost.MemoryMB > capacity {
+			a.m.Unlock()
+			dequeue()
+			return nil, ErrLabTooLarge
+		}
+		ok, reason := a.fits(stats, live, cost)
+		if ok {
+			a.committed = a.committed.add(cost)
+			a.pending = a.pending.add(cost)
+			a.labs++
+			if queued {
+				a.queued--
+			}
+			a.m.Unlock()
+			return &admittance{a: a, cost: cost}, nil
+		}
+		if !queued {
+			if a.queued >= a.conf.QueueSize {
+				a.m.Unlock()
+				return nil, ErrAdmissionQueueFull
+			}
+			a.queued++
+			queued = true
+			log.Info().Uint64("memory", cost.MemoryMB).Str("reason", reason).Msg("Lab waiting for host resources")
+		}
+		freed := a.freed
+		a.m.Unlock()
+
+		select {
+		case <-freed:
+		case <-ticker.C:
+		case <-deadline.C:
+			dequeue()
+			return nil, ErrAdmissionTimeout
+		case <-ctx.Done():
+			dequeue()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Wake up the labs waiting in the queue, a.m must be held
+func (a *admission) notify() {
+	close(a.freed)
+	a.freed = make(chan struct{})
+}
+
+// Started tells the admission the lab is running, from now on its resources show in the host stats
+func (ad *admittance) Started() {
+	if ad == nil {
+		return
+	}
+	ad.a.m.Lock()
+	defer ad.a.m.Unlock()
+	if !ad.started {
+		ad.started = true
+		ad.a.pending = ad.a.pending.sub(ad.cost)
+		ad.a.notify()
+	}
+}
+
+// Release the resources of the lab, it is safe to call it more than once
+func (ad *admittance) Release() {
+	if ad == nil {
+		return
+	}
+	ad.once.Do(func() {
+		ad.a.m.Lock()
+		defer ad.a.m.Unlock()
+		if !ad.started {
+			ad.a.pending = ad.a.pending.sub(ad.cost)
+		}
+		ad.a.committed = ad.a.committed.sub(ad.cost)
+		ad.a.labs--
+		ad.a.notify()
+	})
+}
+
+// admissionReport is the budget of the admission, as reported on the admin API
+type admissionReport struct {
+	Enabled    bool      `json:"enabled"`
+	Host       hostStats `json:"host"`
+	HostError  string    `json:"host_error,omitempty"`
+	ReservedMB uint64    `json:"reserved_memory_mb"`
+	CapacityMB uint64    `json:"capacity_mb"`
+	Committed  labCost   `json:"committed"`
+	Pending    labCost   `json:"pending"`
+	Labs       int       `json:"labs"`
+	Queued     int       `json:"queued"`
+	QueueSize  int       `json:"queue_size"`
+	Admits     bool      `json:"admits"` //whether a lab of the default frontend fits now
+	Reason     string    `json:"reason,omitempty"`
+}
+
+func (a *admission) Report(probe labCost) admissionReport {
+	if a == nil {
+		return admissionReport{}
+	}
+	stats, err := a.stats()
+
+	a.m.Lock()
+	defer a.m.Unlock()
+	r := admissionReport{
+		Enabled:    true,
+		Host:       stats,
+		ReservedMB: a.conf.ReservedMemoryMB,
+		CapacityMB: a.capacity(stats),
+		Committed:  a.committed,
+		Pending:    a.pending,
+		Labs:       a.labs,
+		Queued:     a.queued,
+		QueueSize:  a.conf.QueueSize,
+	}
+	if err != nil {
+		r.HostError = err.Error()
+	}
+	r.Admits, r.Reason = a.fits(stats, err == nil, probe)
+	return r
+}
+
+// Budget of the admission controller, it can be called only through admin priviledges
+func (lm *LearningMaterialAPI) admissionBudget() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, lm.admission.Report(lm.admission.LabCost(nil, lm.frontends)))
+	}
+}
@@ -0,0 +1,85 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aau-network-security/haaukins/store"
+)
+
+func TestLabCost(t *testing.T) {
+	conf := AdmissionConfig{Enabled: true}
+	conf.setDefaults("/tmp")
+	a := newAdmission(conf)
+
+	cost := a.LabCost([]store.Exercise{
+		{Tag: "ftp", Instance: []store.ExerciseInstanceConfig{{Image: "ftp", MemoryMB: 512, CPU: 0.5}}},
+		{Tag: "sql", Instance: []store.ExerciseInstanceConfig{{Image: "db"}, {Image: "web", MemoryMB: 128}}},
+	}, newLabFrontends([]FrontendConfig{{Image: "kali"}, {Image: "windows10", Memory: 8192}}))
+
+	want := labCost{MemoryMB: 512 + admissionExerciseMemoryMB + 128 + admissionFrontendMemoryMB + 8192, CPU: 0.5}
+	if cost != want {
+		t.Fatalf("expected cost %+v, got %+v", want, cost)
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	stats := hostStats{MemTotalMB: 16384, MemAvailableMB: 16000, CPUs: 4, Load1: 1, DiskFreeMB: 100000}
+	a := newAdmission(AdmissionConfig{
+		Enabled:          true,
+		ReservedMemoryMB: 2048,
+		MaxLoad:          1,
+		MinDiskMB:        1024,
+		QueueSize:        1,
+		QueueTimeout:     time.Second,
+	})
+	a.stats = func() (hostStats, error) { return stats, nil }
+	ctx := context.Background()
+	lab := labCost{MemoryMB: 6000}
+
+	if _, err := a.Admit(ctx, labCost{MemoryMB: 20000}); err != ErrLabTooLarge {
+		t.Fatalf("expected %v, got %v", ErrLabTooLarge, err)
+	}
+
+	first, err := a.Admit(ctx, lab)
+	if err != nil {
+		t.Fatalf("unexpected error admitting the first lab: %v", err)
+	}
+	first.Started()
+	stats.MemAvailableMB -= lab.MemoryMB
+
+	second, err := a.Admit(ctx, lab)
+	if err != nil {
+		t.Fatalf("unexpected error admitting the second lab: %v", err)
+	}
+
+	//The second lab is still being created, the host stats don't show its memory yet
+	admitted := make(chan error)
+	go func() {
+		third, err := a.Admit(ctx, lab)
+		third.Release()
+		admitted <- err
+	}()
+	for !a.QueueFull() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := a.Admit(ctx, lab); err != ErrAdmissionQueueFull {
+		t.Fatalf("expected %v, got %v", ErrAdmissionQueueFull, err)
+	}
+
+	second.Release()
+	if err := <-admitted; err != nil {
+		t.Fatalf("expected the queued lab to be admitted once resources are freed: %v", err)
+	}
+
+	stats.Load1 = 8
+	if _, err := a.Admit(ctx, lab); err != ErrAdmissionTimeout {
+		t.Fatalf("expected %v under high load, got %v", ErrAdmissionTimeout, err)
+	}
+
+	r := a.Report(lab)
+	if r.Labs != 1 || r.Committed.MemoryMB != lab.MemoryMB || r.Queued != 0 || r.Admits {
+		t.Fatalf("unexpected report: %+v", r)
+	}
+}
@@ -16,6 +16,7 @@ import (
 
 const (
 	requestedChallenges = "challenges"
+	loginTicketParam    = "ticket"
 	sessionCookie       = "haaukins_session"
 	sessionChal         = "chals"
 	timeFormat          = "2006-01-02 15:04:05"
@@ -26,6 +27,9 @@ const (
 	errorGetClient     = "Error getting client"
 	errorCreateEnv     = "Error creating the environment"
 	errorGetCR         = "Error getting the environment"
+	errorLoginTicket   = "The login link is not valid anymore"
+	errorGuacSession   = "Your session is not valid anymore, please request the challenges again"
+	errorGuacDown      = "The virtual desktop is not reachable at the moment, please try again in a few seconds"
 
 	errorAPIRequests    = "API reached the maximum number of requests it can handles"
 	errorClientRequests = "You reached the maximum number of requests you can make"
@@ -37,14 +41,47 @@ func (lm *LearningMaterialAPI) Handler() http.Handler {
 	m := http.NewServeMux()
 	m.HandleFunc("/", lm.handleIndex())
 	m.HandleFunc("/api/", lm.handleRequest(lm.getOrCreateClient(lm.getOrCreateEnvironment()), lm.conf.SecretChallengeAuth.Username, lm.conf.SecretChallengeAuth.Password, lm.conf.SecretChallengeAuth.EnableSecretAuth))
-	m.HandleFunc("/admin/envs/", lm.listEnvs())
+	m.HandleFunc(flagsAPIPath, lm.handleFlags())
+	m.HandleFunc(progressAPIPath, lm.handleProgress())
+	m.HandleFunc(progressPagePath, lm.handleProgressPage())
+	m.HandleFunc(challengesAPIPath, lm.handleChallenges())
+	m.HandleFunc(bundlesAPIPath, lm.handleBundles())
+	m.HandleFunc(labsAPIPath, lm.handleLabs())
+	m.HandleFunc(labsAPIPath+"/", lm.handleLabs())
+	m.HandleFunc(envsAdminPath, lm.adminAuth(lm.handleEnvs()))
+	m.HandleFunc("/admin/proxy/", lm.adminAuth(lm.proxyMetrics()))
+	m.HandleFunc("/admin/admission/", lm.adminAuth(lm.admissionBudget()))
+	m.HandleFunc("/admin/workers/", lm.adminAuth(lm.listWorkers()))
+	m.HandleFunc(catalogAdminPath, lm.adminAuth(lm.handleCatalog()))
+	m.HandleFunc(bundlesAdminPath, lm.adminAuth(lm.handleAdminBundles()))
+	m.HandleFunc(reservationsAdminPath, lm.adminAuth(lm.handleReservations()))
+	m.HandleFunc(recordingsAdminPath, lm.adminAuth(lm.handleRecordings()))
+	m.HandleFunc(shadowAdminPath, lm.adminAuth(lm.handleShadow()))
+	m.HandleFunc(resetAdminPath, lm.adminAuth(lm.handleReset()))
+	m.HandleFunc(shadowLoginPath, lm.shadowLogin())
 	m.HandleFunc("/guaclogin/", lm.guacLogin())
+	m.HandleFunc(labPagePath, lm.handleLab())
 	m.HandleFunc("/guacamole/", lm.proxyHandler())
 	m.HandleFunc("/challengesFrontend", lm.handleFrontendChallengesRequest())
 
+	if lm.lti != nil {
+		m.HandleFunc("/lti/login", lm.handleLTILogin())
+		m.HandleFunc(ltiLaunchPath, lm.handleLTILaunch())
+		m.HandleFunc("/lti/deeplink/", lm.handleLTIDeepLink())
+		m.HandleFunc("/lti/jwks", lm.handleLTIKeySet())
+		m.HandleFunc(ltiLabPath, lm.handleLTILab(lm.getOrCreateEnvironment()))
+	}
+
+	if lm.reconciler != nil {
+		m.HandleFunc(reconcileAdminPath, lm.adminAuth(lm.handleReconcile()))
+	}
+	if lm.prefetch != nil {
+		m.HandleFunc(prefetchAdminPath, lm.adminAuth(lm.handlePrefetch()))
+	}
+
 	m.Handle("/assets/", http.StripPrefix("/assets", http.FileServer(http.Dir("resources/public"))))
 
-	return m
+	return lm.secure(m)
 }
 
 func (lm *LearningMaterialAPI) handleIndex() http.HandlerFunc {
@@ -81,6 +118,16 @@ func (lm *LearningMaterialAPI) handleRequest(next http.Handler, username, passwo
 		// No need to sanitize the url requested
 		//https://stackoverflow.com/questions/23285364/does-go-sanitize-urls-for-web-requests
 
+		//A bundle is launched as the lab of its challenges
+		r, err := lm.resolveBundle(r)
+		if err != nil {
+			errorPage(w, r, http.StatusNotFound, returnError{
+				Content:         errorBundleNotFound,
+				Toomanyrequests: false,
+			})
+			return
+		}
+
 		_, challenges, err := lm.GetChallengesFromRequest(r.URL.Query().Get(requestedChallenges))
 		if err != nil {
 			errorPage(w, r, http.StatusBadRequest, returnError{
@@ -108,8 +155,35 @@ func (lm *LearningMaterialAPI) handleRequest(next http.Handler, username, passwo
 			}
 		}
 
+		//The labs booked by a reservation are held back from the other requests,
+		//its access code gets one of them instead
+		var res *reservation
+		if code := r.URL.Query().Get(reservationCodeParam); code != "" {
+			var ok bool
+			res, ok = lm.reservations.Find(code, r.URL.Query().Get(requestedChallenges))
+			if !ok {
+				errorPage(w, r, http.StatusForbidden, returnError{
+					Content:         errorReservationCode,
+					Toomanyrequests: false,
+				})
+				return
+			}
+			var clientID string
+			if cookie, err := r.Cookie(sessionCookie); err == nil {
+				clientID, _ = GetTokenFromCookie(cookie.Value, lm.conf.API.SignKey)
+			}
+			if !lm.reservations.HasRoom(res, clientID) {
+				errorPage(w, r, http.StatusServiceUnavailable, returnError{
+					Content:         errorReservationFull,
+					Toomanyrequests: true,
+				})
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), reservationKey{}, res))
+		}
+
 		//Check if the API can handle another request
-		if len(lm.ClientRequestStore.GetAllRequests()) > lm.conf.API.TotalMaxRequest {
+		if res == nil && lm.reachedMaxRequests() {
 			log.Info().Msg("API reached the maximum number of requests it can handles")
 			errorPage(w, r, http.StatusServiceUnavailable, returnError{
 				Content:         errorAPIRequests,
@@ -138,6 +212,9 @@ func (lm *LearningMaterialAPI) handleRequest(next http.Handler, username, passwo
 					// request a password to be used for the challenge.
 
 					formActionURL := fmt.Sprintf("/api/?%s=%s", requestedChallenges, r.URL.Query().Get(requestedChallenges))
+					if res != nil {
+						formActionURL += fmt.Sprintf("&%s=%s", reservationCodeParam, r.URL.Query().Get(reservationCodeParam))
+					}
 
 					w.WriteHeader(http.StatusBadRequest)
 					w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -154,6 +231,13 @@ func (lm *LearningMaterialAPI) handleRequest(next http.Handler, username, passwo
 	}
 }
 
+//Check if the API reached the maximum number of requests it can handle, counting the labs held back
+//for the reservations, or too many labs are already waiting for the resources of the host
+func (lm *LearningMaterialAPI) reachedMaxRequests() bool {
+	requests := len(lm.ClientRequestStore.GetAllRequests()) + lm.reservations.HeldBack()
+	return requests > lm.conf.API.TotalMaxRequest || lm.admission.QueueFull()
+}
+
 func (lm *LearningMaterialAPI) BasicAuth(handler http.HandlerFunc, username, password, realm string) http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -194,7 +278,7 @@ func (lm *LearningMaterialAPI) getOrCreateClient(next http.Handler) http.Handler
 				})
 				return
 			}
-			go lm.CreateEnvironment(client, r.URL.Query().Get(requestedChallenges))
+			lm.createEnvironmentFor(r, client, r.URL.Query().Get(requestedChallenges))
 
 			http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: token, Path: "/"})
 			WaitingResponse(w)
@@ -245,15 +329,15 @@ func (lm *LearningMaterialAPI) getOrCreateEnvironment() http.HandlerFunc {
 				})
 				return
 			}
-			go lm.CreateEnvironment(client, chals)
+			lm.createEnvironmentFor(r, client, chals)
 			WaitingResponse(w)
 			return
 		}
 
-		//Check for error while creating the environment
-		select {
-		case err = <-cr.err:
+		//Check for error while creating the environment, the request is removed once reported
+		if err := cr.Err(); err != nil {
 			log.Error().Msgf("Error while creating the environment: %v", err)
+			client.RemoveClientRequest(chals)
 			errorPage(w, r, http.StatusInternalServerError, returnError{
 				Content:         errorCreateEnv,
 				Toomanyrequests: false,
@@ -261,7 +345,6 @@ func (lm *LearningMaterialAPI) getOrCreateEnvironment() http.HandlerFunc {
 			fw := csv.NewWriter(lm.storeFile)
 			writeToCSVFile(fw, []string{time.Now().Format(timeFormat), clientID, client.Host(), chals, err.Error()})
 			return
-		default:
 		}
 
 		//Check if the environment is ready
@@ -274,59 +357,86 @@ func (lm *LearningMaterialAPI) getOrCreateEnvironment() http.HandlerFunc {
 		fw := csv.NewWriter(lm.storeFile)
 		writeToCSVFile(fw, []string{time.Now().Format(timeFormat), clientID, client.Host(), chals, ""})
 
-		host := fmt.Sprintf("/guaclogin/?%s=%s", requestedChallenges, chals)
+		ticket, err := lm.tickets.Issue(client.ID(), chals)
+		if err != nil {
+			log.Error().Msgf("Error creating login ticket: %v", err)
+			errorPage(w, r, http.StatusInternalServerError, returnError{
+				Content:         errorGetCR,
+				Toomanyrequests: false,
+			})
+			return
+		}
+
+		host := fmt.Sprintf("/guaclogin/?%s=%s", loginTicketParam, ticket)
 		http.Redirect(w, r, host, http.StatusFound)
 	}
 }
 
-//Create a new client request, create a new environment and assign it to the client
-//Start a go routine that triggers when the timer expires
-func (lm *LearningMaterialAPI) CreateEnvironment(client Client, chals string) {
+//Create a new client request and start creating the environment in background,
+//the client request is returned straight away so the caller can follow its status
+func (lm *LearningMaterialAPI) CreateEnvironment(client Client, chals string) *ClientRequest {
 
 	log.Info().Str("chals", chals).Str("client", client.ID()).Msg("Creating new Environment")
 
 	cr := client.NewClientRequest(chals)
+	go lm.provisionEnvironment(client, cr, chals)
+
+	return cr
+}
+
+//Create a new environment and assign it to the client, it is created again on transient errors.
+//When it fails the request is marked as failed, which frees the slot of the client
+func (lm *LearningMaterialAPI) provisionEnvironment(client Client, cr *ClientRequest, chals string) {
 
 	chalsTag, sChalTags, _ := lm.GetChallengesFromRequest(chals)
 
-	env, err := lm.NewEnvironment(chalsTag, sChalTags)
+	err := lm.retryProvision(cr, func() error {
+		env, err := lm.NewEnvironment(chalsTag, sChalTags)
+		if err != nil {
+			return err
+		}
+		return lm.startEnvironment(client, cr, chals, env)
+	})
 	if err != nil {
-		go cr.NewError(err)
-		return
+		log.Error().Str("request", cr.ID()).Msgf("Error provisioning the environment: %v", err)
+		cr.NewError(err)
 	}
+}
 
-	err = env.Assign(client, chals)
-	if err != nil {
-		go cr.NewError(err)
-		log.Error().Msg("Error while assigning the environment to the client")
-		err := env.Close()
-		if err != nil {
-			log.Error().Msgf("Error closing the environment through timer, assign function: %s", err.Error())
-		}
-		return
+//Assign the environment to the client and start a go routine that closes it when the timer expires.
+//The environment is closed when it can't be assigned
+func (lm *LearningMaterialAPI) startEnvironment(client Client, cr *ClientRequest, chals string, env Environment) error {
+
+	var rb rollback
+	rb.Add("environment", env.Close)
+
+	if err := env.Assign(client, chals); err != nil {
+		log.Error().Msgf("Error while assigning the environment to the client: %v", err)
+		rb.Run()
+		return err
 	}
+	rb.Commit()
+
+	lm.progress.LabStarted(client.Identity(), cr, time.Now())
+	cr.startIdle(lm.labIdleTimeout(chals))
 
 	//Close the environment from the Timer
 	go func() {
 		<-env.GetTimer().C
 		client.RemoveClientRequest(chals)
+		cr.closeTunnels()
+		lm.progress.LabEnded(client.Identity(), cr, time.Now())
 		err := env.Close()
 		if err != nil {
 			log.Error().Msgf("Error closing the environment through timer: %s", err.Error())
 		}
 	}()
 
+	return nil
 }
 
-//List the Environments running, it can be called only through admin priviledges
-func (lm *LearningMaterialAPI) listEnvs() http.HandlerFunc {
-
-	type ListEnvs struct {
-		Client      string
-		Host        string
-		Environment []string
-	}
-
+//Wrap the admin endpoints, the request is handled only with the admin credentials
+func (lm *LearningMaterialAPI) adminAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		username, password, authOK := r.BasicAuth()
@@ -341,8 +451,23 @@ func (lm *LearningMaterialAPI) listEnvs() http.HandlerFunc {
 			return
 		}
 
+		next(w, r)
+	}
+}
+
+//List the Environments running, it can be called only through admin priviledges
+func (lm *LearningMaterialAPI) listEnvs() http.HandlerFunc {
+
+	type ListEnvs struct {
+		Client      string
+		Host        string
+		Environment []string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
 		clients := lm.ClientRequestStore.GetAllClients()
-		listEnvs := make([]ListEnvs, len(clients))
+		listEnvs := make([]ListEnvs, 0, len(clients))
 
 		for _, c := range clients {
 			le := ListEnvs{
@@ -351,6 +476,9 @@ func (lm *LearningMaterialAPI) listEnvs() http.HandlerFunc {
 				Environment: []string{},
 			}
 			for _, r := range c.GetAllClientRequests() {
+				if r.env == nil { //still being created
+					continue
+				}
 				le.Environment = append(le.Environment, r.env.GetChallenges())
 			}
 			listEnvs = append(listEnvs, le)
@@ -5,7 +5,7 @@ import (
 	"fmt"
 	proto "github.com/aau-network-security/haaukins/exercise/ex-proto"
 	"io"
-	"net/http"
+	"net"
 	"os"
 
 	"github.com/aau-network-security/haaukins/svcs/guacamole"
@@ -19,36 +19,39 @@ import (
 type LearningMaterialAPI struct {
 	conf *Config
 	ClientRequestStore
-	captcha   Recaptcha
-	exClient  proto.ExerciseStoreClient
-	vlib      vbox.Library
-	frontend  []store.InstanceConfig
-	storeFile *os.File
-	closers   []io.Closer
-	guacamole guacamole.Guacamole
+	captcha          Recaptcha
+	exClient         proto.ExerciseStoreClient
+	frontends        []labFrontend
+	frontendProfiles []frontendProfile
+	storeFile        *os.File
+	closers          []io.Closer
+	guacamole        guacamole.Guacamole
+	guacAdmin        *guacAdmin
+	guacProxy        *guacProxy
+	tickets          *ticketStore
+	lti              *ltiTool
+	shadows          *shadowStore
+	audit            *auditLog
+	progress         *progressStore
+	recordings       *recordingStore
+	admission        *admission
+	scheduler        *labScheduler
+	reservations     *reservationStore
+	reconciler       *reconciler
+	prefetch         *prefetcher
+	catalogHub       *catalogHub
+	catalogWatcher   *catalogWatcher
+	bundles          *bundleStore
 }
 
 func New(conf *Config, isTest bool) (*LearningMaterialAPI, error) {
 
 	vlib := vbox.NewLibrary(conf.OvaDir)
-	frontends := []store.InstanceConfig{{
-		Image:    conf.API.FrontEnd.Image,
-		MemoryMB: conf.API.FrontEnd.Memory,
-	}}
+	frontends := newLabFrontends([]FrontendConfig{conf.API.FrontEnd})
 
-	exServiceConfig := store.ServiceConfig{
-		Grpc:     conf.ExerciseService.Grpc,
-		AuthKey:  conf.ExerciseService.AuthKey,
-		SignKey:  conf.ExerciseService.SignKey,
-		Enabled:  conf.ExerciseService.CertConfig.Enabled,
-		CertFile: conf.ExerciseService.CertConfig.CertFile,
-		CertKey:  conf.ExerciseService.CertConfig.CertKey,
-		CAFile:   conf.ExerciseService.CertConfig.CAFile,
-	}
-
-	exServiceClient, err := store.NewExerciseClientConn(exServiceConfig)
+	exServiceClient, err := newExerciseClient(conf)
 	if err != nil {
-		return nil, fmt.Errorf("[Exercise Service] Error creating gRPC connection to exercise service: %v", err)
+		return nil, err
 	}
 	log.Info().Msg("Connected to exersice service!!")
 
@@ -56,7 +59,41 @@ func New(conf *Config, isTest bool) (*LearningMaterialAPI, error) {
 
 	sf, err := os.OpenFile(conf.API.StoreFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 
+	var lti *ltiTool
+	if conf.LTI.Enabled {
+		lti, err = newLTITool(conf.LTI)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	audit, err := newAuditLog(conf.API.AuditFile)
+	if err != nil {
+		return nil, fmt.Errorf("[Audit] Error opening audit file: %v", err)
+	}
+	progress, err := newProgressStore(conf.API.ProgressFile)
+	if err != nil {
+		return nil, fmt.Errorf("[Progress] Error reading progress file: %v", err)
+	}
+	bundles, err := newBundleStore(conf.API.BundlesFile)
+	if err != nil {
+		return nil, fmt.Errorf("[Bundles] Error reading bundles file: %v", err)
+	}
+	closers := []io.Closer{crs, sf, audit, progress}
+
+	var recordings *recordingStore
+	if conf.Recordings.Enabled {
+		recordings, err = newRecordingStore(conf.Recordings)
+		if err != nil {
+			return nil, fmt.Errorf("[Recordings] Error creating recordings directory: %v", err)
+		}
+		go recordings.pruneLoop()
+		closers = append(closers, recordings)
+	}
+
 	var guac guacamole.Guacamole
+	var guacAdm *guacAdmin
+	var guacProxy *guacProxy
 	if !isTest {
 		ctx := context.Background()
 		guac, err = guacamole.New(ctx, guacamole.Config{}, 0)
@@ -69,32 +106,143 @@ func New(conf *Config, isTest bool) (*LearningMaterialAPI, error) {
 			log.Error().Msgf("Error while starting guacamole %s", err.Error())
 			return nil, err
 		}
+		guacAdm = newGuacAdmin(guac)
+		guacProxy = newGuacProxy(guac.GetPort())
 	}
 
-	return &LearningMaterialAPI{
+	lm := &LearningMaterialAPI{
 		conf:               conf,
 		ClientRequestStore: crs,
 		captcha:            NewRecaptcha(conf.API.Captcha.SecretKey),
 		exClient:           exServiceClient,
-		vlib:               vlib,
-		frontend:           frontends,
+		frontends:          frontends,
+		frontendProfiles:   newFrontendProfiles(conf.API.FrontendProfiles),
 		storeFile:          sf,
-		closers:            []io.Closer{crs, sf, guac},
+		closers:            append(closers, guac),
 		guacamole:          guac,
-	}, nil
+		guacAdmin:          guacAdm,
+		guacProxy:          guacProxy,
+		tickets:            newTicketStore(),
+		lti:                lti,
+		shadows:            newShadowStore(),
+		audit:              audit,
+		progress:           progress,
+		bundles:            bundles,
+		recordings:         recordings,
+		admission:          newAdmission(conf.Admission),
+	}
+
+	//The labs run on this host and/or on the workers
+	local := newWorker("local", vlib, conf.Worker.MaxLabs, conf.Worker.HostIP, lm.admission)
+	lm.scheduler = &labScheduler{}
+	if !conf.Scheduler.DisableLocal {
+		lm.scheduler.workers = append(lm.scheduler.workers, local)
+	}
+	for _, wc := range conf.Scheduler.Workers {
+		rw, err := newRemoteWorker(wc)
+		if err != nil {
+			return nil, fmt.Errorf("[Scheduler] Error connecting to worker %s: %v", wc.Name, err)
+		}
+		lm.scheduler.workers = append(lm.scheduler.workers, rw)
+	}
+	lm.closers = append(lm.closers, local)
+
+	//The resources left behind by the labs of this instance are removed at startup and periodically
+	if !isTest && !conf.Reconciler.Disabled {
+		host, err := newDockerVBoxHost()
+		if err != nil {
+			return nil, fmt.Errorf("[Reconciler] Error connecting to docker: %v", err)
+		}
+		lm.reconciler, err = newReconciler(conf.Reconciler, host, local)
+		if err != nil {
+			return nil, fmt.Errorf("[Reconciler] Error reading state file: %v", err)
+		}
+		local.resources = lm.reconciler
+	}
+
+	if conf.Worker.Enabled {
+		lis, err := net.Listen("tcp", conf.Worker.Listen)
+		if err != nil {
+			return nil, fmt.Errorf("[Worker] Error listening on %s: %v", conf.Worker.Listen, err)
+		}
+		srv, err := serveWorker(lis, local, conf.Worker)
+		if err != nil {
+			return nil, fmt.Errorf("[Worker] Error serving the labs: %v", err)
+		}
+		log.Info().Msgf("Worker serving labs on %s", conf.Worker.Listen)
+		lm.closers = append(lm.closers, srv)
+	}
+
+	lm.reservations = newReservationStore(conf.Reservations.PrewarmLead, lm.newReservedEnvironment)
+	go lm.reservations.loop()
+	lm.closers = append([]io.Closer{lm.reservations}, lm.closers...)
+
+	if conf.Prefetch.Enabled && !isTest {
+		host, err := newDockerImageHost(conf.DockerRepositories)
+		if err != nil {
+			return nil, fmt.Errorf("[Prefetch] Error connecting to docker: %v", err)
+		}
+		var ovas []string
+		for _, f := range append([]FrontendConfig{conf.API.FrontEnd}, profileFrontends(conf.API.FrontendProfiles)...) {
+			ovas = append(ovas, f.Image)
+		}
+		lm.prefetch = newPrefetcher(conf.Prefetch, host, lm.exerciseCatalog, conf.OvaDir, ovas)
+		go lm.prefetch.loop()
+		lm.closers = append([]io.Closer{lm.prefetch}, lm.closers...)
+	}
+
+	lm.catalogHub = newCatalogHub()
+	lm.closers = append([]io.Closer{lm.catalogHub}, lm.closers...)
+	if conf.API.CatalogPoll >= 0 && !isTest {
+		lm.catalogWatcher = newCatalogWatcher(lm.catalogHub, conf.API.CatalogPoll, lm.getChallengeCatalog, lm.prefetch.Refresh)
+		go lm.catalogWatcher.loop()
+		lm.closers = append([]io.Closer{lm.catalogWatcher}, lm.closers...)
+	}
+
+	if lm.reconciler != nil {
+		go lm.reconciler.loop()
+		lm.closers = append([]io.Closer{lm.reconciler}, lm.closers...)
+	}
+
+	idle := newIdleReaper(lm)
+	go idle.loop()
+	lm.closers = append([]io.Closer{idle}, lm.closers...)
+
+	return lm, nil
+}
+
+// Connect to the exercise service of the configuration
+func newExerciseClient(conf *Config) (proto.ExerciseStoreClient, error) {
+	exServiceConfig := store.ServiceConfig{
+		Grpc:     conf.ExerciseService.Grpc,
+		AuthKey:  conf.ExerciseService.AuthKey,
+		SignKey:  conf.ExerciseService.SignKey,
+		Enabled:  conf.ExerciseService.CertConfig.Enabled,
+		CertFile: conf.ExerciseService.CertConfig.CertFile,
+		CertKey:  conf.ExerciseService.CertConfig.CertKey,
+		CAFile:   conf.ExerciseService.CertConfig.CAFile,
+	}
+
+	exServiceClient, err := store.NewExerciseClientConn(exServiceConfig)
+	if err != nil {
+		return nil, fmt.Errorf("[Exercise Service] Error creating gRPC connection to exercise service: %v", err)
+	}
+	return exServiceClient, nil
 }
 
 func (lm *LearningMaterialAPI) Run() {
 	log.Info().Msg("API ready to get requests")
 	if lm.conf.TLS.Enabled {
 		log.Info().Msgf("API running in SECURE mode under port: %d", lm.conf.Port.Secure)
-		if err := http.ListenAndServeTLS(fmt.Sprintf(":%d", lm.conf.Port.Secure), lm.conf.TLS.CertFile, lm.conf.TLS.CertKey, lm.Handler()); err != nil {
+		srv := lm.newServer(fmt.Sprintf(":%d", lm.conf.Port.Secure))
+		if err := srv.ListenAndServeTLS(lm.conf.TLS.CertFile, lm.conf.TLS.CertKey); err != nil {
 			log.Warn().Msgf("Serving error: %s", err)
 		}
 		return
 	}
 	log.Info().Msgf("API running under port: %d", lm.conf.Port.InSecure)
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", lm.conf.Port.InSecure), lm.Handler()); err != nil {
+	srv := lm.newServer(fmt.Sprintf(":%d", lm.conf.Port.InSecure))
+	if err := srv.ListenAndServe(); err != nil {
 		log.Warn().Msgf("Serving error: %s", err)
 	}
 }
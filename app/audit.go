@@ -0,0 +1,89 @@
+package app
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	auditRecordingStarted    = "recording.started"
+	auditShadowStarted       = "shadow.started"
+	auditLabExtended         = "lab.extended"
+	auditLabRestarted        = "lab.restarted"
+	auditExerciseReset       = "exercise.reset"
+	auditLabResetFailed      = "lab.reset-failed"
+	auditLabIdleClosed       = "lab.idle-closed"
+	auditLabClosed           = "lab.closed"
+	auditReservationCreated  = "reservation.created"
+	auditReservationRemoved  = "reservation.removed"
+	auditResourcesReconciled = "resources.reconciled"
+	auditBundleSaved         = "bundle.saved"
+	auditBundleRemoved       = "bundle.removed"
+)
+
+// auditEvent is a line of the audit log, it records who did what on which lab
+type auditEvent struct {
+	Time    time.Time         `json:"time"`
+	Action  string            `json:"action"`
+	Actor   string            `json:"actor"`
+	Client  string            `json:"client,omitempty"`
+	Request string            `json:"request,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// auditLog appends the events as JSON lines to the audit file, when no file is
+// configured the events end up only in the API log
+type auditLog struct {
+	m sync.Mutex
+	f *os.File
+}
+
+func newAuditLog(path string) (*auditLog, error) {
+	if path == "" {
+		return &auditLog{}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{f: f}, nil
+}
+
+func (a *auditLog) Record(e auditEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	log.Info().
+		Str("action", e.Action).
+		Str("actor", e.Actor).
+		Str("client", e.Client).
+		Str("request", e.Request).
+		Msg("Audit event")
+
+	if a == nil || a.f == nil {
+		return
+	}
+
+	raw, err := json.Marshal(e)
+	if err != nil {
+		log.Error().Msgf("Error encoding audit event: %v", err)
+		return
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+	if _, err := a.f.Write(append(raw, '\n')); err != nil {
+		log.Error().Msgf("Error writing audit event: %v", err)
+	}
+}
+
+func (a *auditLog) Close() error {
+	if a == nil || a.f == nil {
+		return nil
+	}
+	return a.f.Close()
+}
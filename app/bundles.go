@@ -0,0 +1,239 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	bundlesAdminPath = "/admin/bundles/"
+	bundlesAPIPath   = "/api/v1/bundles"
+	bundleParam      = "bundle"
+
+	errorBundleNotFound = "The bundle of challenges requested doesn't exist"
+)
+
+var (
+	ErrBundleNotFound = errors.New("bundle not found")
+
+	bundleName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+)
+
+// bundle is a named path of challenges, eg. web-101, launched as one lab
+type bundle struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Challenges  []string `json:"challenges"` //in the order they are meant to be solved
+}
+
+// Challenges of the bundle as requested in the `challenges` parameter
+func (b bundle) Chals() string {
+	return strings.Join(b.Challenges, ",")
+}
+
+// bundleStore keeps the bundles defined by the admins, they are saved to the bundles file,
+// when configured, so they outlive the API
+type bundleStore struct {
+	m       sync.RWMutex
+	path    string
+	bundles map[string]bundle
+}
+
+func newBundleStore(path string) (*bundleStore, error) {
+	bs := &bundleStore{path: path, bundles: map[string]bundle{}}
+	if path == "" {
+		return bs, nil
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return bs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var bundles []bundle
+	if err := json.Unmarshal(raw, &bundles); err != nil {
+		return nil, err
+	}
+	for _, b := range bundles {
+		bs.bundles[b.Name] = b
+	}
+	return bs, nil
+}
+
+func (bs *bundleStore) Get(name string) (bundle, bool) {
+	bs.m.RLock()
+	defer bs.m.RUnlock()
+	b, ok := bs.bundles[strings.ToLower(name)]
+	return b, ok
+}
+
+// Put creates or replaces a bundle
+func (bs *bundleStore) Put(b bundle) {
+	bs.m.Lock()
+	defer bs.m.Unlock()
+	bs.bundles[b.Name] = b
+	bs.save()
+}
+
+func (bs *bundleStore) Remove(name string) error {
+	bs.m.Lock()
+	defer bs.m.Unlock()
+	if _, ok := bs.bundles[name]; !ok {
+		return ErrBundleNotFound
+	}
+	delete(bs.bundles, name)
+	bs.save()
+	return nil
+}
+
+func (bs *bundleStore) List() []bundle {
+	bs.m.RLock()
+	defer bs.m.RUnlock()
+	return bs.list()
+}
+
+func (bs *bundleStore) list() []bundle {
+	bundles := make([]bundle, 0, len(bs.bundles))
+	for _, b := range bs.bundles {
+		bundles = append(bundles, b)
+	}
+	sort.Slice(bundles, func(i, j int) bool { return bundles[i].Name < bundles[j].Name })
+	return bundles
+}
+
+// Save the bundles, the file is replaced at once so it is never left half written
+func (bs *bundleStore) save() {
+	if bs.path == "" {
+		return
+	}
+
+	raw, err := json.Marshal(bs.list())
+	if err != nil {
+		log.Error().Msgf("Error encoding bundles: %v", err)
+		return
+	}
+	tmp := bs.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		log.Error().Msgf("Error writing bundles file: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, bs.path); err != nil {
+		log.Error().Msgf("Error replacing bundles file: %v", err)
+	}
+}
+
+// Replace the `bundle` parameter of a request with the challenges of the bundle, in its order
+func (lm *LearningMaterialAPI) resolveBundle(r *http.Request) (*http.Request, error) {
+	q := r.URL.Query()
+	name := q.Get(bundleParam)
+	if name == "" {
+		return r, nil
+	}
+	b, ok := lm.bundles.Get(name)
+	if !ok {
+		return r, ErrBundleNotFound
+	}
+
+	q.Del(bundleParam)
+	q.Set(requestedChallenges, b.Chals())
+	r = r.Clone(r.Context())
+	r.URL.RawQuery = q.Encode()
+	return r, nil
+}
+
+// Handle the requests made to `GET /api/v1/bundles`, the bundles the users can launch
+func (lm *LearningMaterialAPI) handleBundles() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		bundles := lm.bundles.List()
+		type launchable struct {
+			bundle
+			URL string `json:"url"`
+		}
+		list := make([]launchable, len(bundles))
+		for i, b := range bundles {
+			list[i] = launchable{bundle: b, URL: "/api/?" + url.Values{bundleParam: {b.Name}}.Encode()}
+		}
+		writeJSON(w, http.StatusOK, list)
+	}
+}
+
+// Handle the requests made to `/admin/bundles/`: `GET` lists the bundles, `PUT /admin/bundles/{name}`
+// creates or replaces a bundle with the body `{"description": "...", "challenges": ["xss", "sql"]}`
+// and `DELETE /admin/bundles/{name}` removes it
+func (lm *LearningMaterialAPI) handleAdminBundles() http.HandlerFunc {
+
+	type bundleRequest struct {
+		Description string   `json:"description"`
+		Challenges  []string `json:"challenges"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, _, _ := r.BasicAuth()
+		name := strings.ToLower(strings.Trim(strings.TrimPrefix(r.URL.Path, bundlesAdminPath), "/"))
+
+		switch {
+		case r.Method == http.MethodGet && name == "":
+			writeJSON(w, http.StatusOK, lm.bundles.List())
+
+		case r.Method == http.MethodPut && name != "":
+			if !bundleName.MatchString(name) {
+				writeJSONError(w, http.StatusBadRequest, "the name of a bundle has only lowercase letters, digits and dashes")
+				return
+			}
+			var req bundleRequest
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			b := bundle{Name: name, Description: strings.TrimSpace(req.Description), Challenges: cleanChallenges(req.Challenges)}
+			if len(b.Challenges) == 0 {
+				writeJSONError(w, http.StatusBadRequest, errorChallengesTag)
+				return
+			}
+			if _, _, err := lm.GetChallengesFromRequest(b.Chals()); err != nil {
+				writeJSONError(w, http.StatusBadRequest, errorChallengesTag)
+				return
+			}
+
+			lm.bundles.Put(b)
+			lm.audit.Record(auditEvent{
+				Action:  auditBundleSaved,
+				Actor:   "admin:" + admin,
+				Details: map[string]string{"bundle": b.Name, "challenges": b.Chals()},
+			})
+			writeJSON(w, http.StatusOK, b)
+
+		case r.Method == http.MethodDelete && name != "":
+			if err := lm.bundles.Remove(name); err != nil {
+				writeJSONError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			lm.audit.Record(auditEvent{
+				Action:  auditBundleRemoved,
+				Actor:   "admin:" + admin,
+				Details: map[string]string{"bundle": name},
+			})
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
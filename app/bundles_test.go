@@ -0,0 +1,79 @@
+package app
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalizeChallenges(t *testing.T) {
+	for chals, want := range map[string]string{
+		"a,b":          "a,b",
+		"b,a":          "a,b",
+		" B , a,b,,A ": "a,b",
+		"":             "",
+	} {
+		if got := normalizeChallenges(chals); got != want {
+			t.Errorf("%q: expected %q, got %q", chals, want, got)
+		}
+	}
+
+	client := NewClientRequestStore().NewClient("127.0.0.1")
+	cr := client.NewClientRequest("sql,xss")
+	if got, err := client.GetClientRequest("XSS,sql"); err != nil || got != cr {
+		t.Fatalf("expected the same challenges in another order to be the same lab")
+	}
+	if cr.Challenges() != "sql,xss" {
+		t.Errorf("expected the challenges to keep the order requested, got %q", cr.Challenges())
+	}
+	client.RemoveClientRequest("xss,sql")
+	if _, err := client.GetClientRequest("sql,xss"); err == nil {
+		t.Errorf("expected the lab to be removed")
+	}
+}
+
+func TestBundles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundles")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bundles.json")
+
+	bs, err := newBundleStore(path)
+	if err != nil {
+		t.Fatalf("unable to create bundle store: %v", err)
+	}
+	bs.Put(bundle{Name: "web-101", Description: "Start with the web", Challenges: []string{"xss", "sql", "csrf"}})
+	bs.Put(bundle{Name: "forensics-week-3", Challenges: []string{"mem"}})
+	if err := bs.Remove("forensics-week-3"); err != nil {
+		t.Fatalf("unable to remove bundle: %v", err)
+	}
+	if err := bs.Remove("forensics-week-3"); err != ErrBundleNotFound {
+		t.Errorf("expected removing a missing bundle to fail, got %v", err)
+	}
+
+	//The bundles outlive the API
+	bs, err = newBundleStore(path)
+	if err != nil {
+		t.Fatalf("unable to read bundles file: %v", err)
+	}
+	if list := bs.List(); len(list) != 1 || list[0].Chals() != "xss,sql,csrf" {
+		t.Fatalf("unexpected bundles: %+v", list)
+	}
+
+	lm := &LearningMaterialAPI{bundles: bs}
+	r, err := lm.resolveBundle(httptest.NewRequest("GET", "/api/?bundle=Web-101&code=K7PX2M9Q", nil))
+	if err != nil {
+		t.Fatalf("unable to resolve bundle: %v", err)
+	}
+	q := r.URL.Query()
+	if q.Get(requestedChallenges) != "xss,sql,csrf" || q.Get(bundleParam) != "" || q.Get(reservationCodeParam) != "K7PX2M9Q" {
+		t.Errorf("unexpected query: %s", r.URL.RawQuery)
+	}
+	if _, err := lm.resolveBundle(httptest.NewRequest("GET", "/api/?bundle=web-102", nil)); err != ErrBundleNotFound {
+		t.Errorf("expected an unknown bundle to fail, got %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aau-network-security/haaukins/store"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	catalogAdminPath = "/admin/catalog/"
+
+	uncategorizedName = "Uncategorized"
+	uncategorizedTag  = "uncategorized"
+
+	anomalyNoCategory       = "no-category"       //the exercise has neither a category nor flags
+	anomalyUnknownCategory  = "unknown-category"  //the category is not listed by the exercise service
+	anomalyCategoryMismatch = "category-mismatch" //the category matched only by tag or in another casing
+)
+
+// catalogAnomaly is an exercise whose category doesn't match the categories of the exercise service
+type catalogAnomaly struct {
+	Exercise string `json:"exercise"`
+	Kind     string `json:"kind"`
+	Category string `json:"category,omitempty"` //the category of the exercise
+	Matched  string `json:"matched,omitempty"`  //tag of the category it was put in
+}
+
+// Categories of an exercise: its own and the ones of its flags, without duplicates
+func exerciseCategories(e store.Exercise) []string {
+	var categories []string
+	seen := map[string]bool{}
+	add := func(c string) {
+		c = strings.TrimSpace(c)
+		if c == "" || seen[strings.ToLower(c)] {
+			return
+		}
+		seen[strings.ToLower(c)] = true
+		categories = append(categories, c)
+	}
+
+	add(e.Category)
+	for _, i := range e.Instance {
+		for _, f := range i.Flags {
+			add(f.Category)
+		}
+	}
+	return categories
+}
+
+// Group the challenges of the exercises by the categories of the exercise service. A category
+// of an exercise matches a category by its name, or by its tag or name in any casing, the latter
+// reported as a mismatch. An exercise is listed in each of its categories, the exercises matching
+// none are listed in the Uncategorized category
+func buildCatalog(cats []store.Category, exers []store.Exercise, challenge func(store.Exercise) Challenge) ([]Category, []catalogAnomaly) {
+	categories := make([]Category, 0, len(cats)+1)
+	byName := map[string]int{}
+	byFold := map[string]int{}
+	for i, c := range cats {
+		tag := strings.ToLower(string(c.Tag))
+		categories = append(categories, Category{Name: c.Name, Tag: tag, Challenges: []Challenge{}})
+		byName[c.Name] = i
+		byFold[tag] = i
+		if _, ok := byFold[strings.ToLower(c.Name)]; !ok {
+			byFold[strings.ToLower(c.Name)] = i
+		}
+	}
+
+	anomalies := []catalogAnomaly{}
+	var uncategorized []Challenge
+	for _, e := range exers {
+		chal := challenge(e)
+		names := exerciseCategories(e)
+		if len(names) == 0 {
+			anomalies = append(anomalies, catalogAnomaly{Exercise: string(e.Tag), Kind: anomalyNoCategory, Matched: uncategorizedTag})
+		}
+
+		listed := map[int]bool{}
+		for _, name := range names {
+			i, ok := byName[name]
+			if !ok {
+				if i, ok = byFold[strings.ToLower(name)]; ok {
+					anomalies = append(anomalies, catalogAnomaly{
+						Exercise: string(e.Tag),
+						Kind:     anomalyCategoryMismatch,
+						Category: name,
+						Matched:  categories[i].Tag,
+					})
+				}
+			}
+			if !ok {
+				anomalies = append(anomalies, catalogAnomaly{Exercise: string(e.Tag), Kind: anomalyUnknownCategory, Category: name})
+				continue
+			}
+			if !listed[i] {
+				listed[i] = true
+				categories[i].Challenges = append(categories[i].Challenges, chal)
+			}
+		}
+
+		if len(listed) == 0 {
+			uncategorized = append(uncategorized, chal)
+		}
+	}
+
+	if len(uncategorized) > 0 {
+		categories = append(categories, Category{Name: uncategorizedName, Tag: uncategorizedTag, Challenges: uncategorized})
+	}
+	return categories, anomalies
+}
+
+// Challenge of an exercise shown in the catalog
+func (lm *LearningMaterialAPI) newChallenge(e store.Exercise) Challenge {
+	chal := Challenge{
+		Name:        e.Name,
+		Tag:         string(e.Tag),
+		Ready:       lm.prefetch.ExerciseReady(string(e.Tag)),
+		Description: e.OrgDescription,
+		Cost:        lm.exerciseCost(e),
+	}
+
+	for _, i := range e.Instance {
+		for _, f := range i.Flags {
+			chal.flags = append(chal.flags, string(f.Tag))
+			chal.Points += f.Points
+			if chal.Description == "" {
+				chal.Description = f.TeamDescription
+			}
+		}
+		if len(i.Flags) > 1 {
+			chal.Name += " ("
+			for _, f := range i.Flags {
+				chal.Name += f.Name + ", "
+			}
+			chal.Name = strings.TrimRight(chal.Name, ", ") + ")"
+		}
+	}
+
+	chal.Flags = len(chal.flags)
+	chal.Difficulty = challengeDifficulty(chal.Points)
+	return chal
+}
+
+// Get the categories and the exercises of the exercise service
+func (lm *LearningMaterialAPI) catalogSources() ([]store.Category, []store.Exercise, error) {
+	cats, err := lm.getChallengeCategories()
+	if err != nil {
+		return nil, nil, err
+	}
+	exers, err := lm.exerciseCatalog()
+	if err != nil {
+		return nil, nil, fmt.Errorf("[exercise-service] Error getting exercises: %v", err)
+	}
+	return cats, exers, nil
+}
+
+// ChallengeCatalog gets the catalog from the exercise service of the configuration, without
+// starting the API. The secret challenges are not included
+func ChallengeCatalog(conf *Config) ([]Category, error) {
+	exClient, err := newExerciseClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	lm := &LearningMaterialAPI{conf: conf, exClient: exClient}
+	return lm.getChallengeCatalog()
+}
+
+// categorySummary is the number of challenges listed in a category
+type categorySummary struct {
+	Name       string `json:"name"`
+	Tag        string `json:"tag"`
+	Challenges int    `json:"challenges"`
+}
+
+// catalogReport is how the exercises of the exercise service fit its categories
+type catalogReport struct {
+	Categories []categorySummary `json:"categories"`
+	Anomalies  []catalogAnomaly  `json:"anomalies"`
+}
+
+// Handle the requests made to `GET /admin/catalog/`: the challenges listed in each category and
+// the exercises whose categories don't match, the secret exercises included
+func (lm *LearningMaterialAPI) handleCatalog() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		cats, exers, err := lm.catalogSources()
+		if err != nil {
+			log.Error().Msgf("Error getting the challenge catalog: %v", err)
+			writeJSONError(w, http.StatusBadGateway, errorCatalog)
+			return
+		}
+
+		categories, anomalies := buildCatalog(cats, exers, lm.newChallenge)
+		report := catalogReport{Categories: []categorySummary{}, Anomalies: anomalies}
+		for _, c := range categories {
+			report.Categories = append(report.Categories, categorySummary{Name: c.Name, Tag: c.Tag, Challenges: len(c.Challenges)})
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
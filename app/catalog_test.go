@@ -0,0 +1,108 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/aau-network-security/haaukins/store"
+)
+
+func fixtureExercise(tag string, categories ...string) store.Exercise {
+	e := store.Exercise{Tag: store.Tag(tag), Name: tag}
+	var flags []store.ChildrenChalConfig
+	for _, c := range categories {
+		flags = append(flags, store.ChildrenChalConfig{Tag: store.Tag(tag + "-flag"), Category: c, Points: 10})
+	}
+	if len(flags) > 0 {
+		e.Instance = []store.ExerciseInstanceConfig{{Image: tag, Flags: flags}}
+	}
+	return e
+}
+
+func TestBuildCatalog(t *testing.T) {
+	cats := []store.Category{
+		{Tag: "WEB", Name: "Web Exploitation"},
+		{Tag: "for", Name: "Forensics"},
+		{Tag: "cry", Name: "Cryptography"},
+	}
+	exers := []store.Exercise{
+		fixtureExercise("xss", "Web Exploitation"),
+		fixtureExercise("mem", "forensics"),
+		fixtureExercise("pcap", "for"),
+		fixtureExercise("sqli", "Web Exploitation", "Forensics", "Web Exploitation"),
+		fixtureExercise("nmap"),
+		fixtureExercise("rev", "Reverse Engineering"),
+		{Tag: "rsa", Name: "rsa", Category: "Cryptography"},
+	}
+
+	categories, anomalies := buildCatalog(cats, exers, func(e store.Exercise) Challenge {
+		return Challenge{Name: e.Name, Tag: string(e.Tag)}
+	})
+
+	listed := map[string][]string{}
+	for _, c := range categories {
+		for _, chal := range c.Challenges {
+			listed[c.Tag] = append(listed[c.Tag], chal.Tag)
+		}
+	}
+	want := map[string][]string{
+		"web":            {"xss", "sqli"},
+		"for":            {"mem", "pcap", "sqli"},
+		"cry":            {"rsa"},
+		uncategorizedTag: {"nmap", "rev"},
+	}
+	if len(categories) != 4 || categories[3].Name != uncategorizedName {
+		t.Fatalf("expected the uncategorized exercises to be listed last, got %+v", categories)
+	}
+	for tag, chals := range want {
+		if len(listed[tag]) != len(chals) {
+			t.Fatalf("category %s: expected %v, got %v", tag, chals, listed[tag])
+		}
+		for i := range chals {
+			if listed[tag][i] != chals[i] {
+				t.Fatalf("category %s: expected %v, got %v", tag, chals, listed[tag])
+			}
+		}
+	}
+
+	kinds := map[string]string{}
+	for _, a := range anomalies {
+		kinds[a.Exercise] = a.Kind
+	}
+	wantKinds := map[string]string{
+		"mem":  anomalyCategoryMismatch,
+		"pcap": anomalyCategoryMismatch,
+		"nmap": anomalyNoCategory,
+		"rev":  anomalyUnknownCategory,
+	}
+	if len(anomalies) != len(wantKinds) {
+		t.Fatalf("expected %d anomalies, got %+v", len(wantKinds), anomalies)
+	}
+	for exer, kind := range wantKinds {
+		if kinds[exer] != kind {
+			t.Errorf("exercise %s: expected anomaly %q, got %q", exer, kind, kinds[exer])
+		}
+	}
+
+	if categories, _ := buildCatalog(cats, exers[:1], func(store.Exercise) Challenge { return Challenge{} }); len(categories) != 3 {
+		t.Errorf("expected no uncategorized category without uncategorized exercises")
+	}
+}
+
+func TestNewChallenge(t *testing.T) {
+	lm := &LearningMaterialAPI{conf: &Config{}}
+	e := store.Exercise{Tag: "sql", Name: "SQL", Instance: []store.ExerciseInstanceConfig{{
+		Image: "sql",
+		Flags: []store.ChildrenChalConfig{
+			{Tag: "sql-1", Name: "Login", Points: 10, TeamDescription: "Log in as admin"},
+			{Tag: "sql-2", Name: "Dump", Points: 15},
+		},
+	}}}
+
+	chal := lm.newChallenge(e)
+	if chal.Name != "SQL (Login, Dump)" || chal.Flags != 2 || chal.Points != 25 || chal.Difficulty != difficultyMedium {
+		t.Errorf("unexpected challenge: %+v", chal)
+	}
+	if chal.Description != "Log in as admin" || !chal.Ready {
+		t.Errorf("unexpected challenge: %+v", chal)
+	}
+}
@@ -0,0 +1,148 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/aau-network-security/haaukins/store"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	challengesAPIPath = "/api/v1/challenges"
+
+	difficultyEasy   = "easy"
+	difficultyMedium = "medium"
+	difficultyHard   = "hard"
+
+	errorCatalog = "unable to get the challenges"
+)
+
+// Difficulty of a challenge, derived from the points of its flags
+func challengeDifficulty(points uint) string {
+	switch {
+	case points == 0:
+		return ""
+	case points <= 10:
+		return difficultyEasy
+	case points <= 25:
+		return difficultyMedium
+	default:
+		return difficultyHard
+	}
+}
+
+// Estimate the resources the instances of an exercise take in a lab, the admission estimate
+// is used for the instances without memory
+func (lm *LearningMaterialAPI) exerciseCost(e store.Exercise) labCost {
+	estimate := lm.conf.Admission.ExerciseMemoryMB
+	if estimate == 0 {
+		estimate = admissionExerciseMemoryMB
+	}
+
+	var cost labCost
+	for _, i := range e.Instance {
+		mem := i.MemoryMB
+		if mem == 0 {
+			mem = estimate
+		}
+		cost = cost.add(labCost{MemoryMB: uint64(mem), CPU: i.CPU})
+	}
+	return cost
+}
+
+// Keep the challenges of the category (by tag) and matching the search text, in their name, tag
+// or description. The categories left without challenges are removed
+func filterCatalog(categories []Category, category, search string) []Category {
+	category = strings.ToLower(category)
+	search = strings.ToLower(strings.TrimSpace(search))
+
+	filtered := []Category{}
+	for _, c := range categories {
+		if category != "" && c.Tag != category {
+			continue
+		}
+		fc := Category{Name: c.Name, Tag: c.Tag, Challenges: []Challenge{}}
+		for _, chal := range c.Challenges {
+			if search != "" &&
+				!strings.Contains(strings.ToLower(chal.Name), search) &&
+				!strings.Contains(strings.ToLower(chal.Tag), search) &&
+				!strings.Contains(strings.ToLower(chal.Description), search) {
+				continue
+			}
+			fc.Challenges = append(fc.Challenges, chal)
+		}
+		if len(fc.Challenges) > 0 {
+			filtered = append(filtered, fc)
+		}
+	}
+	return filtered
+}
+
+// Strong ETag of a response body
+func etag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// Whether the If-None-Match header of the request matches the ETag
+func etagMatch(r *http.Request, tag string) bool {
+	for _, t := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == tag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle the requests made to `GET /api/v1/challenges?category={tag}&q={text}`, the same catalog
+// the frontend websocket sends. The catalog polled by the catalog watcher is served, the exercise
+// service is asked only until it was polled. The response carries an ETag, a request with a
+// matching If-None-Match gets a `304 Not Modified`
+func (lm *LearningMaterialAPI) handleChallenges() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		categories, body, tag, ok := lm.catalogWatcher.Catalog()
+		if !ok {
+			var err error
+			categories, err = lm.getChallengeCatalog()
+			if err != nil {
+				log.Error().Msgf("Error getting the challenge catalog: %v", err)
+				writeJSONError(w, http.StatusBadGateway, errorCatalog)
+				return
+			}
+		}
+
+		category, search := r.URL.Query().Get("category"), r.URL.Query().Get("q")
+		if body == nil || category != "" || search != "" {
+			var err error
+			body, err = json.Marshal(filterCatalog(categories, category, search))
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, errorCatalog)
+				return
+			}
+			tag = etag(body)
+		}
+
+		w.Header().Set("ETag", tag)
+		w.Header().Set("Cache-Control", "no-cache")
+		if etagMatch(r, tag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(body)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aau-network-security/haaukins/store"
+)
+
+func TestFilterCatalog(t *testing.T) {
+	categories := []Category{
+		{Name: "Web Exploitation", Tag: "web", Challenges: []Challenge{
+			{Name: "Cross-site scripting", Tag: "xss"},
+			{Name: "SQL injection", Tag: "sql", Description: "Dump the users table"},
+		}},
+		{Name: "Forensics", Tag: "for", Challenges: []Challenge{
+			{Name: "Memory dump", Tag: "mem"},
+		}},
+	}
+
+	tt := []struct {
+		name     string
+		category string
+		search   string
+		want     []string
+	}{
+		{name: "All", want: []string{"xss", "sql", "mem"}},
+		{name: "Category", category: "WEB", want: []string{"xss", "sql"}},
+		{name: "Search name", search: "memory", want: []string{"mem"}},
+		{name: "Search description", search: "users", want: []string{"sql"}},
+		{name: "Search in category", category: "for", search: "sql", want: nil},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, c := range filterCatalog(categories, tc.category, tc.search) {
+				if len(c.Challenges) == 0 {
+					t.Errorf("expected the empty category %s to be removed", c.Tag)
+				}
+				for _, chal := range c.Challenges {
+					got = append(got, chal.Tag)
+				}
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("expected %v, got %v", tc.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestChallengeDetails(t *testing.T) {
+	for points, want := range map[uint]string{0: "", 5: difficultyEasy, 20: difficultyMedium, 40: difficultyHard} {
+		if got := challengeDifficulty(points); got != want {
+			t.Errorf("expected difficulty %q for %d points, got %q", want, points, got)
+		}
+	}
+
+	lm := &LearningMaterialAPI{conf: &Config{}}
+	cost := lm.exerciseCost(store.Exercise{Instance: []store.ExerciseInstanceConfig{
+		{Image: "web", MemoryMB: 512, CPU: 0.5},
+		{Image: "db"},
+	}})
+	if cost.MemoryMB != 512+admissionExerciseMemoryMB || cost.CPU != 0.5 {
+		t.Errorf("unexpected exercise cost: %+v", cost)
+	}
+}
+
+func TestETagMatch(t *testing.T) {
+	tag := etag([]byte(`[{"tag":"web"}]`))
+	if tag != etag([]byte(`[{"tag":"web"}]`)) || tag == etag([]byte(`[]`)) {
+		t.Fatalf("expected the ETag to depend only on the body")
+	}
+
+	for header, want := range map[string]bool{
+		"":                false,
+		tag:               true,
+		"W/" + tag:        true,
+		`"other", ` + tag: true,
+		`"other"`:         false,
+		"*":               true,
+	} {
+		r := httptest.NewRequest("GET", challengesAPIPath, nil)
+		if header != "" {
+			r.Header.Set("If-None-Match", header)
+		}
+		if got := etagMatch(r, tag); got != want {
+			t.Errorf("If-None-Match %q: expected %v, got %v", header, want, got)
+		}
+	}
+}
+
+func TestChallengesCached(t *testing.T) {
+	polls := 0
+	catalog := []Category{
+		{Name: "Web", Tag: "web", Challenges: []Challenge{{Name: "XSS", Tag: "xss"}, {Name: "SQL", Tag: "sql"}}},
+		{Name: "Empty", Tag: "empty"},
+	}
+	cw := newCatalogWatcher(newCatalogHub(), 0, func() ([]Category, error) {
+		polls++
+		return catalog, nil
+	}, nil)
+	lm := &LearningMaterialAPI{conf: &Config{}, catalogWatcher: cw}
+	cw.poll()
+
+	get := func(query, tag string) (*httptest.ResponseRecorder, []Category) {
+		r := httptest.NewRequest(http.MethodGet, challengesAPIPath+query, nil)
+		if tag != "" {
+			r.Header.Set("If-None-Match", tag)
+		}
+		w := httptest.NewRecorder()
+		lm.handleChallenges()(w, r)
+		var categories []Category
+		json.Unmarshal(w.Body.Bytes(), &categories)
+		return w, categories
+	}
+
+	w, categories := get("", "")
+	tag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || len(categories) != 1 || len(categories[0].Challenges) != 2 || tag == "" {
+		t.Fatalf("expected the catalog without empty categories, got %d %+v", w.Code, categories)
+	}
+	if w, _ = get("", tag); w.Code != http.StatusNotModified {
+		t.Errorf("expected the cached catalog not to be modified, got %d", w.Code)
+	}
+	if w, categories = get("?q=sql", ""); len(categories) != 1 || len(categories[0].Challenges) != 1 || w.Header().Get("ETag") == tag {
+		t.Errorf("expected the cached catalog to be filtered, got %+v", categories)
+	}
+	if polls != 1 {
+		t.Errorf("expected the exercise service to be asked only by the watcher, got %d polls", polls)
+	}
+
+	//The catalog changes with the next poll
+	catalog = []Category{{Name: "Web", Tag: "web", Challenges: []Challenge{{Name: "XSS", Tag: "xss"}}}}
+	cw.poll()
+	if w, categories = get("", tag); w.Code != http.StatusOK || len(categories[0].Challenges) != 1 {
+		t.Errorf("expected the new catalog, got %d %+v", w.Code, categories)
+	}
+}
@@ -0,0 +1,247 @@
+package app
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	catalogPollInterval = time.Minute
+
+	msgChallengesAdded   = "challenges_added"
+	msgChallengesRemoved = "challenges_removed"
+	msgChallengesUpdated = "challenges_updated"
+)
+
+// catalogHub keeps the frontend websockets connected, the catalog changes are broadcast to them
+type catalogHub struct {
+	m       sync.Mutex
+	clients map[*FrontendClient]bool
+	closed  bool
+}
+
+func newCatalogHub() *catalogHub {
+	return &catalogHub{clients: map[*FrontendClient]bool{}}
+}
+
+// Register the client to get the catalog changes, false when the hub doesn't take clients anymore
+func (h *catalogHub) Register(c *FrontendClient) bool {
+	if h == nil {
+		return false
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.closed {
+		return false
+	}
+	h.clients[c] = true
+	return true
+}
+
+// Unregister the client, its send channel is closed so its write pump says goodbye
+func (h *catalogHub) Unregister(c *FrontendClient) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.clients[c] {
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
+
+// Broadcast a message to every client, the clients too slow to keep up are dropped
+func (h *catalogHub) Broadcast(msg []byte) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	for c := range h.clients {
+		select {
+		case c.send <- msg:
+		default:
+			delete(h.clients, c)
+			close(c.send)
+		}
+	}
+}
+
+func (h *catalogHub) Clients() int {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return len(h.clients)
+}
+
+func (h *catalogHub) Close() error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.closed = true
+	for c := range h.clients {
+		delete(h.clients, c)
+		close(c.send)
+	}
+	return nil
+}
+
+// catalogChange is a challenge added, removed or updated in a category
+type catalogChange struct {
+	Category     string     `json:"category"`
+	CategoryName string     `json:"category_name,omitempty"`
+	Tag          string     `json:"tag"`
+	Challenge    *Challenge `json:"challenge,omitempty"` //not sent for the removed challenges
+}
+
+type catalogEntry struct {
+	category Category
+	chal     Challenge
+}
+
+func catalogEntries(categories []Category) map[string]catalogEntry {
+	entries := map[string]catalogEntry{}
+	for _, c := range categories {
+		for _, chal := range c.Challenges {
+			entries[c.Tag+"/"+chal.Tag] = catalogEntry{category: c, chal: chal}
+		}
+	}
+	return entries
+}
+
+// Compare two versions of the catalog, a challenge is identified by its tag within its category
+func diffCatalog(old, new []Category) (added, removed, updated []catalogChange) {
+	before, after := catalogEntries(old), catalogEntries(new)
+
+	for key, e := range after {
+		chal := e.chal
+		change := catalogChange{Category: e.category.Tag, CategoryName: e.category.Name, Tag: chal.Tag, Challenge: &chal}
+		prev, ok := before[key]
+		switch {
+		case !ok:
+			added = append(added, change)
+		case !reflect.DeepEqual(prev.chal, e.chal):
+			updated = append(updated, change)
+		}
+	}
+	for key, e := range before {
+		if _, ok := after[key]; !ok {
+			removed = append(removed, catalogChange{Category: e.category.Tag, Tag: e.chal.Tag})
+		}
+	}
+
+	for _, changes := range [][]catalogChange{added, removed, updated} {
+		sort.Slice(changes, func(i, j int) bool {
+			if changes[i].Category != changes[j].Category {
+				return changes[i].Category < changes[j].Category
+			}
+			return changes[i].Tag < changes[j].Tag
+		})
+	}
+	return added, removed, updated
+}
+
+// catalogWatcher polls the catalog of the exercise service and broadcasts its changes. The
+// catalog last polled is kept for the challenges API, together with its JSON and ETag
+type catalogWatcher struct {
+	hub      *catalogHub
+	catalog  func() ([]Category, error)
+	changed  func() //called after a change was broadcast
+	interval time.Duration
+	m        sync.Mutex
+	last     []Category
+	body     []byte
+	tag      string
+	loaded   bool
+	stop     chan struct{}
+	once     sync.Once
+}
+
+func newCatalogWatcher(hub *catalogHub, interval time.Duration, catalog func() ([]Category, error), changed func()) *catalogWatcher {
+	if interval == 0 {
+		interval = catalogPollInterval
+	}
+	return &catalogWatcher{
+		hub:      hub,
+		catalog:  catalog,
+		changed:  changed,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Get the catalog and broadcast what changed since the last poll
+func (cw *catalogWatcher) poll() {
+	categories, err := cw.catalog()
+	if err != nil {
+		log.Error().Msgf("Error polling the challenge catalog: %v", err)
+		return
+	}
+	body, err := json.Marshal(filterCatalog(categories, "", ""))
+	if err != nil {
+		log.Error().Msgf("Error encoding the challenge catalog: %v", err)
+		return
+	}
+
+	cw.m.Lock()
+	last, loaded := cw.last, cw.loaded
+	cw.last, cw.body, cw.tag, cw.loaded = categories, body, etag(body), true
+	cw.m.Unlock()
+	if !loaded {
+		return
+	}
+
+	added, removed, updated := diffCatalog(last, categories)
+	if len(added)+len(removed)+len(updated) == 0 {
+		return
+	}
+
+	log.Info().
+		Int("added", len(added)).
+		Int("removed", len(removed)).
+		Int("updated", len(updated)).
+		Msg("Challenge catalog changed")
+	for _, m := range []struct {
+		msg     string
+		changes []catalogChange
+	}{
+		{msgChallengesRemoved, removed},
+		{msgChallengesAdded, added},
+		{msgChallengesUpdated, updated},
+	} {
+		if len(m.changes) == 0 {
+			continue
+		}
+		raw, _ := json.Marshal(Message{Message: m.msg, Values: m.changes})
+		cw.hub.Broadcast(raw)
+	}
+	if cw.changed != nil {
+		cw.changed()
+	}
+}
+
+// Catalog last polled, with the JSON of the whole catalog and its ETag. False until a poll succeeded
+func (cw *catalogWatcher) Catalog() ([]Category, []byte, string, bool) {
+	if cw == nil {
+		return nil, nil, "", false
+	}
+	cw.m.Lock()
+	defer cw.m.Unlock()
+	return cw.last, cw.body, cw.tag, cw.loaded
+}
+
+func (cw *catalogWatcher) loop() {
+	ticker := time.NewTicker(cw.interval)
+	defer ticker.Stop()
+	for {
+		cw.poll()
+		select {
+		case <-ticker.C:
+		case <-cw.stop:
+			return
+		}
+	}
+}
+
+func (cw *catalogWatcher) Close() error {
+	cw.once.Do(func() { close(cw.stop) })
+	return nil
+}
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDiffCatalog(t *testing.T) {
+	old := []Category{
+		{Name: "Web Exploitation", Tag: "web", Challenges: []Challenge{
+			{Name: "Cross-site scripting", Tag: "xss", Ready: true},
+			{Name: "SQL injection", Tag: "sql", Ready: true},
+		}},
+	}
+	new := []Category{
+		{Name: "Web Exploitation", Tag: "web", Challenges: []Challenge{
+			{Name: "Cross-site scripting", Tag: "xss", Ready: false},
+		}},
+		{Name: "Forensics", Tag: "for", Challenges: []Challenge{
+			{Name: "Memory dump", Tag: "mem"},
+		}},
+	}
+
+	added, removed, updated := diffCatalog(old, new)
+	if len(added) != 1 || added[0].Tag != "mem" || added[0].CategoryName != "Forensics" || added[0].Challenge == nil {
+		t.Errorf("unexpected added challenges: %+v", added)
+	}
+	if len(removed) != 1 || removed[0].Tag != "sql" || removed[0].Challenge != nil {
+		t.Errorf("unexpected removed challenges: %+v", removed)
+	}
+	if len(updated) != 1 || updated[0].Tag != "xss" || updated[0].Challenge.Ready {
+		t.Errorf("unexpected updated challenges: %+v", updated)
+	}
+
+	if a, r, u := diffCatalog(new, new); len(a)+len(r)+len(u) != 0 {
+		t.Errorf("expected no change, got %v %v %v", a, r, u)
+	}
+}
+
+func TestCatalogWatcher(t *testing.T) {
+	hub := newCatalogHub()
+	client := &FrontendClient{send: make(chan []byte, 4)}
+	slow := &FrontendClient{send: make(chan []byte)}
+	hub.Register(client)
+	hub.Register(slow)
+
+	catalog := []Category{{Name: "Web", Tag: "web", Challenges: []Challenge{{Name: "XSS", Tag: "xss"}}}}
+	refreshed := 0
+	cw := newCatalogWatcher(hub, 0, func() ([]Category, error) { return catalog, nil }, func() { refreshed++ })
+
+	cw.poll()
+	cw.poll()
+	if len(client.send) != 0 || refreshed != 0 {
+		t.Fatalf("expected nothing to be broadcast while the catalog is the same")
+	}
+
+	catalog = []Category{{Name: "Web", Tag: "web", Challenges: []Challenge{{Name: "SQL", Tag: "sql"}}}}
+	cw.poll()
+	if refreshed != 1 {
+		t.Errorf("expected the change to be notified once, got %d", refreshed)
+	}
+
+	var msgs []string
+	for len(client.send) > 0 {
+		var m Message
+		if err := json.Unmarshal(<-client.send, &m); err != nil {
+			t.Fatalf("unable to decode message: %v", err)
+		}
+		msgs = append(msgs, m.Message)
+	}
+	if len(msgs) != 2 || msgs[0] != msgChallengesRemoved || msgs[1] != msgChallengesAdded {
+		t.Errorf("unexpected messages: %v", msgs)
+	}
+
+	//The client which couldn't keep up is dropped, its channel closed
+	if hub.Clients() != 1 {
+		t.Errorf("expected the slow client to be dropped, got %d clients", hub.Clients())
+	}
+	if _, ok := <-slow.send; ok {
+		t.Errorf("expected the channel of the slow client to be closed")
+	}
+
+	hub.Close()
+	if hub.Register(&FrontendClient{send: make(chan []byte)}) || hub.Clients() != 0 {
+		t.Errorf("expected the closed hub to refuse clients")
+	}
+}
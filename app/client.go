@@ -3,6 +3,7 @@ package app
 import (
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -13,24 +14,29 @@ var (
 	UnknownIDErr          = errors.New("unknown Client ID")
 	ErrInvalidTokenFormat = errors.New("invalid token format")
 	ErrChallengeNotFound  = errors.New("client challenge not found")
+	ErrRequestNotFound    = errors.New("client request not found")
 )
 
 type ClientRequestStore interface {
 	NewClient(string) Client
 	GetClient(string) (Client, error)
+	GetOrCreateClient(identity, host string) Client
+	GetClientRequestByID(string) (Client, *ClientRequest, error)
 	GetAllClients() []Client
 	GetAllRequests() []*ClientRequest
 	Close() error //To Shut down gracefully
 }
 
 type clientRequestStore struct {
-	m        sync.RWMutex
-	clientsR map[string]*client
+	m          sync.RWMutex
+	clientsR   map[string]*client
+	identities map[string]string //external identity -> client id
 }
 
 func NewClientRequestStore() ClientRequestStore {
 	crs := &clientRequestStore{
-		clientsR: map[string]*client{},
+		clientsR:   map[string]*client{},
+		identities: map[string]string{},
 	}
 	return crs
 }
@@ -68,7 +74,9 @@ func (c *clientRequestStore) GetAllRequests() []*ClientRequest {
 	var cr []*ClientRequest
 	for _, client := range clients {
 		for _, r := range client.GetAllClientRequests() {
-			cr = append(cr, r)
+			if r.Err() == nil {
+				cr = append(cr, r)
+			}
 		}
 	}
 	return cr
@@ -78,6 +86,41 @@ func (c *clientRequestStore) NewClient(host string) Client {
 	c.m.Lock()
 	defer c.m.Unlock()
 
+	return c.newClient("", host)
+}
+
+// Get the client bound to an external identity (eg. a user of an API key),
+// a new client is created the first time the identity is seen
+func (c *clientRequestStore) GetOrCreateClient(identity, host string) Client {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if id, ok := c.identities[identity]; ok {
+		if cl, ok := c.clientsR[id]; ok {
+			return cl
+		}
+	}
+
+	cl := c.newClient(identity, host)
+	c.identities[identity] = cl.id
+	return cl
+}
+
+func (c *clientRequestStore) GetClientRequestByID(id string) (Client, *ClientRequest, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	for _, cl := range c.clientsR {
+		for _, r := range cl.GetAllClientRequests() {
+			if r.ID() == id {
+				return cl, r, nil
+			}
+		}
+	}
+	return nil, nil, ErrRequestNotFound
+}
+
+func (c *clientRequestStore) newClient(identity, host string) *client {
 	id := uuid.New().String()
 
 	_, ok := c.clientsR[id] //get a new id if the previous one already exists
@@ -85,8 +128,13 @@ func (c *clientRequestStore) NewClient(host string) Client {
 		id = uuid.New().String()
 	}
 
+	if identity == "" {
+		identity = id
+	}
+
 	cl := &client{
 		id:       id,
+		identity: identity,
 		host:     host,
 		requests: map[string]*ClientRequest{},
 	}
@@ -102,6 +150,9 @@ func (c *clientRequestStore) Close() error {
 	var firstErr error
 	for _, cr := range c.clientsR {
 		for _, ce := range cr.requests {
+			if ce.env == nil {
+				continue
+			}
 			if err := ce.env.Close(); err != nil && firstErr == nil {
 				firstErr = err
 			}
@@ -118,6 +169,7 @@ type Client interface {
 	RemoveClientRequest(string)
 	CreateToken(key string) (string, error)
 	ID() string
+	Identity() string
 	Host() string
 	RequestMade() int
 }
@@ -125,15 +177,16 @@ type Client interface {
 type client struct {
 	m        sync.RWMutex
 	id       string
+	identity string
 	host     string
-	requests map[string]*ClientRequest //map with the challengeTags
+	requests map[string]*ClientRequest //map with the challengeTags, normalised
 }
 
 func (c *client) GetClientRequest(chals string) (*ClientRequest, error) {
 	c.m.RLock()
 	defer c.m.RUnlock()
 
-	cc, ok := c.requests[chals]
+	cc, ok := c.requests[normalizeChallenges(chals)]
 	if !ok {
 		return nil, ErrChallengeNotFound
 	}
@@ -160,11 +213,11 @@ func (c *client) NewClientRequest(chals string) *ClientRequest {
 
 	cc := &ClientRequest{
 		id:      uuid.New().String(),
+		chals:   chals,
 		isReady: false,
-		err:     make(chan error, 0),
 	}
 
-	c.requests[chals] = cc
+	c.requests[normalizeChallenges(chals)] = cc
 
 	return cc
 }
@@ -172,30 +225,65 @@ func (c *client) NewClientRequest(chals string) *ClientRequest {
 func (c *client) RemoveClientRequest(chals string) {
 	c.m.Lock()
 	defer c.m.Unlock()
-	delete(c.requests, chals)
+	delete(c.requests, normalizeChallenges(chals))
 }
 
 type ClientRequest struct {
-	id      string
-	isReady bool
-	err     chan error
-	env     Environment
+	m            sync.Mutex
+	id           string
+	chals        string
+	isReady      bool
+	failed       error //the environment couldn't be created
+	env          Environment
+	guacPassword string
+	guacToken    string
+	recorded     bool //the guacamole sessions are recorded
+	desktops     []desktop
+	solves       map[string]solve       //challenges solved, by challenge tag
+	tunnels      map[int]guacTunnelConn //guacamole tunnels opened through the proxy
+	httpTunnels  map[string]bool        //UUIDs of the guacamole HTTP tunnels, true for the shadow sessions
+	lastTunnel   int
+	lastActivity time.Time     //last guacamole traffic or lab page hit
+	idleTimeout  time.Duration //the lab is closed after being idle this long
 }
 
+// Mark the request as failed, it doesn't count against the requests of the client anymore
+// and it is removed once the error has been reported
 func (cr *ClientRequest) NewError(e error) {
-	cr.err <- e
+	cr.m.Lock()
+	defer cr.m.Unlock()
+	cr.failed = e
+}
+
+// Error the environment of the request failed with, if any
+func (cr *ClientRequest) Err() error {
+	cr.m.Lock()
+	defer cr.m.Unlock()
+	return cr.failed
 }
 
 func (cr *ClientRequest) ID() string {
 	return cr.id
 }
 
+func (cr *ClientRequest) Challenges() string {
+	return cr.chals
+}
+
 func (c *client) ID() string {
 	c.m.RLock()
 	defer c.m.RUnlock()
 	return c.id
 }
 
+// Identity is the client ID for browser clients, or the external identity
+// (eg. API key user) the client has been created for
+func (c *client) Identity() string {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.identity
+}
+
 func (c *client) Host() string {
 	c.m.RLock()
 	defer c.m.RUnlock()
@@ -205,5 +293,12 @@ func (c *client) Host() string {
 func (c *client) RequestMade() int {
 	c.m.RLock()
 	defer c.m.RUnlock()
-	return len(c.requests)
+
+	var n int
+	for _, r := range c.requests {
+		if r.Err() == nil {
+			n++
+		}
+	}
+	return n
 }
@@ -2,7 +2,11 @@ package app
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 
@@ -25,6 +29,15 @@ type Config struct {
 	API                 APIConfig                        `yaml:"api"`
 	SecretChallengeAuth Auth                             `yaml:"api-creds"`
 	DockerRepositories  []dockerclient.AuthConfiguration `yaml:"docker-repositories,omitempty"`
+	LTI                 LTIConfig                        `yaml:"lti,omitempty"`
+	Recordings          RecordingsConfig                 `yaml:"recordings,omitempty"`
+	Admission           AdmissionConfig                  `yaml:"admission,omitempty"`
+	Scheduler           SchedulerConfig                  `yaml:"scheduler,omitempty"`
+	Worker              WorkerServerConfig               `yaml:"worker,omitempty"`
+	Reservations        ReservationsConfig               `yaml:"reservations,omitempty"`
+	Reconciler          ReconcilerConfig                 `yaml:"reconciler,omitempty"`
+	Prefetch            PrefetchConfig                   `yaml:"prefetch,omitempty"`
+	Server              ServerConfig                     `yaml:"server,omitempty"`
 }
 
 type CertificateConfig struct {
@@ -48,13 +61,143 @@ type APIConfig struct {
 		SiteKey   string `yaml:"site-key"`
 		SecretKey string `yaml:"secret-key"`
 	} `yaml:"captcha"`
-	TotalMaxRequest  int `yaml:"total-max-requests"`
-	ClientMaxRequest int `yaml:"client-max-requests"`
-	FrontEnd         struct {
-		Image  string `yaml:"image"`
-		Memory uint   `yaml:"memory"`
-	} `yaml:"frontend"`
-	StoreFile string `yaml:"store-file"`
+	TotalMaxRequest     int               `yaml:"total-max-requests"`
+	ClientMaxRequest    int               `yaml:"client-max-requests"`
+	FrontEnd            FrontendConfig    `yaml:"frontend"`
+	FrontendProfiles    []FrontendProfile `yaml:"frontend-profiles,omitempty"`
+	StoreFile           string            `yaml:"store-file"`
+	AuditFile           string            `yaml:"audit-file,omitempty"`
+	ProgressFile        string            `yaml:"progress-file,omitempty"`
+	BundlesFile         string            `yaml:"bundles-file,omitempty"`
+	MaxResets           int               `yaml:"max-resets,omitempty"`            //resets of a lab a client can make, -1 disables them
+	IdleTimeout         time.Duration     `yaml:"idle-timeout,omitempty"`          //idle labs are closed after it, -1 disables it
+	ProvisionRetries    int               `yaml:"provision-retries,omitempty"`     //times a lab failing with a transient error is created again
+	ProvisionRetryDelay time.Duration     `yaml:"provision-retry-delay,omitempty"` //wait before the first retry, growing with each retry
+	CatalogPoll         time.Duration     `yaml:"catalog-poll,omitempty"`          //the catalog is polled for changes pushed to the frontends, -1 disables it
+	APIKeys             []APIKey          `yaml:"api-keys,omitempty"`
+}
+
+// FrontendConfig is a desktop users connect to through guacamole
+type FrontendConfig struct {
+	Name   string `yaml:"name,omitempty"` //name shown to the users, defaults to the image
+	Image  string `yaml:"image"`
+	Memory uint   `yaml:"memory"`
+}
+
+// FrontendProfile gives the labs of some challenge sets their own frontends and idle timeout,
+// the labs of the other challenges get the default ones
+type FrontendProfile struct {
+	ChallengeSets []string         `yaml:"challenge-sets"` //eg. "ftp,sql", "*" matches every lab
+	Frontends     []FrontendConfig `yaml:"frontends,omitempty"`
+	IdleTimeout   time.Duration    `yaml:"idle-timeout,omitempty"`
+}
+
+// APIKey gives a server-to-server integration (eg. an LMS plugin) access to the labs API
+type APIKey struct {
+	Name        string `yaml:"name"`
+	Key         string `yaml:"key"`
+	MaxRequests int    `yaml:"max-requests,omitempty"` //0 means bounded only by total-max-requests
+}
+
+// LTIConfig configures the LTI 1.3 tool used by learning platforms to launch labs
+type LTIConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	PrivateKeyFile string        `yaml:"private-key-file"` //PEM RSA key signing the deep linking responses
+	KeyID          string        `yaml:"key-id"`
+	Platforms      []LTIPlatform `yaml:"platforms"`
+}
+
+// LTIPlatform is a learning platform (eg. Moodle) registered with the tool
+type LTIPlatform struct {
+	Issuer        string   `yaml:"issuer"`
+	ClientID      string   `yaml:"client-id"`
+	AuthEndpoint  string   `yaml:"auth-endpoint"`
+	KeySetURL     string   `yaml:"keyset-url,omitempty"`
+	PublicKey     string   `yaml:"public-key,omitempty"` //PEM, used when the platform has no key set URL
+	DeploymentIDs []string `yaml:"deployment-ids,omitempty"`
+}
+
+// RecordingsConfig enables the recording of the guacamole sessions of some challenge sets
+type RecordingsConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	Dir           string        `yaml:"dir"`
+	GuacdDir      string        `yaml:"guacd-dir,omitempty"` //dir as seen by guacd, defaults to dir
+	ChallengeSets []string      `yaml:"challenge-sets"`      //eg. "ftp,sql", "*" records every lab
+	MaxAge        time.Duration `yaml:"max-age,omitempty"`
+	MaxSizeMB     int64         `yaml:"max-size-mb,omitempty"`
+}
+
+// AdmissionConfig admits the labs by the resources of the host, on top of total-max-requests.
+// Labs which don't fit wait in a queue until enough resources are freed
+type AdmissionConfig struct {
+	Enabled          bool          `yaml:"enabled"`
+	ReservedMemoryMB uint64        `yaml:"reserved-memory-mb,omitempty"` //memory always left to the host
+	MaxLoad          float64       `yaml:"max-load,omitempty"`           //1 minute load average per CPU
+	DiskPath         string        `yaml:"disk-path,omitempty"`          //defaults to the ova directory
+	MinDiskMB        uint64        `yaml:"min-disk-mb,omitempty"`
+	ExerciseMemoryMB uint          `yaml:"exercise-memory-mb,omitempty"` //estimate of the exercises without memory
+	FrontendMemoryMB uint          `yaml:"frontend-memory-mb,omitempty"` //estimate of the frontends without memory
+	QueueSize        int           `yaml:"queue-size,omitempty"`
+	QueueTimeout     time.Duration `yaml:"queue-timeout,omitempty"`
+}
+
+// SchedulerConfig spreads the labs over several haaukins hosts
+type SchedulerConfig struct {
+	DisableLocal bool           `yaml:"disable-local,omitempty"` //run no lab on the host of the API
+	Workers      []WorkerConfig `yaml:"workers,omitempty"`
+}
+
+// WorkerConfig is another haaukins host the labs are scheduled on
+type WorkerConfig struct {
+	Name    string            `yaml:"name"`
+	Address string            `yaml:"address"` //gRPC address of the worker, eg. "10.0.0.2:5454"
+	AuthKey string            `yaml:"auth-key"`
+	TLS     CertificateConfig `yaml:"tls,omitempty"` //cafile verifies the certificate of the worker
+}
+
+// WorkerServerConfig makes this host a worker of the scheduler of another API
+type WorkerServerConfig struct {
+	Enabled bool              `yaml:"enabled"`
+	Listen  string            `yaml:"listen"`  //eg. ":5454"
+	HostIP  string            `yaml:"host-ip"` //IP guacamole reaches the desktops of this host at
+	AuthKey string            `yaml:"auth-key"`
+	MaxLabs int               `yaml:"max-labs,omitempty"` //labs of this host, requested locally or by a scheduler
+	TLS     CertificateConfig `yaml:"tls,omitempty"`
+}
+
+// ServerConfig sets the timeouts and the limits of the HTTP server of the API. The read and write
+// timeouts are off by default, they cut the guacamole sessions falling back to the HTTP tunnel
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration `yaml:"read-header-timeout,omitempty"` //defaults to 10s
+	ReadTimeout       time.Duration `yaml:"read-timeout,omitempty"`
+	WriteTimeout      time.Duration `yaml:"write-timeout,omitempty"`
+	IdleTimeout       time.Duration `yaml:"idle-timeout,omitempty"`     //defaults to 2m
+	MaxHeaderBytes    int           `yaml:"max-header-bytes,omitempty"` //defaults to 64KB
+	MaxFormBytes      int64         `yaml:"max-form-bytes,omitempty"`   //defaults to 256KB
+	FrameAncestors    []string      `yaml:"frame-ancestors,omitempty"`  //origins allowed to frame the labs besides the LTI platforms
+}
+
+// ReservationsConfig sets how the labs booked for the class sessions are prepared
+type ReservationsConfig struct {
+	PrewarmLead time.Duration `yaml:"prewarm-lead,omitempty"` //labs are created this long before the start, defaults to 10m
+}
+
+// ReconcilerConfig removes the containers, networks and VMs left behind by the labs of this API
+type ReconcilerConfig struct {
+	Disabled  bool          `yaml:"disabled,omitempty"`
+	StateFile string        `yaml:"state-file,omitempty"` //resources of the labs, kept across restarts to clean up after a crash
+	Interval  time.Duration `yaml:"interval,omitempty"`   //defaults to 10m, -1 reconciles only at startup
+	Grace     time.Duration `yaml:"grace,omitempty"`      //labs younger than it are never orphaned, defaults to 5m
+	DryRun    bool          `yaml:"dry-run,omitempty"`    //only log the orphaned resources
+	Label     string        `yaml:"label,omitempty"`      //label of the lab containers, defaults to hkn
+}
+
+// PrefetchConfig pulls the images of the exercises and verifies the frontend OVAs ahead of the labs
+type PrefetchConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	Interval    time.Duration `yaml:"interval,omitempty"`     //the catalog is checked for new images this often, defaults to 5m
+	Parallel    int           `yaml:"parallel,omitempty"`     //images pulled at the same time, defaults to 2
+	HideUnready bool          `yaml:"hide-unready,omitempty"` //hide the challenges with images not pulled yet, instead of flagging them
 }
 
 func NewConfigFromFile(path string) (*Config, error) {
@@ -84,6 +227,14 @@ func NewConfigFromFile(path string) (*Config, error) {
 		c.Port.Secure = 443
 	}
 
+	if c.API.IdleTimeout == 0 {
+		c.API.IdleTimeout = idleTimeout
+	}
+
+	if c.API.MaxResets == 0 {
+		c.API.MaxResets = environmentMaxResets
+	}
+
 	if c.TLS.CertFile == "" || c.TLS.CertKey == "" {
 		c.TLS.Enabled = false
 	}
@@ -102,9 +253,101 @@ func NewConfigFromFile(path string) (*Config, error) {
 		c.API.Admin.Password = random
 	}
 
+	if c.API.FrontEnd.Name == "" {
+		c.API.FrontEnd.Name = c.API.FrontEnd.Image
+	}
+	for i, p := range c.API.FrontendProfiles {
+		if len(p.ChallengeSets) == 0 || (len(p.Frontends) == 0 && p.IdleTimeout == 0) {
+			return nil, errors.New("frontend profiles need challenge sets and frontends or an idle timeout")
+		}
+		for j, f := range p.Frontends {
+			if f.Image == "" {
+				return nil, errors.New("frontends need an image")
+			}
+			if f.Name == "" {
+				c.API.FrontendProfiles[i].Frontends[j].Name = f.Image
+			}
+		}
+	}
+
+	names := map[string]bool{}
+	for _, k := range c.API.APIKeys {
+		if k.Name == "" || k.Key == "" {
+			return nil, errors.New("api keys need both a name and a key")
+		}
+		if strings.Contains(k.Name, "/") { //it separates the key from the user in the identity of the clients
+			return nil, fmt.Errorf("the name of the api key %s can't have a \"/\"", k.Name)
+		}
+		if names[k.Name] {
+			return nil, fmt.Errorf("duplicated api key name: %s", k.Name)
+		}
+		names[k.Name] = true
+	}
+
+	if c.LTI.Enabled {
+		if c.LTI.PrivateKeyFile == "" {
+			return nil, errors.New("lti needs a private key file")
+		}
+		if c.LTI.KeyID == "" {
+			c.LTI.KeyID = "haaukins-api"
+		}
+		for _, p := range c.LTI.Platforms {
+			if p.Issuer == "" || p.ClientID == "" || p.AuthEndpoint == "" {
+				return nil, errors.New("lti platforms need issuer, client-id and auth-endpoint")
+			}
+			if p.KeySetURL == "" && p.PublicKey == "" {
+				return nil, fmt.Errorf("lti platform %s needs either a keyset-url or a public-key", p.Issuer)
+			}
+		}
+	}
+
+	if c.Recordings.Enabled {
+		if c.Recordings.Dir == "" {
+			return nil, errors.New("recordings need a directory")
+		}
+		if c.Recordings.GuacdDir == "" {
+			c.Recordings.GuacdDir = c.Recordings.Dir
+		}
+	}
+
 	if c.OvaDir == "" {
 		return nil, errors.New("ova directory is necessary")
 	}
 
+	if c.Admission.Enabled {
+		c.Admission.setDefaults(c.OvaDir)
+	}
+
+	for i, w := range c.Scheduler.Workers {
+		if w.Address == "" || w.AuthKey == "" {
+			return nil, errors.New("workers need an address and an auth key")
+		}
+		if !w.TLS.Enabled {
+			return nil, fmt.Errorf("worker %s: %v", w.Address, ErrWorkerNoTLS)
+		}
+		if w.Name == "" {
+			c.Scheduler.Workers[i].Name = w.Address
+		}
+	}
+	if c.Scheduler.DisableLocal && len(c.Scheduler.Workers) == 0 {
+		return nil, errors.New("the local labs can be disabled only with workers")
+	}
+	if c.Worker.Enabled && (c.Worker.Listen == "" || c.Worker.HostIP == "" || c.Worker.AuthKey == "") {
+		return nil, errors.New("the worker needs listen, host-ip and auth-key")
+	}
+	if c.Worker.Enabled && !c.Worker.TLS.Enabled {
+		return nil, fmt.Errorf("worker: %v", ErrWorkerNoTLS)
+	}
+
+	if c.Reservations.PrewarmLead < 0 {
+		return nil, errors.New("the prewarm-lead of the reservations can't be negative")
+	}
+
+	for _, o := range c.Server.FrameAncestors {
+		if u, err := url.Parse(o); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("the frame ancestor %q is not an origin, eg. https://moodle.example.org", o)
+		}
+	}
+
 	return &c, nil
 }
@@ -0,0 +1,253 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	proto "github.com/aau-network-security/haaukins/exercise/ex-proto"
+	"github.com/aau-network-security/haaukins/store"
+	"github.com/rs/zerolog/log"
+)
+
+const labPagePath = "/lab/"
+
+// Notices shown on the dashboard after an action, the page only shows known notices
+var labNotices = map[string]string{
+	"extended":       "The lab has been extended",
+	"max-extensions": "The lab can't be extended anymore",
+	"restarted":      "The lab has been restarted",
+	"reset":          "The exercise has been reset",
+	"max-resets":     "The lab can't be reset anymore",
+	"error":          "Something went wrong, please try again",
+}
+
+// labChallenge is a challenge of a running lab, as shown on the dashboard
+type labChallenge struct {
+	Tag         string
+	Name        string
+	Description string
+	Points      uint
+}
+
+// Get the challenges of the exercises with the given tags, together with their descriptions
+func (lm *LearningMaterialAPI) getLabChallenges(tags []string) ([]labChallenge, error) {
+	response, err := lm.exClient.GetExerciseByTags(context.TODO(), &proto.GetExerciseByTagsRequest{Tag: tags})
+	if err != nil {
+		return nil, fmt.Errorf("[exercise-service] Error getting exercises: %v", err)
+	}
+
+	var chals []labChallenge
+	for _, e := range response.Exercises {
+		exercise, err := protobufToJson(e)
+		if err != nil {
+			return nil, err
+		}
+		eStruct := store.Exercise{}
+		if err := json.Unmarshal([]byte(exercise), &eStruct); err != nil {
+			return nil, err
+		}
+
+		var flags int
+		for _, i := range eStruct.Instance {
+			for _, f := range i.Flags {
+				flags++
+				chals = append(chals, labChallenge{
+					Tag:         string(f.Tag),
+					Name:        f.Name,
+					Description: f.TeamDescription,
+					Points:      f.Points,
+				})
+			}
+		}
+		if flags == 0 {
+			chals = append(chals, labChallenge{
+				Tag:         string(eStruct.Tag),
+				Name:        eStruct.Name,
+				Description: eStruct.OrgDescription,
+			})
+		}
+	}
+	return chals, nil
+}
+
+// Get the client request of the session for the challenges in the query
+func (lm *LearningMaterialAPI) sessionClientRequest(r *http.Request) (Client, *ClientRequest, error) {
+	client, err := lm.sessionClient(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	cr, err := client.GetClientRequest(r.URL.Query().Get(requestedChallenges))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !cr.isReady || cr.env == nil {
+		return nil, nil, ErrChallengeNotFound
+	}
+	return client, cr, nil
+}
+
+func labPageURL(chals, notice string) string {
+	v := url.Values{requestedChallenges: {chals}}
+	if notice != "" {
+		v.Set("notice", notice)
+	}
+	return labPagePath + "?" + v.Encode()
+}
+
+// Handle the requests made to `/lab/`, it shows the dashboard of the lab of the requested
+// challenges, `POST /lab/extend` and `POST /lab/restart` extend and restart the lab, `POST /lab/reset`
+// resets the exercise in the `exercise` form value and `POST /lab/keepalive` records activity on the lab.
+// `GET /lab/status` tells when the lab closes, without counting as activity
+func (lm *LearningMaterialAPI) handleLab() http.HandlerFunc {
+	tmpl, err := template.ParseFiles(
+		"resources/private/base.tmpl.html",
+		"resources/private/lab.tmpl.html",
+	)
+	if err != nil {
+		log.Error().Msgf("error lab tmpl: %s", err.Error())
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, cr, err := lm.sessionClientRequest(r)
+		if err == ErrChallengeNotFound {
+			errorPage(w, r, http.StatusNotFound, returnError{
+				Content:         errorGetCR,
+				Toomanyrequests: false,
+			})
+			return
+		}
+		if err != nil {
+			errorPage(w, r, http.StatusUnauthorized, returnError{
+				Content:         errorGuacSession,
+				Toomanyrequests: false,
+			})
+			return
+		}
+
+		action := strings.Trim(strings.TrimPrefix(r.URL.Path, labPagePath), "/")
+		if action == "status" {
+			writeJSON(w, http.StatusOK, labClosing(cr))
+			return
+		}
+		if action != "" {
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if !sameOrigin(r) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			notice := lm.labAction(r, action, client, cr)
+			http.Redirect(w, r, labPageURL(cr.Challenges(), notice), http.StatusSeeOther)
+			return
+		}
+
+		cr.touch()
+		chals, err := lm.getLabChallenges(strings.Split(cr.Challenges(), ","))
+		if err != nil {
+			log.Error().Msgf("Error getting the lab challenges: %v", err)
+		}
+
+		solved := map[string]bool{}
+		for _, s := range cr.Solves() {
+			solved[s.Tag] = true
+		}
+
+		content := struct {
+			Challenges  []labChallenge
+			Solved      map[string]bool
+			Desktops    []desktop
+			Lab         string
+			Exercises   []string
+			Query       string
+			Expires     int64 //unix milliseconds, used by the countdown
+			Remaining   string
+			IdleWarning int64 //seconds before an idle close the warning is shown
+			ResetsLeft  int
+			Notice      string
+		}{
+			Challenges:  chals,
+			Solved:      solved,
+			Desktops:    cr.desktops,
+			Lab:         cr.Challenges(),
+			Exercises:   strings.Split(cr.Challenges(), ","),
+			Query:       url.Values{requestedChallenges: {cr.Challenges()}}.Encode(),
+			Expires:     cr.env.Expires().UnixNano() / int64(time.Millisecond),
+			Remaining:   time.Until(cr.env.Expires()).Round(time.Minute).String(),
+			IdleWarning: int64(idleWarning.Seconds()),
+			ResetsLeft:  cr.env.ResetsLeft(),
+			Notice:      labNotices[r.URL.Query().Get("notice")],
+		}
+		if err := tmpl.Execute(w, content); err != nil {
+			log.Error().Msgf("template err lab: %s", err.Error())
+		}
+	}
+}
+
+// Times the lab closes, because it expires or because it stays idle (omitted when the lab is
+// never closed for being idle), as unix milliseconds
+func labClosing(cr *ClientRequest) map[string]int64 {
+	status := map[string]int64{
+		"expires": cr.env.Expires().UnixNano() / int64(time.Millisecond),
+	}
+	if idle := cr.IdleDeadline(); !idle.IsZero() {
+		status["idle_closes"] = idle.UnixNano() / int64(time.Millisecond)
+	}
+	return status
+}
+
+// Run an action on the lab, the notice to show on the dashboard is returned
+func (lm *LearningMaterialAPI) labAction(r *http.Request, action string, client Client, cr *ClientRequest) string {
+	event := auditEvent{
+		Actor:   client.Identity(),
+		Client:  client.ID(),
+		Request: cr.ID(),
+		Details: map[string]string{"challenges": cr.Challenges()},
+	}
+
+	switch action {
+	case "keepalive":
+		cr.touch()
+		return ""
+
+	case "extend":
+		expires, err := cr.env.Extend()
+		if err == ErrMaxExtensions {
+			return "max-extensions"
+		}
+		if err != nil {
+			return "error"
+		}
+		event.Action = auditLabExtended
+		event.Details["expires"] = expires.Format(time.RFC3339)
+		lm.audit.Record(event)
+		return "extended"
+
+	case "restart", "reset":
+		exercise := ""
+		if action == "reset" {
+			exercise = r.FormValue("exercise")
+			if exercise == "" {
+				return "error"
+			}
+		}
+		err := lm.resetLab(cr, exercise, false, event)
+		switch {
+		case err == ErrMaxResets:
+			return "max-resets"
+		case err != nil:
+			return "error"
+		case exercise == "":
+			return "restarted"
+		}
+		return "reset"
+	}
+	return "error"
+}
@@ -0,0 +1,89 @@
+package app
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/aau-network-security/haaukins/store"
+)
+
+// labFrontend is a frontend of a lab together with the name shown to the users
+type labFrontend struct {
+	name string
+	conf store.InstanceConfig
+}
+
+type frontendProfile struct {
+	sets        challengeSets
+	frontends   []labFrontend
+	idleTimeout time.Duration
+}
+
+// desktop is a frontend of a running lab the user can open
+type desktop struct {
+	Name       string
+	Connection string //guacamole connection name
+	URL        string //path opening the connection in guacamole
+}
+
+func newLabFrontends(confs []FrontendConfig) []labFrontend {
+	frontends := make([]labFrontend, len(confs))
+	for i, f := range confs {
+		frontends[i] = labFrontend{
+			name: f.Name,
+			conf: store.InstanceConfig{
+				Image:    f.Image,
+				MemoryMB: f.Memory,
+			},
+		}
+	}
+	return frontends
+}
+
+func newFrontendProfiles(confs []FrontendProfile) []frontendProfile {
+	profiles := make([]frontendProfile, len(confs))
+	for i, p := range confs {
+		profiles[i] = frontendProfile{
+			sets:        newChallengeSets(p.ChallengeSets),
+			frontends:   newLabFrontends(p.Frontends),
+			idleTimeout: p.IdleTimeout,
+		}
+	}
+	return profiles
+}
+
+// Frontends of the labs of the given challenges, the first profile matching the
+// challenges with frontends is used, otherwise the default frontend
+func (lm *LearningMaterialAPI) labFrontends(chals string) []labFrontend {
+	for _, p := range lm.frontendProfiles {
+		if len(p.frontends) > 0 && p.sets.Match(chals) {
+			return p.frontends
+		}
+	}
+	return lm.frontends
+}
+
+// Frontends of all the frontend profiles
+func profileFrontends(profiles []FrontendProfile) []FrontendConfig {
+	var frontends []FrontendConfig
+	for _, p := range profiles {
+		frontends = append(frontends, p.Frontends...)
+	}
+	return frontends
+}
+
+func frontendConfigs(frontends []labFrontend) []store.InstanceConfig {
+	confs := make([]store.InstanceConfig, len(frontends))
+	for i, f := range frontends {
+		confs[i] = f.conf
+	}
+	return confs
+}
+
+// Path opening a connection directly in the guacamole web application
+func guacClientURL(connectionID, dataSource string) string {
+	id := base64.StdEncoding.EncodeToString([]byte(connectionID + "\x00c\x00" + dataSource))
+	return fmt.Sprintf("%s#/client/%s", guacPath, url.PathEscape(id))
+}
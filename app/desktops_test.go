@@ -0,0 +1,52 @@
+package app
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLabFrontends(t *testing.T) {
+	lm := &LearningMaterialAPI{
+		frontends: newLabFrontends([]FrontendConfig{{Name: "Kali", Image: "kali", Memory: 4096}}),
+		frontendProfiles: newFrontendProfiles([]FrontendProfile{{
+			ChallengeSets: []string{"ad,smb"},
+			Frontends: []FrontendConfig{
+				{Name: "Kali", Image: "kali", Memory: 4096},
+				{Name: "Windows attacker", Image: "windows10", Memory: 8192},
+			},
+		}}),
+	}
+
+	if f := lm.labFrontends("ftp"); len(f) != 1 || f[0].name != "Kali" {
+		t.Errorf("expected the default frontend, got %+v", f)
+	}
+
+	f := lm.labFrontends("SMB,ad")
+	if len(f) != 2 || f[1].name != "Windows attacker" || f[1].conf.MemoryMB != 8192 {
+		t.Fatalf("expected the frontends of the profile, got %+v", f)
+	}
+	if confs := frontendConfigs(f); len(confs) != 2 || confs[1].Image != "windows10" {
+		t.Errorf("unexpected lab frontends: %+v", confs)
+	}
+}
+
+func TestGuacClientURL(t *testing.T) {
+	u := guacClientURL("12", "mysql")
+	if !strings.HasPrefix(u, "/guacamole/#/client/") {
+		t.Fatalf("unexpected client URL: %s", u)
+	}
+
+	id, err := url.PathUnescape(strings.TrimPrefix(u, "/guacamole/#/client/"))
+	if err != nil {
+		t.Fatalf("unable to unescape client identifier: %v", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(id)
+	if err != nil {
+		t.Fatalf("unable to decode client identifier: %v", err)
+	}
+	if string(raw) != "12\x00c\x00mysql" {
+		t.Errorf("unexpected client identifier: %q", raw)
+	}
+}
@@ -7,27 +7,55 @@ import (
 	"fmt"
 	proto "github.com/aau-network-security/haaukins/exercise/ex-proto"
 	"strings"
+	"sync"
 	"time"
 
-	hlab "github.com/aau-network-security/haaukins/lab"
 	"github.com/aau-network-security/haaukins/store"
 	"github.com/aau-network-security/haaukins/svcs/guacamole"
-	"github.com/aau-network-security/haaukins/virtual/docker"
 	"github.com/rs/zerolog/log"
 )
 
-const environmentTimer = 45 * time.Minute
+const (
+	environmentTimer         = 45 * time.Minute
+	environmentExtension     = 30 * time.Minute
+	environmentMaxExtensions = 2
+	environmentMaxResets     = 3
+)
+
+var (
+	ErrMaxExtensions     = errors.New("the lab can't be extended anymore")
+	ErrEnvironmentClosed = errors.New("the lab is closing")
+	ErrMaxResets         = errors.New("the lab can't be reset anymore")
+	ErrUnknownExercise   = errors.New("the exercise is not part of the lab")
+)
 
 type environment struct {
+	m          sync.Mutex
 	timer      *time.Timer
+	expires    time.Time
+	extensions int
+	resets     int
+	maxResets  int
 	challenges []store.Tag
-	lab        hlab.Lab
+	lab        workerLab
+	host       string //host the RDP ports of the lab are reachable at
 	guacamole  guacamole.Guacamole
+	guacAdmin  *guacAdmin
+	guacUser   string
+	recordings *recordingStore
+	frontends  []labFrontend
 }
 
 type Environment interface {
 	GetChallenges() string
 	GetTimer() *time.Timer
+	Expires() time.Time
+	Extend() (time.Time, error)
+	Reset(ctx context.Context, exercise string, force bool) (int, error)
+	ResetsLeft() int
+	Expire() bool
+	Renew()
+	Flags() []store.Challenge
 	Assign(Client, string) error
 	Close() error //close the dockers and the vms
 }
@@ -38,7 +66,10 @@ func (lm *LearningMaterialAPI) NewEnvironment(challenges []store.Tag, sChallenge
 	var exers []store.Exercise
 
 	ctx := context.TODO()
-	response, _ := lm.exClient.GetExerciseByTags(ctx, &proto.GetExerciseByTagsRequest{Tag: sChallenges})
+	response, err := lm.exClient.GetExerciseByTags(ctx, &proto.GetExerciseByTagsRequest{Tag: sChallenges})
+	if err != nil {
+		return nil, err
+	}
 
 	for _, e := range response.Exercises {
 		exercise, err := protobufToJson(e)
@@ -51,32 +82,29 @@ func (lm *LearningMaterialAPI) NewEnvironment(challenges []store.Tag, sChallenge
 	}
 
 	ctx = context.Background()
-	labConf := hlab.Config{
-		Exercises: exers,
-		Frontends: lm.frontend,
-	}
+	frontends := lm.labFrontends(strings.Join(sChallenges, ","))
 
-	lh := hlab.LabHost{
-		Vlib: lm.vlib,
-		Conf: labConf,
-	}
-
-	lab, err := lh.NewLab(ctx, 0)
+	//The lab is created and started by the worker with the most room
+	lab, host, err := lm.scheduler.CreateLab(ctx, labSpec{
+		Exercises: exers,
+		Frontends: frontendConfigs(frontends),
+	})
 	if err != nil {
 		log.Error().Msgf("Error while creating new lab %s", err.Error())
 		return nil, err
 	}
 
-	if err := lab.Start(ctx); err != nil {
-		log.Error().Msgf("Error while starting lab %s", err.Error())
-		return nil, err
-	}
-
 	env := &environment{
 		timer:      time.NewTimer(environmentTimer),
+		expires:    time.Now().Add(environmentTimer),
+		maxResets:  lm.conf.API.MaxResets,
 		challenges: challenges,
 		lab:        lab,
+		host:       host,
 		guacamole:  lm.guacamole,
+		guacAdmin:  lm.guacAdmin,
+		recordings: lm.recordings,
+		frontends:  frontends,
 	}
 
 	return env, nil
@@ -87,7 +115,7 @@ func (e *environment) Assign(client Client, chals string) error {
 
 	cr, err := client.GetClientRequest(chals)
 	if err != nil {
-		return errors.New("client request not found")
+		return ErrRequestNotFound
 	}
 
 	rdpPorts := e.lab.RdpConnPorts()
@@ -100,9 +128,15 @@ func (e *environment) Assign(client Client, chals string) error {
 		return errors.New("RdpConfErr")
 	}
 
+	//The password is kept server side, users log in through one-time tickets
+	password, err := randomString()
+	if err != nil {
+		return err
+	}
+
 	u := guacamole.GuacUser{
 		Username: cr.ID(),
-		Password: cr.ID(),
+		Password: password,
 	}
 
 	if err := e.guacamole.CreateUser(u.Username, u.Password); err != nil {
@@ -113,16 +147,36 @@ func (e *environment) Assign(client Client, chals string) error {
 		return err
 	}
 
-	dockerHost := docker.NewHost()
-	hostIp, err := dockerHost.GetDockerHostIP()
-	if err != nil {
-		return err
+	//The guacamole user and its connections are removed when a later step fails
+	var rb rollback
+	defer rb.Run()
+	if e.guacAdmin != nil {
+		rb.Add("guacamole user", func() error {
+			if err := e.guacAdmin.DeleteConnections(u.Username + "-"); err != nil {
+				return err
+			}
+			return e.guacAdmin.DeleteUser(u.Username)
+		})
 	}
 
+	hostIp := e.host
+
+	record := e.recordings.Records(chals)
+	if record && e.guacAdmin == nil {
+		log.Warn().Str("client", cr.ID()).Msg("Session recording needs the guacamole admin, the session is not recorded")
+		record = false
+	}
+
+	desktops := make([]desktop, len(rdpPorts))
 	for i, port := range rdpPorts {
 		num := i + 1
 		name := fmt.Sprintf("%s-client%d", cr.ID(), num)
 
+		desktops[i] = desktop{Name: fmt.Sprintf("Desktop %d", num), Connection: name, URL: guacPath}
+		if i < len(e.frontends) {
+			desktops[i].Name = e.frontends[i].name
+		}
+
 		log.Debug().Str("client", cr.ID()).Uint("port", port).Msg("Creating RDP Connection for group")
 		if err := e.guacamole.CreateRDPConn(guacamole.CreateRDPConnOpts{
 			Host:     hostIp,
@@ -134,14 +188,55 @@ func (e *environment) Assign(client Client, chals string) error {
 		}); err != nil {
 			return err
 		}
+
+		if record {
+			if err := e.guacAdmin.UpdateConnectionParameters(name, e.recordings.connParameters(client.ID(), cr.ID(), num)); err != nil {
+				return err
+			}
+		}
 	}
 
+	e.resolveDesktops(desktops)
+	rb.Commit()
+
+	e.guacUser = u.Username
 	cr.env = e
+	cr.recorded = record
+	cr.desktops = desktops
+	cr.guacPassword = u.Password
 	cr.isReady = true
 
 	return nil
 }
 
+//Set the URLs opening the desktops directly, users land on the guacamole home when the connections can't be found
+func (e *environment) resolveDesktops(desktops []desktop) {
+	if e.guacAdmin == nil {
+		return
+	}
+
+	ds, err := e.guacAdmin.DataSource()
+	if err != nil {
+		log.Warn().Msgf("Unable to get the guacamole data source: %v", err)
+		return
+	}
+	conns, err := e.guacAdmin.Connections()
+	if err != nil {
+		log.Warn().Msgf("Unable to get the guacamole connections: %v", err)
+		return
+	}
+
+	ids := map[string]string{}
+	for id, c := range conns {
+		ids[c.Name] = id
+	}
+	for i, d := range desktops {
+		if id, ok := ids[d.Connection]; ok {
+			desktops[i].URL = guacClientURL(id, ds)
+		}
+	}
+}
+
 func (e *environment) GetChallenges() string {
 	chals := make([]string, len(e.challenges))
 	var i int
@@ -156,7 +251,136 @@ func (e *environment) GetTimer() *time.Timer {
 	return e.timer
 }
 
+//Time the environment is closed
+func (e *environment) Expires() time.Time {
+	e.m.Lock()
+	defer e.m.Unlock()
+	return e.expires
+}
+
+//Postpone the closing of the environment, an environment can be extended environmentMaxExtensions times
+func (e *environment) Extend() (time.Time, error) {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	if e.extensions >= environmentMaxExtensions {
+		return e.expires, ErrMaxExtensions
+	}
+	if !e.timer.Stop() { //the timer already fired, the environment is being closed
+		return e.expires, ErrEnvironmentClosed
+	}
+
+	e.extensions++
+	e.expires = e.expires.Add(environmentExtension)
+	e.timer.Reset(time.Until(e.expires))
+	return e.expires, nil
+}
+
+//Reset the exercise with the given tag, restarting its containers, or the whole lab (frontends
+//and exercises) when no exercise is given. Each reset counts against the reset budget of the
+//environment unless it is forced (eg. by an admin), the resets left are returned
+func (e *environment) Reset(ctx context.Context, exercise string, force bool) (int, error) {
+	if exercise != "" {
+		tag, ok := e.challengeTag(exercise)
+		if !ok {
+			return e.ResetsLeft(), ErrUnknownExercise
+		}
+		exercise = tag
+	}
+
+	e.m.Lock()
+	if !force && e.resets >= e.maxResets {
+		e.m.Unlock()
+		return 0, ErrMaxResets
+	}
+	//The reset is counted before it runs, so concurrent resets can't go over the budget,
+	//and it is given back when it fails
+	if !force {
+		e.resets++
+	}
+	e.m.Unlock()
+
+	var err error
+	if exercise == "" {
+		err = e.lab.Restart(ctx)
+	} else {
+		err = e.lab.ResetExercise(ctx, exercise)
+	}
+	if err != nil && !force {
+		e.m.Lock()
+		e.resets--
+		e.m.Unlock()
+	}
+	return e.ResetsLeft(), err
+}
+
+//Start the timer of the environment again, with no extensions and resets used, when it is handed
+//to a client after being created in advance
+func (e *environment) Renew() {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	if !e.timer.Stop() {
+		select {
+		case <-e.timer.C:
+		default:
+		}
+	}
+	e.extensions = 0
+	e.resets = 0
+	e.expires = time.Now().Add(environmentTimer)
+	e.timer.Reset(environmentTimer)
+}
+
+//Close the environment now through its timer, false is returned when the timer already fired
+func (e *environment) Expire() bool {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	if !e.timer.Stop() {
+		return false
+	}
+	e.expires = time.Now()
+	e.timer.Reset(0)
+	return true
+}
+
+//Number of resets the environment has left
+func (e *environment) ResetsLeft() int {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if e.resets >= e.maxResets {
+		return 0
+	}
+	return e.maxResets - e.resets
+}
+
+//Tag of the challenge of the environment matching the given tag, regardless of the case
+func (e *environment) challengeTag(tag string) (string, bool) {
+	for _, c := range e.challenges {
+		if strings.EqualFold(string(c), tag) {
+			return string(c), true
+		}
+	}
+	return "", false
+}
+
+//Flags of the exercises running in the environment
+func (e *environment) Flags() []store.Challenge {
+	return e.lab.Flags()
+}
+
 func (e *environment) Close() error {
+	//Remove the guacamole user together with its RDP connections
+	if e.guacUser != "" && e.guacAdmin != nil {
+		if err := e.guacAdmin.DeleteConnections(e.guacUser + "-"); err != nil {
+			log.Error().Str("user", e.guacUser).Msgf("Error deleting guacamole connections: %v", err)
+		}
+		if err := e.guacAdmin.DeleteUser(e.guacUser); err != nil {
+			log.Error().Str("user", e.guacUser).Msgf("Error deleting guacamole user: %v", err)
+		}
+	}
+
 	err := e.lab.Close()
 	return err
 }
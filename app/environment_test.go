@@ -0,0 +1,91 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aau-network-security/haaukins/store"
+)
+
+func TestEnvironmentExtend(t *testing.T) {
+	expires := time.Now().Add(environmentTimer)
+	env := &environment{
+		timer:   time.NewTimer(environmentTimer),
+		expires: expires,
+	}
+
+	for i := 0; i < environmentMaxExtensions; i++ {
+		got, err := env.Extend()
+		if err != nil {
+			t.Fatalf("unexpected error extending the environment: %v", err)
+		}
+		expires = expires.Add(environmentExtension)
+		if !got.Equal(expires) || !env.Expires().Equal(expires) {
+			t.Fatalf("expected the environment to expire at %s, got %s", expires, got)
+		}
+	}
+
+	if _, err := env.Extend(); err != ErrMaxExtensions {
+		t.Fatalf("expected %v, got %v", ErrMaxExtensions, err)
+	}
+
+	closed := &environment{timer: time.NewTimer(0), expires: time.Now()}
+	<-closed.timer.C
+	if _, err := closed.Extend(); err != ErrEnvironmentClosed {
+		t.Fatalf("expected %v, got %v", ErrEnvironmentClosed, err)
+	}
+}
+
+func TestEnvironmentReset(t *testing.T) {
+	lab := &testLab{}
+	env := &environment{
+		maxResets:  2,
+		challenges: []store.Tag{"ftp", "sql"},
+		lab:        &localLab{lab: lab},
+	}
+	ctx := context.Background()
+
+	if _, err := env.Reset(ctx, "telnet", false); err != ErrUnknownExercise {
+		t.Fatalf("expected %v, got %v", ErrUnknownExercise, err)
+	}
+	if left, err := env.Reset(ctx, "FTP", false); err != nil || left != 1 {
+		t.Fatalf("expected one reset left, got %d (%v)", left, err)
+	}
+	if left, err := env.Reset(ctx, "", false); err != nil || left != 0 {
+		t.Fatalf("expected no reset left, got %d (%v)", left, err)
+	}
+	if _, err := env.Reset(ctx, "sql", false); err != ErrMaxResets {
+		t.Fatalf("expected %v, got %v", ErrMaxResets, err)
+	}
+	if _, err := env.Reset(ctx, "sql", true); err != nil {
+		t.Fatalf("unexpected error forcing a reset: %v", err)
+	}
+
+	if lab.restarts != 1 || len(lab.resets) != 2 || lab.resets[0] != "ftp" || lab.resets[1] != "sql" {
+		t.Fatalf("unexpected resets: %d restarts, exercises %v", lab.restarts, lab.resets)
+	}
+}
+
+func TestEnvironmentResetFailed(t *testing.T) {
+	failed := errors.New("docker unavailable")
+	lab := &testLab{restartErr: failed, resetErr: failed}
+	env := &environment{
+		maxResets:  1,
+		challenges: []store.Tag{"ftp"},
+		lab:        &localLab{lab: lab},
+	}
+	ctx := context.Background()
+
+	for _, exercise := range []string{"ftp", ""} {
+		if left, err := env.Reset(ctx, exercise, false); err != failed || left != 1 {
+			t.Fatalf("expected the failed reset %q to leave one reset, got %d (%v)", exercise, left, err)
+		}
+	}
+
+	lab.restartErr, lab.resetErr = nil, nil
+	if left, err := env.Reset(ctx, "ftp", false); err != nil || left != 0 {
+		t.Fatalf("expected no reset left, got %d (%v)", left, err)
+	}
+}
@@ -0,0 +1,80 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+const envsAdminPath = "/admin/envs/"
+
+// Handle the requests made to `/admin/envs/`: `GET` lists the environments of each client,
+// `DELETE /admin/envs/{client}?challenges={tags}` closes a lab and
+// `POST /admin/envs/{client}/extend?challenges={tags}` extends it
+func (lm *LearningMaterialAPI) handleEnvs() http.HandlerFunc {
+	list := lm.listEnvs()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, envsAdminPath), "/"), "/")
+		clientID, action := path[0], ""
+		if len(path) > 1 {
+			action = path[1]
+		}
+
+		switch {
+		case r.Method == http.MethodGet && clientID == "":
+			list(w, r)
+			return
+		case clientID == "" || len(path) > 2,
+			r.Method == http.MethodDelete && action != "",
+			r.Method == http.MethodPost && action != "extend",
+			r.Method != http.MethodDelete && r.Method != http.MethodPost:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		client, err := lm.ClientRequestStore.GetClient(clientID)
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		cr, err := client.GetClientRequest(r.URL.Query().Get(requestedChallenges))
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if !cr.isReady || cr.env == nil {
+			writeJSONError(w, http.StatusConflict, "the lab is not ready yet")
+			return
+		}
+
+		admin, _, _ := r.BasicAuth()
+		event := auditEvent{
+			Actor:   "admin:" + admin,
+			Client:  client.ID(),
+			Request: cr.ID(),
+			Details: map[string]string{"challenges": cr.Challenges()},
+		}
+
+		if r.Method == http.MethodDelete {
+			if !cr.env.Expire() {
+				writeJSONError(w, http.StatusConflict, "the lab is already being closed")
+				return
+			}
+			event.Action = auditLabClosed
+			lm.audit.Record(event)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		expires, err := cr.env.Extend()
+		if err != nil {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		}
+		event.Action = auditLabExtended
+		event.Details["expires"] = expires.Format(time.RFC3339)
+		lm.audit.Record(event)
+		writeJSON(w, http.StatusOK, map[string]time.Time{"expires": expires})
+	}
+}
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminEnvs(t *testing.T) {
+	lm := &LearningMaterialAPI{
+		conf:               &Config{API: APIConfig{SignKey: "test-key"}},
+		ClientRequestStore: NewClientRequestStore(),
+		audit:              &auditLog{},
+	}
+	cr, _ := newTestLab(t, lm, "ftp,sql", nil)
+	client, _, err := lm.ClientRequestStore.GetClientRequestByID(cr.ID())
+	if err != nil {
+		t.Fatalf("unable to get client: %v", err)
+	}
+
+	do := func(method, path string) int {
+		w := httptest.NewRecorder()
+		lm.handleEnvs()(w, httptest.NewRequest(method, path, nil))
+		return w.Code
+	}
+
+	expires := cr.env.Expires()
+	if code := do(http.MethodPost, envsAdminPath+client.ID()+"/extend?challenges=sql,ftp"); code != http.StatusOK {
+		t.Fatalf("expected the lab to be extended, got %d", code)
+	}
+	if !cr.env.Expires().After(expires) {
+		t.Errorf("expected the lab to expire later")
+	}
+
+	for path, want := range map[string]int{
+		envsAdminPath + "unknown?challenges=ftp,sql":               http.StatusNotFound,
+		envsAdminPath + client.ID() + "?challenges=xss":            http.StatusNotFound,
+		envsAdminPath + client.ID() + "/extend?challenges=ftp,sql": http.StatusMethodNotAllowed,
+	} {
+		if code := do(http.MethodDelete, path); code != want {
+			t.Errorf("DELETE %s: expected %d, got %d", path, want, code)
+		}
+	}
+
+	if code := do(http.MethodDelete, envsAdminPath+client.ID()+"?challenges=ftp,sql"); code != http.StatusNoContent {
+		t.Fatalf("expected the lab to be closed, got %d", code)
+	}
+	select {
+	case <-cr.env.GetTimer().C:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the lab to be closed through its timer")
+	}
+}
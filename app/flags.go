@@ -0,0 +1,135 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aau-network-security/haaukins/store"
+	"github.com/rs/zerolog/log"
+)
+
+const flagsAPIPath = "/api/flags"
+
+// solve is a challenge solved in a client request
+type solve struct {
+	Tag    string    `json:"tag"`
+	Name   string    `json:"name"`
+	Solved time.Time `json:"solved_at"`
+}
+
+// Record a solve, when the challenge was already solved the first solve is returned together with false
+func (cr *ClientRequest) addSolve(s solve) (solve, bool) {
+	cr.m.Lock()
+	defer cr.m.Unlock()
+
+	if cr.solves == nil {
+		cr.solves = map[string]solve{}
+	}
+	if prev, ok := cr.solves[s.Tag]; ok {
+		return prev, false
+	}
+	cr.solves[s.Tag] = s
+	return s, true
+}
+
+// Solves of the client request, in the order they were solved
+func (cr *ClientRequest) Solves() []solve {
+	cr.m.Lock()
+	defer cr.m.Unlock()
+
+	solves := make([]solve, 0, len(cr.solves))
+	for _, s := range cr.solves {
+		solves = append(solves, s)
+	}
+	sort.Slice(solves, func(i, j int) bool { return solves[i].Solved.Before(solves[j].Solved) })
+	return solves
+}
+
+// Find the challenge the flag belongs to among the flags of a lab
+func checkFlag(flags []store.Challenge, flag string) (store.Challenge, bool) {
+	flag = strings.TrimSpace(flag)
+	if flag == "" {
+		return store.Challenge{}, false
+	}
+	for _, f := range flags {
+		if f.Value != "" && subtle.ConstantTimeCompare([]byte(f.Value), []byte(flag)) == 1 {
+			return f, true
+		}
+	}
+	return store.Challenge{}, false
+}
+
+// Handle the requests made to `/api/flags`, it checks a flag against the flags of the lab
+// of the session, body: `{"challenges": "ftp,sql", "flag": "HKN{...}"}`
+func (lm *LearningMaterialAPI) handleFlags() http.HandlerFunc {
+
+	type flagRequest struct {
+		Challenges string `json:"challenges"`
+		Flag       string `json:"flag"`
+	}
+
+	type flagResponse struct {
+		Correct       bool   `json:"correct"`
+		Challenge     *solve `json:"challenge,omitempty"`
+		AlreadySolved bool   `json:"already_solved,omitempty"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		if !sameOrigin(r) {
+			writeJSONError(w, http.StatusForbidden, "cross-origin request")
+			return
+		}
+		client, err := lm.sessionClient(r)
+		if err != nil {
+			writeJSONError(w, http.StatusUnauthorized, errorGuacSession)
+			return
+		}
+
+		var req flagRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		cr, err := client.GetClientRequest(req.Challenges)
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, errorGetCR)
+			return
+		}
+		if !cr.isReady || cr.env == nil {
+			writeJSONError(w, http.StatusConflict, "the lab is not ready yet")
+			return
+		}
+
+		chal, ok := checkFlag(cr.env.Flags(), req.Flag)
+		if !ok {
+			writeJSON(w, http.StatusOK, flagResponse{Correct: false})
+			return
+		}
+
+		s, first := cr.addSolve(solve{
+			Tag:    string(chal.Tag),
+			Name:   chal.Name,
+			Solved: time.Now(),
+		})
+		if first {
+			log.Info().Str("request", cr.ID()).Str("challenge", s.Tag).Msg("Challenge solved")
+			lm.progress.Solved(client.Identity(), s)
+		}
+		writeJSON(w, http.StatusOK, flagResponse{
+			Correct:       true,
+			Challenge:     &s,
+			AlreadySolved: !first,
+		})
+	}
+}
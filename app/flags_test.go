@@ -0,0 +1,96 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aau-network-security/haaukins/store"
+)
+
+// Create a client with a ready lab running the given flags, the session cookie of the client is returned
+func newTestLab(t *testing.T, lm *LearningMaterialAPI, chals string, flags []store.Challenge) (*ClientRequest, *http.Cookie) {
+	client := lm.ClientRequestStore.NewClient("127.0.0.1")
+	cr := client.NewClientRequest(chals)
+	cr.env = &environment{
+		timer:   time.NewTimer(environmentTimer),
+		expires: time.Now().Add(environmentTimer),
+		lab:     &localLab{lab: &testLab{flags: flags}},
+	}
+	cr.isReady = true
+
+	token, err := client.CreateToken(lm.conf.API.SignKey)
+	if err != nil {
+		t.Fatalf("unable to create session token: %v", err)
+	}
+	return cr, &http.Cookie{Name: sessionCookie, Value: token}
+}
+
+func TestFlagSubmission(t *testing.T) {
+	lm := &LearningMaterialAPI{
+		conf:               &Config{API: APIConfig{SignKey: "test-key"}},
+		ClientRequestStore: NewClientRequestStore(),
+	}
+	cr, cookie := newTestLab(t, lm, "ftp,sql", []store.Challenge{
+		{Tag: "ftp", Name: "FTP login", Value: "HKN{ftp-flag}"},
+		{Tag: "sql", Name: "SQL injection", Value: "HKN{sql-flag}"},
+	})
+
+	submit := func(body string, cookie *http.Cookie) (int, map[string]interface{}) {
+		r := httptest.NewRequest(http.MethodPost, flagsAPIPath, strings.NewReader(body))
+		r.Header.Set("Origin", "http://example.com")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		lm.handleFlags()(w, r)
+
+		resp := map[string]interface{}{}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+
+	code, resp := submit(`{"challenges": "ftp,sql", "flag": "HKN{wrong}"}`, cookie)
+	if code != http.StatusOK || resp["correct"] != false {
+		t.Fatalf("expected wrong flag to be rejected, got %d %v", code, resp)
+	}
+
+	code, resp = submit(`{"challenges": "ftp,sql", "flag": " HKN{sql-flag} "}`, cookie)
+	if code != http.StatusOK || resp["correct"] != true {
+		t.Fatalf("expected flag to be correct, got %d %v", code, resp)
+	}
+	chal, _ := resp["challenge"].(map[string]interface{})
+	if chal["tag"] != "sql" || chal["solved_at"] == nil || resp["already_solved"] != nil {
+		t.Fatalf("unexpected solved challenge: %v", resp)
+	}
+
+	_, resp = submit(`{"challenges": "ftp,sql", "flag": "HKN{sql-flag}"}`, cookie)
+	if resp["already_solved"] != true {
+		t.Fatalf("expected challenge to be already solved: %v", resp)
+	}
+
+	if solves := cr.Solves(); len(solves) != 1 || solves[0].Tag != "sql" {
+		t.Fatalf("unexpected solves: %+v", solves)
+	}
+
+	//The flags of another lab can't be checked without its session
+	if code, _ := submit(`{"challenges": "xss", "flag": "HKN{sql-flag}"}`, cookie); code != http.StatusNotFound {
+		t.Errorf("expected lab not found, got %d", code)
+	}
+	if code, _ := submit(`{"challenges": "ftp,sql", "flag": "HKN{sql-flag}"}`, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized without session, got %d", code)
+	}
+
+	//Another site can't submit flags with the session of the learner
+	r := httptest.NewRequest(http.MethodPost, flagsAPIPath, strings.NewReader(`{"challenges": "ftp,sql", "flag": "HKN{ftp-flag}"}`))
+	r.Header.Set("Origin", "https://attacker.example.org")
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	lm.handleFlags()(w, r)
+	if w.Code != http.StatusForbidden || len(cr.Solves()) != 1 {
+		t.Errorf("expected the cross-origin submission to be rejected, got %d", w.Code)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"github.com/aau-network-security/haaukins/store"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -21,6 +20,8 @@ const (
 	pongWait = 60 * time.Second
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
+	// Maximum message size allowed from peer.
+	maxMessageSize = 512
 )
 
 var (
@@ -44,8 +45,15 @@ type Category struct {
 }
 
 type Challenge struct {
-	Name string `json:"name"`
-	Tag  string `json:"tag"`
+	Name        string  `json:"name"`
+	Tag         string  `json:"tag"`
+	Ready       bool    `json:"ready"` //the images of the exercise are pulled
+	Description string  `json:"description,omitempty"`
+	Difficulty  string  `json:"difficulty,omitempty"`
+	Points      uint    `json:"points"`
+	Flags       int     `json:"flags"`
+	Cost        labCost `json:"cost"` //estimated resources of the exercise in a lab
+	flags       []string //tags of the flags of the exercise
 }
 
 type FrontendClient struct {
@@ -64,65 +72,10 @@ func (lm *LearningMaterialAPI) handleFrontendChallengesRequest() http.HandlerFun
 
 		client := &FrontendClient{conn: conn, send: make(chan []byte, 256)}
 
-		var categories []Category
-
-		//Get che Categories
-		cats, err := lm.getChallengeCategories()
+		categories, err := lm.getChallengeCatalog()
 		if err != nil {
 			log.Println(err)
 		}
-		for _, c := range cats {
-			categories = append(categories, Category{
-				Name:       c.Name,
-				Tag:        strings.ToLower(string(c.Tag)),
-				Challenges: []Challenge{},
-			})
-		}
-
-		//loop through the exercises
-		ctx := context.TODO()
-		response, err := lm.exClient.GetExercises(ctx, &proto.Empty{})
-		if err != nil {
-			log.Println(fmt.Errorf("[exercise-service] Error getting exercises: %v", err))
-		}
-
-		for _, e := range response.Exercises {
-			if e.Secret {
-				continue
-			}
-			exercise, err := protobufToJson(e)
-			if err != nil {
-				log.Println("Error converting protobuffer to JSON: %v", err)
-			}
-			eStruct := store.Exercise{}
-			json.Unmarshal([]byte(exercise), &eStruct)
-			chal := Challenge{
-				Name: e.Name,
-				Tag:  e.Tag,
-			}
-
-			var category string
-			for _, i := range eStruct.Instance {
-				if len(i.Flags) != 0 {
-					category = i.Flags[0].Category
-					if len(i.Flags) > 1 {
-						chal.Name += " ("
-						for _, f := range i.Flags {
-							chal.Name += f.Name + ", "
-						}
-						chal.Name = strings.TrimRight(chal.Name, ", ") + ")"
-					}
-				}
-			}
-
-
-			for i, rc := range categories {
-				if rc.Name == category{
-					categories[i].Challenges = append(categories[i].Challenges, chal)
-				}
-			}
-
-		}
 
 		msg := Message{
 			Message: "challenges_categories",
@@ -133,11 +86,36 @@ func (lm *LearningMaterialAPI) handleFrontendChallengesRequest() http.HandlerFun
 
 		client.send <- rawMsg
 
+		//The client gets the changes of the catalog until it disconnects
+		if lm.catalogHub.Register(client) {
+			go client.readPump(lm.catalogHub)
+		} else {
+			close(client.send)
+		}
 		go client.writePump()
 
 	}
 }
 
+//Read from the frontend until it disconnects, only the pongs are expected
+func (c *FrontendClient) readPump(hub *catalogHub) {
+	defer func() {
+		hub.Unregister(c)
+		c.conn.Close()
+	}()
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
 //Send a message to frontend. It uses s ticker in order to close the connection after the data is sent
 func (c *FrontendClient) writePump() {
 	ticker := time.NewTicker(pingPeriod)
@@ -178,6 +156,29 @@ func (c *FrontendClient) writePump() {
 	}
 }
 
+//Get the challenges grouped by their category, secret challenges are not included
+func (lm *LearningMaterialAPI) getChallengeCatalog() ([]Category, error) {
+	cats, exers, err := lm.catalogSources()
+	if err != nil {
+		return nil, err
+	}
+
+	var listed []store.Exercise
+	for _, e := range exers {
+		if e.Secret {
+			continue
+		}
+		if !lm.prefetch.ExerciseReady(string(e.Tag)) && lm.conf.Prefetch.HideUnready {
+			continue
+		}
+		listed = append(listed, e)
+	}
+
+	//The anomalies are reported on the admin API
+	categories, _ := buildCatalog(cats, listed, lm.newChallenge)
+	return categories, nil
+}
+
 //Get challenges categories
 func (lm *LearningMaterialAPI) getChallengeCategories() ([]store.Category, error) {
 	challengeCats := []store.Category{}
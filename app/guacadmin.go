@@ -0,0 +1,291 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aau-network-security/haaukins/svcs/guacamole"
+)
+
+const guacAdminUser = "guacadmin"
+
+var ErrGuacUnauthorized = errors.New("guacamole admin session not authorized")
+
+// guacAdmin manages the guacamole users and connections through the guacamole REST API,
+// covering what the haaukins guacamole client does not (eg. removing users)
+type guacAdmin struct {
+	guac   guacamole.Guacamole
+	client *http.Client
+
+	m          sync.Mutex
+	token      string
+	dataSource string
+}
+
+type guacConnection struct {
+	Identifier        string `json:"identifier"`
+	Name              string `json:"name"`
+	ActiveConnections int    `json:"activeConnections"`
+}
+
+func newGuacAdmin(guac guacamole.Guacamole) *guacAdmin {
+	return &guacAdmin{
+		guac:   guac,
+		client: &http.Client{Timeout: 20 * time.Second},
+	}
+}
+
+func (ga *guacAdmin) baseURL() string {
+	return fmt.Sprintf("http://localhost:%d/guacamole/api", ga.guac.GetPort())
+}
+
+// Get a token for the admin user, a new token is requested only when the previous one is rejected
+func (ga *guacAdmin) session(renew bool) (string, string, error) {
+	ga.m.Lock()
+	defer ga.m.Unlock()
+
+	if ga.token != "" && !renew {
+		return ga.token, ga.dataSource, nil
+	}
+
+	form := url.Values{"username": {guacAdminUser}, "password": {ga.guac.GetAdminPass()}}
+	resp, err := ga.client.PostForm(ga.baseURL()+"/tokens", form)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("[guacamole] Error logging in as admin: %s", resp.Status)
+	}
+
+	var auth struct {
+		AuthToken  string `json:"authToken"`
+		DataSource string `json:"dataSource"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return "", "", err
+	}
+
+	ga.token, ga.dataSource = auth.AuthToken, auth.DataSource
+	return ga.token, ga.dataSource, nil
+}
+
+// Data source the users and connections are stored in
+func (ga *guacAdmin) DataSource() (string, error) {
+	_, ds, err := ga.session(false)
+	return ds, err
+}
+
+// Call the REST API under the data source of the admin session, path is relative to the data source
+func (ga *guacAdmin) do(method, path string, in, out interface{}) error {
+	err := ga.call(method, path, in, out, false)
+	if err == ErrGuacUnauthorized {
+		return ga.call(method, path, in, out, true)
+	}
+	return err
+}
+
+func (ga *guacAdmin) call(method, path string, in, out interface{}, renew bool) error {
+	token, ds, err := ga.session(renew)
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader
+	if in != nil {
+		raw, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(raw)
+	}
+
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	endpoint := fmt.Sprintf("%s/session/data/%s%s%stoken=%s", ga.baseURL(), ds, path, sep, url.QueryEscape(token))
+
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := ga.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return ErrGuacUnauthorized
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("[guacamole] %s %s: %s", method, path, resp.Status)
+	}
+
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+func (ga *guacAdmin) Connections() (map[string]guacConnection, error) {
+	conns := map[string]guacConnection{}
+	if err := ga.do(http.MethodGet, "/connections", nil, &conns); err != nil {
+		return nil, err
+	}
+	return conns, nil
+}
+
+// Delete all the connections whose name starts with prefix
+func (ga *guacAdmin) DeleteConnections(prefix string) error {
+	conns, err := ga.Connections()
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for id, c := range conns {
+		if !strings.HasPrefix(c.Name, prefix) {
+			continue
+		}
+		if err := ga.do(http.MethodDelete, "/connections/"+url.PathEscape(id), nil, nil); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (ga *guacAdmin) DeleteUser(username string) error {
+	return ga.do(http.MethodDelete, "/users/"+url.PathEscape(username), nil, nil)
+}
+
+// Set parameters of the connection with the given name, guacamole replaces the whole
+// connection on update so the current connection and its parameters are fetched first
+func (ga *guacAdmin) UpdateConnectionParameters(name string, params map[string]string) error {
+	conns, err := ga.Connections()
+	if err != nil {
+		return err
+	}
+
+	var id string
+	for k, c := range conns {
+		if c.Name == name {
+			id = k
+			break
+		}
+	}
+	if id == "" {
+		return fmt.Errorf("[guacamole] connection %s not found", name)
+	}
+
+	path := "/connections/" + url.PathEscape(id)
+	conn := map[string]interface{}{}
+	if err := ga.do(http.MethodGet, path, nil, &conn); err != nil {
+		return err
+	}
+	current := map[string]string{}
+	if err := ga.do(http.MethodGet, path+"/parameters", nil, &current); err != nil {
+		return err
+	}
+	for k, v := range params {
+		current[k] = v
+	}
+	conn["parameters"] = current
+
+	return ga.do(http.MethodPut, path, conn, nil)
+}
+
+type guacActiveConnection struct {
+	Identifier           string `json:"identifier"`
+	ConnectionIdentifier string `json:"connectionIdentifier"`
+	Username             string `json:"username"`
+	StartDate            int64  `json:"startDate"`
+}
+
+func (ga *guacAdmin) ActiveConnections() (map[string]guacActiveConnection, error) {
+	conns := map[string]guacActiveConnection{}
+	if err := ga.do(http.MethodGet, "/activeConnections", nil, &conns); err != nil {
+		return nil, err
+	}
+	return conns, nil
+}
+
+// Get the identifier of the sharing profile with the given name of a connection, the
+// profile is created when it does not exist yet. Sharing profiles are removed by
+// guacamole together with their connection
+func (ga *guacAdmin) SharingProfile(connectionID, name string, readOnly bool) (string, error) {
+	type sharingProfile struct {
+		Identifier                  string            `json:"identifier,omitempty"`
+		Name                        string            `json:"name"`
+		PrimaryConnectionIdentifier string            `json:"primaryConnectionIdentifier"`
+		Parameters                  map[string]string `json:"parameters,omitempty"`
+		Attributes                  map[string]string `json:"attributes"`
+	}
+
+	profiles := map[string]sharingProfile{}
+	if err := ga.do(http.MethodGet, "/sharingProfiles", nil, &profiles); err != nil {
+		return "", err
+	}
+	for id, p := range profiles {
+		if p.PrimaryConnectionIdentifier == connectionID && p.Name == name {
+			return id, nil
+		}
+	}
+
+	params := map[string]string{}
+	if readOnly {
+		params["read-only"] = "true"
+	}
+	created := sharingProfile{}
+	if err := ga.do(http.MethodPost, "/sharingProfiles", sharingProfile{
+		Name:                        name,
+		PrimaryConnectionIdentifier: connectionID,
+		Parameters:                  params,
+		Attributes:                  map[string]string{},
+	}, &created); err != nil {
+		return "", err
+	}
+	return created.Identifier, nil
+}
+
+// Get a key which joins the active connection through the sharing profile
+func (ga *guacAdmin) SharingKey(activeConnectionID, sharingProfileID string) (string, error) {
+	var creds struct {
+		Values map[string]string `json:"values"`
+	}
+	path := fmt.Sprintf("/activeConnections/%s/sharingCredentials/%s", url.PathEscape(activeConnectionID), url.PathEscape(sharingProfileID))
+	if err := ga.do(http.MethodGet, path, nil, &creds); err != nil {
+		return "", err
+	}
+	if creds.Values["key"] == "" {
+		return "", fmt.Errorf("[guacamole] no sharing key for active connection %s", activeConnectionID)
+	}
+	return creds.Values["key"], nil
+}
+
+// Log in to guacamole with a sharing key, the raw login response is returned as RawLogin does
+func (ga *guacAdmin) ShareLogin(key string) ([]byte, error) {
+	resp, err := ga.client.PostForm(ga.baseURL()+"/tokens", url.Values{"key": {key}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("[guacamole] Error logging in with sharing key: %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,160 @@
+package app
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aau-network-security/haaukins/svcs/guacamole"
+)
+
+type fakeGuacamole struct {
+	guacamole.Guacamole
+	port uint
+}
+
+func (f fakeGuacamole) GetPort() uint        { return f.port }
+func (f fakeGuacamole) GetAdminPass() string { return "admin-pass" }
+
+// fakeGuacREST is the REST API of guacamole, with the connections and sharing profiles of the tests
+type fakeGuacREST struct {
+	m           sync.Mutex
+	logins      int
+	expired     bool //the current token is rejected once
+	connections map[string]guacConnection
+	profiles    map[string]map[string]interface{}
+	deleted     []string
+	fail        bool
+}
+
+func newFakeGuacAdmin(t *testing.T, f *fakeGuacREST) (*guacAdmin, func()) {
+	m := http.NewServeMux()
+	m.HandleFunc("/guacamole/api/tokens", func(w http.ResponseWriter, r *http.Request) {
+		f.m.Lock()
+		defer f.m.Unlock()
+		if r.FormValue("username") != guacAdminUser || r.FormValue("password") != "admin-pass" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		f.logins++
+		writeJSON(w, http.StatusOK, map[string]string{"authToken": "token-" + strconv.Itoa(f.logins), "dataSource": "postgresql"})
+	})
+	m.HandleFunc("/guacamole/api/session/data/postgresql/", func(w http.ResponseWriter, r *http.Request) {
+		f.m.Lock()
+		defer f.m.Unlock()
+		if f.expired || r.URL.Query().Get("token") != "token-"+strconv.Itoa(f.logins) {
+			f.expired = false
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if f.fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/guacamole/api/session/data/postgresql")
+		switch {
+		case r.Method == http.MethodGet && path == "/connections":
+			writeJSON(w, http.StatusOK, f.connections)
+		case r.Method == http.MethodGet && path == "/sharingProfiles":
+			writeJSON(w, http.StatusOK, f.profiles)
+		case r.Method == http.MethodPost && path == "/sharingProfiles":
+			p := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&p)
+			p["identifier"] = strconv.Itoa(len(f.profiles) + 1)
+			f.profiles[p["identifier"].(string)] = p
+			writeJSON(w, http.StatusOK, p)
+		case r.Method == http.MethodDelete:
+			f.deleted = append(f.deleted, path)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	srv := httptest.NewServer(m)
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatalf("unexpected address of the test server: %v", err)
+	}
+	return newGuacAdmin(fakeGuacamole{port: uint(p)}), srv.Close
+}
+
+func TestGuacAdminSharingProfile(t *testing.T) {
+	f := &fakeGuacREST{profiles: map[string]map[string]interface{}{}}
+	ga, stop := newFakeGuacAdmin(t, f)
+	defer stop()
+
+	id, err := ga.SharingProfile("7", "watch", true)
+	if err != nil {
+		t.Fatalf("unexpected error creating the sharing profile: %v", err)
+	}
+	p, ok := f.profiles[id]
+	if !ok || p["primaryConnectionIdentifier"] != "7" || p["name"] != "watch" {
+		t.Fatalf("expected the sharing profile of the connection to be created, got %v", f.profiles)
+	}
+	if params, _ := p["parameters"].(map[string]interface{}); params["read-only"] != "true" {
+		t.Errorf("expected a read-only sharing profile, got %v", p["parameters"])
+	}
+
+	//The profile is created only once
+	if again, err := ga.SharingProfile("7", "watch", true); err != nil || again != id {
+		t.Fatalf("expected the sharing profile %s, got %s (%v)", id, again, err)
+	}
+	if len(f.profiles) != 1 || f.logins != 1 {
+		t.Errorf("expected 1 profile created with 1 login, got %d profiles and %d logins", len(f.profiles), f.logins)
+	}
+}
+
+func TestGuacAdminDelete(t *testing.T) {
+	f := &fakeGuacREST{connections: map[string]guacConnection{
+		"1": {Identifier: "1", Name: "user1-kali"},
+		"2": {Identifier: "2", Name: "user1-win"},
+		"3": {Identifier: "3", Name: "user10-kali"},
+	}}
+	ga, stop := newFakeGuacAdmin(t, f)
+	defer stop()
+
+	if err := ga.DeleteConnections("user1-"); err != nil {
+		t.Fatalf("unexpected error deleting the connections: %v", err)
+	}
+	f.expired = true //the admin logs in again once its token is rejected
+	if err := ga.DeleteUser("user1"); err != nil {
+		t.Fatalf("unexpected error deleting the user: %v", err)
+	}
+
+	deleted := strings.Join(f.deleted, " ")
+	for _, path := range []string{"/connections/1", "/connections/2", "/users/user1"} {
+		if !strings.Contains(deleted+" ", path+" ") {
+			t.Errorf("expected %s to be deleted, got %v", path, f.deleted)
+		}
+	}
+	if len(f.deleted) != 3 {
+		t.Errorf("expected only the connections of user1 to be deleted, got %v", f.deleted)
+	}
+	if f.logins != 2 {
+		t.Errorf("expected 2 logins, got %d", f.logins)
+	}
+}
+
+func TestGuacAdminErrorStatus(t *testing.T) {
+	f := &fakeGuacREST{fail: true}
+	ga, stop := newFakeGuacAdmin(t, f)
+	defer stop()
+
+	if err := ga.DeleteUser("user1"); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatalf("expected the error status to be returned, got %v", err)
+	}
+	if _, err := ga.Connections(); err == nil {
+		t.Fatalf("expected an error listing the connections")
+	}
+	if len(f.deleted) != 0 {
+		t.Errorf("expected nothing to be deleted, got %v", f.deleted)
+	}
+}
@@ -0,0 +1,297 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	guacPath = "/guacamole/"
+
+	guacTokenHeader   = "Guacamole-Token"
+	guacTunnelUUIDLen = 36 //the UUID guacamole answers the connect of an HTTP tunnel with
+)
+
+type guacRequestKind int
+
+const (
+	guacDenied guacRequestKind = iota
+	guacStatic                 //web application files (html, js, css, images...)
+	guacPublic                 //api endpoints guacamole serves without a token
+	guacAPI                    //api endpoints used by the student session, the token is checked
+	guacTunnel                 //websocket and HTTP tunnels carrying the RDP session
+)
+
+var (
+	//API endpoints, relative to `api/session/data/{datasource}/`, the student interface uses
+	guacUserAPI   = regexp.MustCompile(`^session/data/[^/]+/(self(/.*)?|connectionGroups/ROOT/tree|connections/[^/]+|users/([^/]+)(/permissions|/effectivePermissions)?)$`)
+	guacPublicAPI = map[string]bool{"languages": true, "patches": true}
+)
+
+// Classify a request forwarded to guacamole, everything which is not needed by the
+// student interface (eg. administration endpoints) is denied
+func classifyGuacRequest(r *http.Request) guacRequestKind {
+	p := strings.TrimPrefix(r.URL.Path, guacPath)
+
+	switch {
+	case p == "websocket-tunnel" || p == "tunnel":
+		return guacTunnel
+	case strings.HasPrefix(p, "api/"):
+		api := strings.TrimPrefix(p, "api/")
+		switch {
+		case guacPublicAPI[api] && r.Method == http.MethodGet:
+			return guacPublic
+		case api == "tokens" && r.Method == http.MethodPost:
+			return guacAPI
+		case strings.HasPrefix(api, "tokens/") && r.Method == http.MethodDelete:
+			return guacAPI
+		case guacUserAPI.MatchString(api) && r.Method == http.MethodGet:
+			return guacAPI
+		}
+		return guacDenied
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return guacStatic
+	}
+	return guacDenied
+}
+
+// Get the guacamole token a request has been made with, the token is either in the
+// header, in the query or, when logging in again or connecting the HTTP tunnel, in the form
+func guacRequestToken(r *http.Request) string {
+	if t := r.Header.Get(guacTokenHeader); t != "" {
+		return t
+	}
+	if t := r.URL.Query().Get("token"); t != "" {
+		return t
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, guacPath)
+	if strings.HasPrefix(p, "api/tokens/") {
+		return strings.TrimPrefix(p, "api/tokens/")
+	}
+
+	if p == "api/tokens" || r.URL.RawQuery == "connect" {
+		return guacForm(r).Get("token")
+	}
+	return ""
+}
+
+// Read the form of a POST request without consuming the body which is forwarded to guacamole
+func guacForm(r *http.Request) url.Values {
+	if r.Method != http.MethodPost || r.Body == nil {
+		return url.Values{}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		return url.Values{}
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return url.Values{}
+	}
+	return form
+}
+
+// Tells if the request opens a tunnel, the websocket tunnel is opened by each request
+// while the HTTP tunnel is opened with `tunnel?connect`
+func isGuacTunnelConnect(r *http.Request) bool {
+	p := strings.TrimPrefix(r.URL.Path, guacPath)
+	return p == "websocket-tunnel" || (p == "tunnel" && r.URL.RawQuery == "connect")
+}
+
+// UUID of the HTTP tunnel a read or a write is made to, eg. `tunnel?read:{uuid}:0`
+func guacHTTPTunnelUUID(r *http.Request) string {
+	for _, op := range []string{"read:", "write:"} {
+		if strings.HasPrefix(r.URL.RawQuery, op) {
+			return strings.SplitN(strings.TrimPrefix(r.URL.RawQuery, op), ":", 2)[0]
+		}
+	}
+	return ""
+}
+
+// Identifier of the guacamole connection a tunnel is opened to
+func guacConnectionID(r *http.Request) string {
+	if id := r.URL.Query().Get("GUAC_ID"); id != "" {
+		return id
+	}
+	return guacForm(r).Get("GUAC_ID")
+}
+
+// Get the guacamole token out of the guacamole login response
+func guacAuthToken(content []byte) string {
+	var auth struct {
+		AuthToken string `json:"authToken"`
+	}
+	if err := json.Unmarshal(content, &auth); err != nil {
+		return ""
+	}
+	return auth.AuthToken
+}
+
+// Get the client of the session cookie sent with the request
+func (lm *LearningMaterialAPI) sessionClient(r *http.Request) (Client, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+	clientID, err := GetTokenFromCookie(cookie.Value, lm.conf.API.SignKey)
+	if err != nil {
+		return nil, err
+	}
+	return lm.ClientRequestStore.GetClient(clientID)
+}
+
+// Check the session of a request made to guacamole, the request is forwarded only if it
+// belongs to the client of the session. The client request the guacamole session belongs
+// to is returned, nil for the requests which don't need a guacamole session, and whether
+// the request is made through a shadow session
+func (lm *LearningMaterialAPI) authorizeGuacRequest(r *http.Request) (*ClientRequest, bool, bool) {
+	kind := classifyGuacRequest(r)
+	if kind == guacDenied {
+		return nil, false, false
+	}
+
+	//Admins joining a student session
+	if cr, ok := lm.authorizeShadowRequest(r, kind); ok {
+		return cr, true, true
+	}
+
+	client, err := lm.sessionClient(r)
+	if err != nil {
+		return nil, false, false
+	}
+	if kind == guacStatic || kind == guacPublic {
+		return nil, false, true
+	}
+
+	token := guacRequestToken(r)
+	if token == "" {
+		//HTTP tunnel reads and writes are bound to the tunnel UUID given when it connected
+		if kind != guacTunnel {
+			return nil, false, false
+		}
+		uuid := guacHTTPTunnelUUID(r)
+		for _, cr := range client.GetAllClientRequests() {
+			if shadow, ok := cr.httpTunnel(uuid); ok && !shadow {
+				return cr, false, true
+			}
+		}
+		return nil, false, false
+	}
+
+	for _, cr := range client.GetAllClientRequests() {
+		if cr.guacToken == "" || cr.guacToken != token {
+			continue
+		}
+
+		//A student can only look at its own guacamole user
+		if m := guacUserAPI.FindStringSubmatch(strings.TrimPrefix(r.URL.Path, guacPath+"api/")); m != nil && m[3] != "" && m[3] != cr.ID() {
+			return nil, false, false
+		}
+		return cr, false, true
+	}
+	return nil, false, false
+}
+
+// guacTunnelConn is a tunnel opened to the guacamole session of a client request
+type guacTunnelConn struct {
+	cancel context.CancelFunc
+	shadow bool //opened by an admin shadowing the session, it doesn't count as activity of the lab
+}
+
+// Keep track of the tunnels opened by a client request, they are closed when the environment is closed
+func (cr *ClientRequest) trackTunnel(ctx context.Context, shadow bool) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	cr.m.Lock()
+	defer cr.m.Unlock()
+	if cr.tunnels == nil {
+		cr.tunnels = map[int]guacTunnelConn{}
+	}
+	cr.lastTunnel++
+	id := cr.lastTunnel
+	cr.tunnels[id] = guacTunnelConn{cancel: cancel, shadow: shadow}
+
+	return ctx, func() {
+		cr.m.Lock()
+		delete(cr.tunnels, id)
+		if !shadow {
+			cr.lastActivity = time.Now()
+		}
+		cr.m.Unlock()
+		cancel()
+	}
+}
+
+// Close all the tunnels of the client request, the HTTP tunnels can't be read from anymore
+func (cr *ClientRequest) closeTunnels() {
+	cr.m.Lock()
+	defer cr.m.Unlock()
+	for id, t := range cr.tunnels {
+		t.cancel()
+		delete(cr.tunnels, id)
+	}
+	cr.httpTunnels = nil
+}
+
+// Bind an HTTP tunnel to the client request, its reads and writes carry only its UUID
+func (cr *ClientRequest) bindHTTPTunnel(uuid string, shadow bool) {
+	cr.m.Lock()
+	defer cr.m.Unlock()
+	if cr.httpTunnels == nil {
+		cr.httpTunnels = map[string]bool{}
+	}
+	cr.httpTunnels[uuid] = shadow
+}
+
+// Tells if the HTTP tunnel is bound to the client request, and whether a shadow session opened it
+func (cr *ClientRequest) httpTunnel(uuid string) (bool, bool) {
+	cr.m.Lock()
+	defer cr.m.Unlock()
+	shadow, ok := cr.httpTunnels[uuid]
+	return shadow, ok
+}
+
+// tunnelConnectWriter binds the HTTP tunnel to its client request as soon as guacamole answers
+// the connect with the UUID of the tunnel, before the browser can read from it
+type tunnelConnectWriter struct {
+	http.ResponseWriter
+	status int
+	uuid   []byte
+	bind   func(uuid string)
+}
+
+func (tw *tunnelConnectWriter) WriteHeader(code int) {
+	tw.status = code
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *tunnelConnectWriter) Write(p []byte) (int, error) {
+	if (tw.status == 0 || tw.status == http.StatusOK) && len(tw.uuid) < guacTunnelUUIDLen {
+		n := guacTunnelUUIDLen - len(tw.uuid)
+		if n > len(p) {
+			n = len(p)
+		}
+		tw.uuid = append(tw.uuid, p[:n]...)
+		if len(tw.uuid) == guacTunnelUUIDLen {
+			tw.bind(string(tw.uuid))
+		}
+	}
+	return tw.ResponseWriter.Write(p)
+}
+
+func (tw *tunnelConnectWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
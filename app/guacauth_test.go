@@ -0,0 +1,178 @@
+package app
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testTunnelUUID = "0f3c9a4e-5d2b-4f7a-8c1e-2b6d9e0a7f31"
+
+func TestClassifyGuacRequest(t *testing.T) {
+	tt := []struct {
+		method string
+		path   string
+		kind   guacRequestKind
+	}{
+		{method: http.MethodGet, path: "/guacamole/app.js", kind: guacStatic},
+		{method: http.MethodHead, path: "/guacamole/", kind: guacStatic},
+		{method: http.MethodPost, path: "/guacamole/app.js", kind: guacDenied},
+		{method: http.MethodGet, path: "/guacamole/api/languages", kind: guacPublic},
+		{method: http.MethodPost, path: "/guacamole/api/languages", kind: guacDenied},
+		{method: http.MethodPost, path: "/guacamole/api/tokens", kind: guacAPI},
+		{method: http.MethodDelete, path: "/guacamole/api/tokens/abc", kind: guacAPI},
+		{method: http.MethodGet, path: "/guacamole/api/session/data/postgresql/self", kind: guacAPI},
+		{method: http.MethodGet, path: "/guacamole/api/session/data/postgresql/users/user1/permissions", kind: guacAPI},
+		{method: http.MethodGet, path: "/guacamole/api/session/data/postgresql/users", kind: guacDenied},
+		{method: http.MethodPost, path: "/guacamole/api/session/data/postgresql/connections/1", kind: guacDenied},
+		{method: http.MethodGet, path: "/guacamole/websocket-tunnel", kind: guacTunnel},
+		{method: http.MethodPost, path: "/guacamole/tunnel?connect", kind: guacTunnel},
+		{method: http.MethodGet, path: "/guacamole/tunnel?read:" + testTunnelUUID + ":0", kind: guacTunnel},
+	}
+	for _, tc := range tt {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if kind := classifyGuacRequest(r); kind != tc.kind {
+			t.Errorf("%s %s: expected kind %d, got %d", tc.method, tc.path, tc.kind, kind)
+		}
+	}
+}
+
+func TestGuacRequestToken(t *testing.T) {
+	tt := []struct {
+		name   string
+		method string
+		path   string
+		header string
+		body   string
+		token  string
+	}{
+		{name: "header", method: http.MethodGet, path: "/guacamole/api/session/data/postgresql/self", header: "a", token: "a"},
+		{name: "query", method: http.MethodGet, path: "/guacamole/api/session/data/postgresql/self?token=b", token: "b"},
+		{name: "logout", method: http.MethodDelete, path: "/guacamole/api/tokens/c", token: "c"},
+		{name: "login again", method: http.MethodPost, path: "/guacamole/api/tokens", body: "token=d", token: "d"},
+		{name: "tunnel connect", method: http.MethodPost, path: "/guacamole/tunnel?connect", body: "token=e&GUAC_ID=1", token: "e"},
+		{name: "tunnel read", method: http.MethodGet, path: "/guacamole/tunnel?read:" + testTunnelUUID + ":0"},
+		{name: "static", method: http.MethodGet, path: "/guacamole/app.js"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			if tc.header != "" {
+				r.Header.Set(guacTokenHeader, tc.header)
+			}
+			if token := guacRequestToken(r); token != tc.token {
+				t.Errorf("expected token %q, got %q", tc.token, token)
+			}
+			//The body is still forwarded to guacamole
+			if body, _ := ioutil.ReadAll(r.Body); string(body) != tc.body {
+				t.Errorf("expected the body %q to be kept, got %q", tc.body, body)
+			}
+		})
+	}
+}
+
+func TestGuacAuthorization(t *testing.T) {
+	lm := &LearningMaterialAPI{
+		conf:               &Config{API: APIConfig{SignKey: "test-key"}},
+		ClientRequestStore: NewClientRequestStore(),
+		shadows:            newShadowStore(),
+	}
+	cr, cookie := newTestLab(t, lm, "ftp", nil)
+	cr.guacToken = "student-token"
+	cr.bindHTTPTunnel(testTunnelUUID, false)
+	other, otherCookie := newTestLab(t, lm, "sql", nil)
+	other.guacToken = "other-token"
+
+	self := "/guacamole/api/session/data/postgresql/users/"
+	tt := []struct {
+		name   string
+		method string
+		path   string
+		cookie *http.Cookie
+		cr     *ClientRequest
+		ok     bool
+	}{
+		{name: "static", method: http.MethodGet, path: "/guacamole/app.js", cookie: cookie, ok: true},
+		{name: "static without session", method: http.MethodGet, path: "/guacamole/app.js"},
+		{name: "public", method: http.MethodGet, path: "/guacamole/api/languages", cookie: cookie, ok: true},
+		{name: "api", method: http.MethodGet, path: self + cr.ID() + "?token=student-token", cookie: cookie, cr: cr, ok: true},
+		{name: "api without token", method: http.MethodGet, path: self + cr.ID(), cookie: cookie},
+		{name: "token of another client", method: http.MethodGet, path: self + other.ID() + "?token=other-token", cookie: cookie},
+		{name: "another student", method: http.MethodGet, path: self + other.ID() + "?token=student-token", cookie: cookie},
+		{name: "denied", method: http.MethodGet, path: "/guacamole/api/session/data/postgresql/users?token=student-token", cookie: cookie},
+		{name: "websocket tunnel", method: http.MethodGet, path: "/guacamole/websocket-tunnel?token=student-token", cookie: cookie, cr: cr, ok: true},
+		{name: "tunnel without token", method: http.MethodPost, path: "/guacamole/tunnel?connect", cookie: cookie},
+		{name: "tunnel read", method: http.MethodGet, path: "/guacamole/tunnel?read:" + testTunnelUUID + ":0", cookie: cookie, cr: cr, ok: true},
+		{name: "tunnel write", method: http.MethodPost, path: "/guacamole/tunnel?write:" + testTunnelUUID, cookie: cookie, cr: cr, ok: true},
+		{name: "tunnel of another client", method: http.MethodGet, path: "/guacamole/tunnel?read:" + testTunnelUUID + ":0", cookie: otherCookie},
+		{name: "unknown tunnel", method: http.MethodGet, path: "/guacamole/tunnel?read:" + strings.Repeat("0", guacTunnelUUIDLen) + ":0", cookie: cookie},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.cookie != nil {
+				r.AddCookie(tc.cookie)
+			}
+			got, shadow, ok := lm.authorizeGuacRequest(r)
+			if ok != tc.ok || got != tc.cr {
+				t.Errorf("expected authorized to be %v for %v, got %v for %v", tc.ok, tc.cr, ok, got)
+			}
+			if shadow {
+				t.Errorf("expected the request not to be made through a shadow session")
+			}
+		})
+	}
+
+	//The HTTP tunnels are gone once the lab is closed
+	cr.closeTunnels()
+	r := httptest.NewRequest(http.MethodGet, "/guacamole/tunnel?read:"+testTunnelUUID+":0", nil)
+	r.AddCookie(cookie)
+	if _, _, ok := lm.authorizeGuacRequest(r); ok {
+		t.Errorf("expected the tunnel to be rejected once closed")
+	}
+}
+
+func TestGuacHTTPTunnelBinding(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testTunnelUUID))
+	}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatalf("unexpected address of the test server: %v", err)
+	}
+
+	lm := &LearningMaterialAPI{
+		conf:               &Config{API: APIConfig{SignKey: "test-key"}},
+		ClientRequestStore: NewClientRequestStore(),
+		shadows:            newShadowStore(),
+		guacProxy:          newGuacProxy(uint(p)),
+	}
+	cr, cookie := newTestLab(t, lm, "ftp", nil)
+	cr.guacToken = "student-token"
+
+	r := httptest.NewRequest(http.MethodPost, "/guacamole/tunnel?connect", strings.NewReader("token=student-token&GUAC_ID=1"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	lm.proxyHandler()(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != testTunnelUUID {
+		t.Fatalf("expected the tunnel UUID to be forwarded, got %d %q", w.Code, w.Body.String())
+	}
+	if _, ok := cr.httpTunnel(testTunnelUUID); !ok {
+		t.Fatalf("expected the tunnel to be bound to the lab")
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/guacamole/tunnel?read:"+testTunnelUUID+":0", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	lm.proxyHandler()(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the read of the tunnel to be forwarded, got %d", w.Code)
+	}
+}
@@ -0,0 +1,316 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	proxyConnWebsocket = "websocket"
+	proxyConnHTTP      = "http"
+)
+
+// guacProxy forwards the requests to the local guacamole instance, it is created once and
+// shared by all the requests so the connections to guacamole are reused
+type guacProxy struct {
+	target  *url.URL
+	proxy   *httputil.ReverseProxy
+	dialer  *net.Dialer
+	metrics *proxyMetrics
+}
+
+func newGuacProxy(port uint) *guacProxy {
+	target := &url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:%d", port)}
+	dialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	gp := &guacProxy{
+		target:  target,
+		dialer:  dialer,
+		metrics: newProxyMetrics(),
+	}
+
+	gp.proxy = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.Header.Add("X-Forwarded-Host", req.Host)
+			req.Header.Add("X-Origin-Host", target.Host)
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+		},
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			MaxIdleConns:          256,
+			MaxIdleConnsPerHost:   256,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			ExpectContinueTimeout: time.Second,
+			//The HTTP tunnel streams the RDP session, compressing it only adds latency
+			DisableCompression: true,
+		},
+		//Flush straight away, the HTTP tunnel responses are long lived streams
+		FlushInterval: -1,
+		ErrorHandler:  gp.errorHandler,
+	}
+
+	return gp
+}
+
+func (gp *guacProxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	gp.metrics.addError()
+	if r.Context().Err() != nil { //The user went away or the tunnel has been closed
+		return
+	}
+
+	log.Warn().Str("path", r.URL.Path).Msgf("Error proxying request to guacamole: %v", err)
+	errorPage(w, r, http.StatusBadGateway, returnError{
+		Content:         errorGuacDown,
+		Toomanyrequests: false,
+	})
+}
+
+// Forward the request to guacamole, cr is the client request the request belongs to (if any)
+func (gp *guacProxy) Forward(w http.ResponseWriter, r *http.Request, cr *ClientRequest) {
+	if isWebsocketRequest(r) {
+		gp.forwardWebsocket(w, r, cr)
+		return
+	}
+
+	conn := gp.metrics.open(proxyConnHTTP, r, cr)
+	defer gp.metrics.close(conn)
+
+	cw := &countingResponseWriter{ResponseWriter: w, conn: conn}
+	gp.proxy.ServeHTTP(cw, r)
+}
+
+// Pass the websocket through to guacamole. The connection is closed when the request
+// context is done (eg. when the environment of the client request is closed)
+func (gp *guacProxy) forwardWebsocket(w http.ResponseWriter, r *http.Request, cr *ClientRequest) {
+	backConn, err := gp.dialer.DialContext(r.Context(), "tcp", gp.target.Host)
+	if err != nil {
+		gp.errorHandler(w, r, err)
+		return
+	}
+	defer backConn.Close()
+
+	outReq := r.Clone(r.Context())
+	outReq.URL.Scheme = gp.target.Scheme
+	outReq.URL.Host = gp.target.Host
+	outReq.Header.Add("X-Forwarded-Host", r.Host)
+	outReq.Header.Add("X-Origin-Host", gp.target.Host)
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		outReq.Header.Add("X-Forwarded-For", ip)
+	}
+	if err := outReq.Write(backConn); err != nil {
+		gp.errorHandler(w, r, err)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		gp.errorHandler(w, r, fmt.Errorf("websocket connection can't be hijacked"))
+		return
+	}
+	clientConn, brw, err := hj.Hijack()
+	if err != nil {
+		gp.errorHandler(w, r, err)
+		return
+	}
+	defer clientConn.Close()
+	//The server deadlines are for the requests, not for the session tunnelled
+	clientConn.SetDeadline(time.Time{})
+
+	conn := gp.metrics.open(proxyConnWebsocket, r, cr)
+	defer gp.metrics.close(conn)
+
+	//Data the client sent after the upgrade request, already read by the server
+	if n := brw.Reader.Buffered(); n > 0 {
+		buffered, _ := brw.Reader.Peek(n)
+		if _, err := backConn.Write(buffered); err != nil {
+			return
+		}
+		atomic.AddInt64(&conn.BytesIn, int64(n))
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		clientConn.Close()
+		backConn.Close()
+	}()
+
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(backConn, &countingReader{r: clientConn, n: &conn.BytesIn})
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(clientConn, &countingReader{r: backConn, n: &conn.BytesOut})
+		errc <- err
+	}()
+	<-errc
+}
+
+func isWebsocketRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// countingResponseWriter counts the bytes sent back to the user, keeping the
+// flushing of the wrapped writer working
+type countingResponseWriter struct {
+	http.ResponseWriter
+	conn *proxyConn
+}
+
+func (cw *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	atomic.AddInt64(&cw.conn.BytesOut, int64(n))
+	return n, err
+}
+
+func (cw *countingResponseWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// proxyConn are the metrics of a single connection proxied to guacamole
+type proxyConn struct {
+	ID       uint64    `json:"id"`
+	Kind     string    `json:"kind"`
+	Path     string    `json:"path"`
+	Request  string    `json:"request,omitempty"`
+	Remote   string    `json:"remote"`
+	Started  time.Time `json:"started"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Duration string    `json:"duration"`
+}
+
+type proxyMetrics struct {
+	m        sync.Mutex
+	lastID   uint64
+	active   map[uint64]*proxyConn
+	total    map[string]uint64
+	bytesIn  int64
+	bytesOut int64
+	errors   uint64
+}
+
+type proxyMetricsReport struct {
+	Active      []proxyConn       `json:"active"`
+	Connections map[string]uint64 `json:"connections"`
+	BytesIn     int64             `json:"bytes_in"`
+	BytesOut    int64             `json:"bytes_out"`
+	Errors      uint64            `json:"errors"`
+}
+
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{
+		active: map[uint64]*proxyConn{},
+		total:  map[string]uint64{},
+	}
+}
+
+func (pm *proxyMetrics) open(kind string, r *http.Request, cr *ClientRequest) *proxyConn {
+	pm.m.Lock()
+	defer pm.m.Unlock()
+
+	pm.lastID++
+	c := &proxyConn{
+		ID:      pm.lastID,
+		Kind:    kind,
+		Path:    r.URL.Path,
+		Remote:  r.RemoteAddr,
+		Started: time.Now(),
+	}
+	if cr != nil {
+		c.Request = cr.ID()
+	}
+	pm.active[c.ID] = c
+	pm.total[kind]++
+	return c
+}
+
+func (pm *proxyMetrics) close(c *proxyConn) {
+	pm.m.Lock()
+	defer pm.m.Unlock()
+
+	in, out := atomic.LoadInt64(&c.BytesIn), atomic.LoadInt64(&c.BytesOut)
+	delete(pm.active, c.ID)
+	pm.bytesIn += in
+	pm.bytesOut += out
+	if c.Kind == proxyConnWebsocket {
+		log.Debug().
+			Str("request", c.Request).
+			Int64("in", in).
+			Int64("out", out).
+			Dur("duration", time.Since(c.Started)).
+			Msg("Guacamole websocket closed")
+	}
+}
+
+func (pm *proxyMetrics) addError() {
+	pm.m.Lock()
+	defer pm.m.Unlock()
+	pm.errors++
+}
+
+// Report of the connections currently open and the totals since the API started
+func (pm *proxyMetrics) Report() proxyMetricsReport {
+	pm.m.Lock()
+	defer pm.m.Unlock()
+
+	rep := proxyMetricsReport{
+		Active:      []proxyConn{},
+		Connections: map[string]uint64{},
+		BytesIn:     pm.bytesIn,
+		BytesOut:    pm.bytesOut,
+		Errors:      pm.errors,
+	}
+	for k, v := range pm.total {
+		rep.Connections[k] = v
+	}
+	for _, c := range pm.active {
+		cc := proxyConn{
+			ID:       c.ID,
+			Kind:     c.Kind,
+			Path:     c.Path,
+			Request:  c.Request,
+			Remote:   c.Remote,
+			Started:  c.Started,
+			BytesIn:  atomic.LoadInt64(&c.BytesIn),
+			BytesOut: atomic.LoadInt64(&c.BytesOut),
+			Duration: time.Since(c.Started).Round(time.Second).String(),
+		}
+		rep.Active = append(rep.Active, cc)
+		rep.BytesIn += cc.BytesIn
+		rep.BytesOut += cc.BytesOut
+	}
+	return rep
+}
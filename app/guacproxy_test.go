@@ -0,0 +1,170 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Port of the address the listener of a test server is bound to
+func testServerPort(t *testing.T, addr net.Addr) uint {
+	_, port, _ := net.SplitHostPort(addr.String())
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatalf("unexpected address of the test server: %v", err)
+	}
+	return uint(p)
+}
+
+// Serve a websocket backend which echoes everything sent after the upgrade
+func newEchoBackend(t *testing.T) net.Listener {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				if _, err := http.ReadRequest(br); err != nil {
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+				io.Copy(conn, br)
+			}()
+		}
+	}()
+	return lis
+}
+
+func TestGuacProxyWebsocket(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	gp := newGuacProxy(testServerPort(t, backend.Addr()))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gp.Forward(w, r.WithContext(ctx), nil)
+	}))
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to connect to the proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	//The data sent with the upgrade request is read by the server before the hijack
+	io.WriteString(conn, "GET /guacamole/websocket-tunnel HTTP/1.1\r\nHost: haaukins\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\nhello")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the upgrade to be forwarded, got %v %v", resp, err)
+	}
+	header := int64(len("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+
+	echo := func(want string) {
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(br, got); err != nil || string(got) != want {
+			t.Fatalf("expected %q echoed, got %q (%v)", want, got, err)
+		}
+	}
+	echo("hello")
+	io.WriteString(conn, "world!")
+	echo("world!")
+
+	rep := gp.metrics.Report()
+	if len(rep.Active) != 1 || rep.Active[0].Kind != proxyConnWebsocket || rep.Connections[proxyConnWebsocket] != 1 {
+		t.Fatalf("expected the websocket to be active, got %+v", rep)
+	}
+	if c := rep.Active[0]; c.BytesIn != 11 || c.BytesOut != header+11 {
+		t.Errorf("expected 11 bytes in and %d out, got %d and %d", header+11, c.BytesIn, c.BytesOut)
+	}
+
+	//The tunnel is torn down with the context of the request, eg. when the lab is closed
+	cancel()
+	if _, err := br.ReadByte(); err == nil {
+		t.Fatalf("expected the connection to be closed")
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(gp.metrics.Report().Active) != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	rep = gp.metrics.Report()
+	if len(rep.Active) != 0 || rep.BytesIn != 11 || rep.BytesOut != header+11 {
+		t.Errorf("expected the closed websocket to be counted in the totals, got %+v", rep)
+	}
+}
+
+func TestGuacProxyHTTP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "guacamole")
+	}))
+	defer backend.Close()
+
+	gp := newGuacProxy(testServerPort(t, backend.Listener.Addr()))
+	w := httptest.NewRecorder()
+	gp.Forward(w, httptest.NewRequest(http.MethodGet, "/guacamole/app.js", nil), nil)
+	if w.Code != http.StatusOK || w.Body.String() != "guacamole" {
+		t.Fatalf("expected the response of guacamole, got %d %q", w.Code, w.Body.String())
+	}
+
+	rep := gp.metrics.Report()
+	if len(rep.Active) != 0 || rep.Connections[proxyConnHTTP] != 1 || rep.BytesOut != int64(len("guacamole")) {
+		t.Errorf("expected the request to be closed and counted, got %+v", rep)
+	}
+}
+
+func TestGuacProxyDown(t *testing.T) {
+	//The error page is rendered from the templates of the repository
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("unable to get the working dir: %v", err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatalf("unable to change the working dir: %v", err)
+	}
+	defer os.Chdir(wd)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	gp := newGuacProxy(testServerPort(t, lis.Addr()))
+	lis.Close()
+
+	w := httptest.NewRecorder()
+	gp.Forward(w, httptest.NewRequest(http.MethodGet, "/guacamole/app.js", nil), nil)
+	body, _ := ioutil.ReadAll(w.Body)
+	if w.Code != http.StatusBadGateway || !strings.Contains(string(body), errorGuacDown) {
+		t.Errorf("expected the error page of guacamole down, got %d %q", w.Code, body)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/guacamole/websocket-tunnel", nil)
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Connection", "Upgrade")
+	gp.Forward(w, r, nil)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected the websocket to fail with a bad gateway, got %d", w.Code)
+	}
+	if rep := gp.metrics.Report(); rep.Errors != 2 || len(rep.Active) != 0 {
+		t.Errorf("expected 2 errors and no connection left, got %+v", rep)
+	}
+}
@@ -0,0 +1,124 @@
+package app
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	idleTimeout = 15 * time.Minute
+	idleWarning = 5 * time.Minute //the lab page warns the user this long before closing an idle lab
+	idleTicker  = time.Minute
+)
+
+// Start tracking the activity of the client request, its lab is closed once it has been idle
+// for the given timeout, 0 or less never closes it
+func (cr *ClientRequest) startIdle(timeout time.Duration) {
+	cr.m.Lock()
+	defer cr.m.Unlock()
+	cr.idleTimeout = timeout
+	cr.lastActivity = time.Now()
+}
+
+// Record activity on the lab of the client request (guacamole traffic, lab page hits)
+func (cr *ClientRequest) touch() {
+	cr.m.Lock()
+	defer cr.m.Unlock()
+	cr.lastActivity = time.Now()
+}
+
+// Time the lab of the client request is closed if it stays idle, the zero time when the lab
+// is never closed for being idle. A lab with a guacamole tunnel of the student open, including
+// a pending read of an HTTP tunnel, is never idle, the tunnels of the admins shadowing it don't count
+func (cr *ClientRequest) IdleDeadline() time.Time {
+	return cr.idleDeadline(time.Now())
+}
+
+func (cr *ClientRequest) idleDeadline(now time.Time) time.Time {
+	cr.m.Lock()
+	defer cr.m.Unlock()
+	if cr.idleTimeout <= 0 || cr.lastActivity.IsZero() {
+		return time.Time{}
+	}
+	for _, t := range cr.tunnels {
+		if !t.shadow {
+			return now.Add(cr.idleTimeout)
+		}
+	}
+	return cr.lastActivity.Add(cr.idleTimeout)
+}
+
+// Idle timeout of the labs of the given challenges, the first profile matching the challenges
+// with an idle timeout is used, otherwise the default one
+func (lm *LearningMaterialAPI) labIdleTimeout(chals string) time.Duration {
+	for _, p := range lm.frontendProfiles {
+		if p.idleTimeout != 0 && p.sets.Match(chals) {
+			return p.idleTimeout
+		}
+	}
+	return lm.conf.API.IdleTimeout
+}
+
+// idleReaper closes the labs which have been idle for too long, freeing their slots
+type idleReaper struct {
+	lm   *LearningMaterialAPI
+	stop chan struct{}
+	once sync.Once
+}
+
+func newIdleReaper(lm *LearningMaterialAPI) *idleReaper {
+	return &idleReaper{
+		lm:   lm,
+		stop: make(chan struct{}),
+	}
+}
+
+// Close the idle labs periodically, until the reaper is closed
+func (ir *idleReaper) loop() {
+	ticker := time.NewTicker(idleTicker)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ir.reap(time.Now())
+		case <-ir.stop:
+			return
+		}
+	}
+}
+
+// Close the labs idle at the given time, the labs are closed through their timer so they
+// go through the same steps as the labs which expire
+func (ir *idleReaper) reap(now time.Time) {
+	for _, cr := range ir.lm.ClientRequestStore.GetAllRequests() {
+		if !cr.isReady || cr.env == nil {
+			continue
+		}
+		deadline := cr.idleDeadline(now)
+		if deadline.IsZero() || now.Before(deadline) {
+			continue
+		}
+		if !cr.env.Expire() {
+			continue
+		}
+
+		log.Info().Str("request", cr.ID()).Msg("Closing idle lab")
+		e := auditEvent{
+			Action:  auditLabIdleClosed,
+			Actor:   "api",
+			Request: cr.ID(),
+			Details: map[string]string{"challenges": cr.Challenges()},
+		}
+		if client, _, err := ir.lm.ClientRequestStore.GetClientRequestByID(cr.ID()); err == nil {
+			e.Client = client.ID()
+		}
+		ir.lm.audit.Record(e)
+	}
+}
+
+func (ir *idleReaper) Close() error {
+	ir.once.Do(func() { close(ir.stop) })
+	return nil
+}
@@ -0,0 +1,110 @@
+package app
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIdleReaper(t *testing.T) {
+	lm := &LearningMaterialAPI{
+		conf:               &Config{API: APIConfig{SignKey: "test-key", IdleTimeout: 10 * time.Minute}},
+		ClientRequestStore: NewClientRequestStore(),
+		frontendProfiles: newFrontendProfiles([]FrontendProfile{
+			{ChallengeSets: []string{"sql"}, IdleTimeout: 30 * time.Minute},
+		}),
+	}
+	if got := lm.labIdleTimeout("sql"); got != 30*time.Minute {
+		t.Fatalf("expected the idle timeout of the profile, got %s", got)
+	}
+
+	idle, _ := newTestLab(t, lm, "ftp", nil)
+	idle.startIdle(lm.labIdleTimeout("ftp"))
+	tunnel, _ := newTestLab(t, lm, "telnet", nil)
+	tunnel.startIdle(lm.labIdleTimeout("telnet"))
+	_, done := tunnel.trackTunnel(context.Background(), false)
+	defer done()
+	never, _ := newTestLab(t, lm, "xss", nil)
+	//An admin watching a lab doesn't keep it from being idle
+	shadowed, _ := newTestLab(t, lm, "sql", nil)
+	shadowed.startIdle(lm.labIdleTimeout("sql"))
+	_, watched := shadowed.trackTunnel(context.Background(), true)
+	watched()
+
+	ir := newIdleReaper(lm)
+	ir.reap(time.Now().Add(5 * time.Minute))
+	if !idle.env.Expires().After(time.Now()) {
+		t.Fatalf("expected the lab to be kept before the idle timeout")
+	}
+
+	ir.reap(time.Now().Add(11 * time.Minute))
+	select {
+	case <-idle.env.GetTimer().C:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the idle lab to be closed")
+	}
+	for _, cr := range []*ClientRequest{tunnel, never, shadowed} {
+		if !cr.env.Expires().After(time.Now()) {
+			t.Errorf("expected lab %s to be kept", cr.Challenges())
+		}
+	}
+
+	_, watching := shadowed.trackTunnel(context.Background(), true)
+	defer watching()
+	ir.reap(time.Now().Add(31 * time.Minute))
+	select {
+	case <-shadowed.env.GetTimer().C:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the shadowed lab to be closed once idle")
+	}
+}
+
+func TestIdleHTTPTunnel(t *testing.T) {
+	reading := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(reading)
+		<-release
+	}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatalf("unexpected address of the test server: %v", err)
+	}
+
+	lm := &LearningMaterialAPI{
+		conf:               &Config{API: APIConfig{SignKey: "test-key", IdleTimeout: 10 * time.Minute}},
+		ClientRequestStore: NewClientRequestStore(),
+		shadows:            newShadowStore(),
+		guacProxy:          newGuacProxy(uint(p)),
+	}
+	cr, cookie := newTestLab(t, lm, "ftp", nil)
+	cr.startIdle(lm.labIdleTimeout("ftp"))
+	cr.lastActivity = time.Now().Add(-time.Hour)
+	cr.bindHTTPTunnel(testTunnelUUID, false)
+
+	r := httptest.NewRequest(http.MethodGet, "/guacamole/tunnel?read:"+testTunnelUUID+":0", nil)
+	r.AddCookie(cookie)
+	done := make(chan struct{})
+	go func() {
+		lm.proxyHandler()(httptest.NewRecorder(), r)
+		close(done)
+	}()
+	<-reading
+
+	//The lab isn't idle while the student reads from the tunnel
+	now := time.Now().Add(time.Hour)
+	if d := cr.idleDeadline(now); !d.After(now) {
+		t.Errorf("expected the lab to be active during the read, deadline %s", d)
+	}
+	close(release)
+	<-done
+	if d := cr.IdleDeadline(); d.Before(time.Now().Add(9 * time.Minute)) {
+		t.Errorf("expected the read to count as activity, deadline %s", d)
+	}
+}
@@ -0,0 +1,151 @@
+package app
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/aau-network-security/haaukins/exercise"
+	hlab "github.com/aau-network-security/haaukins/lab"
+	"github.com/aau-network-security/haaukins/store"
+	"github.com/aau-network-security/haaukins/virtual"
+)
+
+// testLab is the haaukins lab of the tests, each of its steps can be made to fail. With a host,
+// its containers and VMs are created and removed on the host as a real lab would
+type testLab struct {
+	hlab.Lab
+	m          sync.Mutex
+	host       *fakeResourceHost
+	instances  []virtual.InstanceInfo
+	flags      []store.Challenge
+	rdpPorts   []uint
+	starting   map[string][]string //containers created by Start, with their networks
+	started    chan struct{}       //closed once Start created its containers
+	release    chan error          //Start waits for it when set
+	startErr   error
+	restartErr error
+	resetErr   error
+	closeErr   error //the lab fails to close, leaving its resources behind
+	restarts   int
+	resets     []string
+	closed     bool
+}
+
+func (l *testLab) Start(context.Context) error {
+	if l.host != nil {
+		l.host.m.Lock()
+		for id, networks := range l.starting {
+			l.host.containers[id] = networks
+			for _, n := range networks {
+				l.host.networks[n] = true
+			}
+			l.instances = append(l.instances, virtual.InstanceInfo{Type: instanceDocker, Id: id})
+		}
+		l.host.m.Unlock()
+	}
+	if l.started != nil {
+		close(l.started)
+	}
+	if l.release != nil {
+		return <-l.release
+	}
+	return l.startErr
+}
+
+// Restart creates the containers of the lab again, under new IDs
+func (l *testLab) Restart(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if l.restartErr != nil {
+		return l.restartErr
+	}
+	l.restarts++
+	if l.host == nil {
+		return nil
+	}
+
+	l.host.m.Lock()
+	defer l.host.m.Unlock()
+	for i, inst := range l.instances {
+		if inst.Type != instanceDocker {
+			continue
+		}
+		id := inst.Id + "-restart-" + strconv.Itoa(l.restarts)
+		l.host.containers[id] = l.host.containers[inst.Id]
+		delete(l.host.containers, inst.Id)
+		l.instances[i].Id = id
+	}
+	return nil
+}
+
+func (l *testLab) InstanceInfo() []virtual.InstanceInfo { return l.instances }
+
+func (l *testLab) RdpConnPorts() []uint { return l.rdpPorts }
+
+func (l *testLab) Environment() exercise.Environment {
+	return testEnvironment{l}
+}
+
+// Close removes the instances of the lab and its networks no other container is attached to
+func (l *testLab) Close() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.closeErr != nil {
+		return l.closeErr
+	}
+	l.closed = true
+	if l.host == nil {
+		return nil
+	}
+
+	h := l.host
+	h.m.Lock()
+	defer h.m.Unlock()
+	var networks []string
+	for _, i := range l.instances {
+		if i.Type == instanceDocker {
+			networks = append(networks, h.containers[i.Id]...)
+			delete(h.containers, i.Id)
+		} else {
+			delete(h.vms, i.Id)
+		}
+	}
+	for _, n := range networks {
+		var attached bool
+		for _, ns := range h.containers {
+			for _, cn := range ns {
+				attached = attached || cn == n
+			}
+		}
+		if !attached {
+			delete(h.networks, n)
+		}
+	}
+	return nil
+}
+
+func (l *testLab) isClosed() bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.closed
+}
+
+type testEnvironment struct {
+	*testLab
+}
+
+func (e testEnvironment) Challenges() []store.Challenge {
+	return e.flags
+}
+
+func (e testEnvironment) ResetByTag(_ context.Context, tag string) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if e.resetErr != nil {
+		return e.resetErr
+	}
+	e.resets = append(e.resets, tag)
+	return nil
+}
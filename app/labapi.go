@@ -0,0 +1,240 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	labsAPIPath = "/api/v1/labs"
+
+	labStatusCreating = "creating"
+	labStatusReady    = "ready"
+	labStatusError    = "error"
+
+	errorAPIKey      = "missing or invalid API key"
+	errorLabNotFound = "lab not found"
+	errorLabNotReady = "lab is not ready yet"
+	errorKeyRequests = "API key reached the maximum number of requests it can make"
+)
+
+type labRequest struct {
+	User       string   `json:"user"`
+	Challenges []string `json:"challenges"`
+}
+
+type labStatus struct {
+	ID         string   `json:"id"`
+	User       string   `json:"user"`
+	Challenges []string `json:"challenges"`
+	Status     string   `json:"status"`
+	Error      string   `json:"error,omitempty"`
+}
+
+type loginURL struct {
+	URL string `json:"url"`
+}
+
+// Identity used for the clients created through an API key
+func apiKeyIdentity(key APIKey, user string) string {
+	return fmt.Sprintf("apikey:%s/%s", key.Name, user)
+}
+
+// User of a client created through the given API key, the key names have no "/" so the user
+// is the identity after the name of the key
+func apiKeyUser(key APIKey, identity string) (string, bool) {
+	prefix := apiKeyIdentity(key, "")
+	if !strings.HasPrefix(identity, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(identity, prefix), true
+}
+
+// Check the bearer token against the configured API keys and pass the matching key to the handler
+func (lm *LearningMaterialAPI) apiKeyAuth(next func(http.ResponseWriter, *http.Request, APIKey)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if k, ok := lm.requestAPIKey(r); ok {
+			next(w, r, k)
+			return
+		}
+		writeJSONError(w, http.StatusUnauthorized, errorAPIKey)
+	}
+}
+
+// Get the API key the request is authenticated with
+func (lm *LearningMaterialAPI) requestAPIKey(r *http.Request) (APIKey, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	for _, k := range lm.conf.API.APIKeys {
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(k.Key)) == 1 {
+			return k, true
+		}
+	}
+	return APIKey{}, false
+}
+
+// Handle the requests made to `/api/v1/labs`, used by server to server integrations to manage labs
+// on behalf of their users:
+//
+//	POST   /api/v1/labs            create a lab
+//	GET    /api/v1/labs/{id}       get the status of the lab
+//	POST   /api/v1/labs/{id}/login get a one-time login URL for the lab
+//	DELETE /api/v1/labs/{id}       terminate the lab
+func (lm *LearningMaterialAPI) handleLabs() http.HandlerFunc {
+	return lm.apiKeyAuth(func(w http.ResponseWriter, r *http.Request, key APIKey) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, labsAPIPath), "/")
+		parts := strings.Split(path, "/")
+
+		switch {
+		case path == "" && r.Method == http.MethodPost:
+			lm.createLab(w, r, key)
+		case len(parts) == 1 && r.Method == http.MethodGet:
+			lm.labStatus(w, key, parts[0])
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			lm.terminateLab(w, key, parts[0])
+		case len(parts) == 2 && parts[1] == "login" && r.Method == http.MethodPost:
+			lm.labLogin(w, key, parts[0])
+		default:
+			writeJSONError(w, http.StatusNotFound, "not found")
+		}
+	})
+}
+
+func (lm *LearningMaterialAPI) createLab(w http.ResponseWriter, r *http.Request, key APIKey) {
+	var req labRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.User == "" || len(req.Challenges) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "user and challenges are required")
+		return
+	}
+
+	chals := strings.Join(req.Challenges, ",")
+	if _, _, err := lm.GetChallengesFromRequest(chals); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errorChallengesTag)
+		return
+	}
+
+	client := lm.ClientRequestStore.GetOrCreateClient(apiKeyIdentity(key, req.User), r.Host)
+
+	//The same lab has been already requested for the user
+	if cr, err := client.GetClientRequest(chals); err == nil {
+		lm.writeLabStatus(w, http.StatusOK, key, client, cr)
+		return
+	}
+
+	if lm.reachedMaxRequests() {
+		writeJSONError(w, http.StatusServiceUnavailable, errorAPIRequests)
+		return
+	}
+	if key.MaxRequests > 0 && lm.apiKeyRequests(key) >= key.MaxRequests {
+		writeJSONError(w, http.StatusTooManyRequests, errorKeyRequests)
+		return
+	}
+	if client.RequestMade() >= lm.conf.API.ClientMaxRequest {
+		writeJSONError(w, http.StatusTooManyRequests, errorClientRequests)
+		return
+	}
+
+	log.Info().Str("key", key.Name).Str("user", req.User).Str("chals", chals).Msg("Lab requested through API key")
+	cr := lm.CreateEnvironment(client, chals)
+	lm.writeLabStatus(w, http.StatusAccepted, key, client, cr)
+}
+
+func (lm *LearningMaterialAPI) labStatus(w http.ResponseWriter, key APIKey, id string) {
+	client, cr, ok := lm.getKeyClientRequest(key, id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, errorLabNotFound)
+		return
+	}
+	lm.writeLabStatus(w, http.StatusOK, key, client, cr)
+}
+
+func (lm *LearningMaterialAPI) labLogin(w http.ResponseWriter, key APIKey, id string) {
+	client, cr, ok := lm.getKeyClientRequest(key, id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, errorLabNotFound)
+		return
+	}
+	if !cr.isReady {
+		writeJSONError(w, http.StatusConflict, errorLabNotReady)
+		return
+	}
+
+	ticket, err := lm.tickets.Issue(client.ID(), cr.Challenges())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, loginURL{
+		URL: lm.publicURL(fmt.Sprintf("/guaclogin/?%s=%s", loginTicketParam, ticket)),
+	})
+}
+
+func (lm *LearningMaterialAPI) terminateLab(w http.ResponseWriter, key APIKey, id string) {
+	_, cr, ok := lm.getKeyClientRequest(key, id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, errorLabNotFound)
+		return
+	}
+	if !cr.isReady {
+		writeJSONError(w, http.StatusConflict, errorLabNotReady)
+		return
+	}
+
+	log.Info().Str("key", key.Name).Str("request", cr.ID()).Msg("Lab terminated through API key")
+	//Expire the timer, the environment is closed and removed by its timer routine
+	cr.env.GetTimer().Reset(0)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Get a client request only if it has been made through the given API key
+func (lm *LearningMaterialAPI) getKeyClientRequest(key APIKey, id string) (Client, *ClientRequest, bool) {
+	client, cr, err := lm.ClientRequestStore.GetClientRequestByID(id)
+	if err != nil {
+		return nil, nil, false
+	}
+	if _, ok := apiKeyUser(key, client.Identity()); !ok {
+		return nil, nil, false
+	}
+	return client, cr, true
+}
+
+// Number of requests currently running for the users of an API key
+func (lm *LearningMaterialAPI) apiKeyRequests(key APIKey) int {
+	var n int
+	for _, c := range lm.ClientRequestStore.GetAllClients() {
+		if _, ok := apiKeyUser(key, c.Identity()); ok {
+			n += c.RequestMade()
+		}
+	}
+	return n
+}
+
+func (lm *LearningMaterialAPI) writeLabStatus(w http.ResponseWriter, code int, key APIKey, client Client, cr *ClientRequest) {
+	user, _ := apiKeyUser(key, client.Identity())
+	ls := labStatus{
+		ID:         cr.ID(),
+		User:       user,
+		Challenges: strings.Split(cr.Challenges(), ","),
+		Status:     labStatusCreating,
+	}
+
+	if err := cr.Err(); err != nil {
+		//The error has been reported, the lab can be requested again
+		client.RemoveClientRequest(cr.Challenges())
+		ls.Status = labStatusError
+		ls.Error = err.Error()
+	} else if cr.isReady {
+		ls.Status = labStatusReady
+	}
+
+	writeJSON(w, code, ls)
+}
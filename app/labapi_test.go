@@ -0,0 +1,83 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLabsAPI(t *testing.T) {
+	keyA := APIKey{Name: "a", Key: "key-a"}
+	keyAB := APIKey{Name: "ab", Key: "key-ab"}
+	lm := &LearningMaterialAPI{
+		conf:               &Config{API: APIConfig{SignKey: "test-key", APIKeys: []APIKey{keyA, keyAB}}},
+		ClientRequestStore: NewClientRequestStore(),
+	}
+
+	newKeyLab := func(key APIKey, user string) *ClientRequest {
+		client := lm.ClientRequestStore.GetOrCreateClient(apiKeyIdentity(key, user), "127.0.0.1")
+		cr := client.NewClientRequest("ftp,sql")
+		cr.env = &environment{
+			timer:   time.NewTimer(environmentTimer),
+			expires: time.Now().Add(environmentTimer),
+		}
+		cr.isReady = true
+		return cr
+	}
+	labA := newKeyLab(keyA, "b/alice")
+	labAB := newKeyLab(keyAB, "bob")
+
+	do := func(method, path, token string) (int, labStatus) {
+		r := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		lm.handleLabs()(w, r)
+
+		var ls labStatus
+		json.NewDecoder(w.Body).Decode(&ls)
+		return w.Code, ls
+	}
+
+	for _, token := range []string{"", "wrong-key"} {
+		if code, _ := do(http.MethodGet, labsAPIPath+"/"+labA.ID(), token); code != http.StatusUnauthorized {
+			t.Errorf("expected %d with the token %q, got %d", http.StatusUnauthorized, token, code)
+		}
+	}
+
+	code, ls := do(http.MethodGet, labsAPIPath+"/"+labA.ID(), keyA.Key)
+	if code != http.StatusOK {
+		t.Fatalf("expected the status of the lab, got %d", code)
+	}
+	if ls.User != "b/alice" || ls.Status != labStatusReady {
+		t.Errorf("expected the ready lab of b/alice, got %+v", ls)
+	}
+
+	//A key never reaches the labs of the other keys
+	if code, _ := do(http.MethodGet, labsAPIPath+"/"+labAB.ID(), keyA.Key); code != http.StatusNotFound {
+		t.Errorf("expected the lab of another key to be hidden, got %d", code)
+	}
+	if code, _ := do(http.MethodDelete, labsAPIPath+"/"+labA.ID(), keyAB.Key); code != http.StatusNotFound {
+		t.Errorf("expected the lab of another key not to be terminated, got %d", code)
+	}
+	if n := lm.apiKeyRequests(keyA); n != 1 {
+		t.Errorf("expected 1 request for the key a, got %d", n)
+	}
+
+	if code, _ := do(http.MethodDelete, labsAPIPath+"/"+labAB.ID(), keyAB.Key); code != http.StatusNoContent {
+		t.Fatalf("expected the lab to be terminated, got %d", code)
+	}
+	select {
+	case <-labAB.env.GetTimer().C:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the lab to be closed through its timer")
+	}
+	select {
+	case <-labA.env.GetTimer().C:
+		t.Errorf("expected the lab of the other key to keep running")
+	default:
+	}
+}
@@ -0,0 +1,685 @@
+package app
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ltiVersion          = "1.3.0"
+	ltiStateTTL         = 5 * time.Minute
+	ltiDeepLinkTTL      = 30 * time.Minute
+	ltiKeySetFetchDelay = time.Minute
+
+	ltiMsgResourceLink    = "LtiResourceLinkRequest"
+	ltiMsgDeepLinking     = "LtiDeepLinkingRequest"
+	ltiMsgDeepLinkingResp = "LtiDeepLinkingResponse"
+
+	ltiClaimMessageType  = "https://purl.imsglobal.org/spec/lti/claim/message_type"
+	ltiClaimVersion      = "https://purl.imsglobal.org/spec/lti/claim/version"
+	ltiClaimDeploymentID = "https://purl.imsglobal.org/spec/lti/claim/deployment_id"
+	ltiClaimTargetLink   = "https://purl.imsglobal.org/spec/lti/claim/target_link_uri"
+	ltiClaimCustom       = "https://purl.imsglobal.org/spec/lti/claim/custom"
+	ltiClaimDLSettings   = "https://purl.imsglobal.org/spec/lti-dl/claim/deep_linking_settings"
+	ltiClaimDLItems      = "https://purl.imsglobal.org/spec/lti-dl/claim/content_items"
+	ltiClaimDLData       = "https://purl.imsglobal.org/spec/lti-dl/claim/data"
+
+	ltiLaunchPath = "/lti/launch"
+	ltiLabPath    = "/lti/lab/"
+
+	errorLTILogin    = "Unable to start the login with the learning platform"
+	errorLTILaunch   = "The launch from the learning platform is not valid"
+	errorLTILab      = "The lab has not been launched, please launch it again from your course"
+	errorLTIDeepLink = "The challenge selection is not valid anymore, please start it again from your course"
+)
+
+var (
+	ErrUnknownPlatform = errors.New("unknown LTI platform")
+	ErrUnknownKey      = errors.New("unknown platform key")
+	ErrInvalidLaunch   = errors.New("invalid LTI launch")
+)
+
+// ltiTool implements the tool side of LTI 1.3, platforms (eg. Moodle) launch labs through it
+type ltiTool struct {
+	conf LTIConfig
+	key  *rsa.PrivateKey
+
+	m         sync.Mutex
+	states    map[string]ltiState
+	deepLinks map[string]ltiDeepLink
+	keys      map[string]map[string]*rsa.PublicKey //issuer -> kid -> key
+	fetched   map[string]time.Time                 //issuer -> last key set fetch
+	fetching  map[string]*sync.Mutex               //issuer -> key set being fetched
+	http      *http.Client
+}
+
+// OIDC login started by a platform, waiting for the launch
+type ltiState struct {
+	platform LTIPlatform
+	nonce    string
+	expires  time.Time
+}
+
+// Deep linking request waiting for the instructor to select the challenges
+type ltiDeepLink struct {
+	platform     LTIPlatform
+	deploymentID string
+	returnURL    string
+	data         string
+	expires      time.Time
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+func newLTITool(conf LTIConfig) (*ltiTool, error) {
+	raw, err := ioutil.ReadFile(conf.PrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("[LTI] Error reading tool private key: %v", err)
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(raw)
+	if err != nil {
+		return nil, fmt.Errorf("[LTI] Error parsing tool private key: %v", err)
+	}
+
+	t := &ltiTool{
+		conf:      conf,
+		key:       key,
+		states:    map[string]ltiState{},
+		deepLinks: map[string]ltiDeepLink{},
+		keys:      map[string]map[string]*rsa.PublicKey{},
+		fetched:   map[string]time.Time{},
+		fetching:  map[string]*sync.Mutex{},
+		http:      &http.Client{Timeout: 20 * time.Second},
+	}
+
+	for _, p := range conf.Platforms {
+		if p.PublicKey == "" {
+			continue
+		}
+		pub, err := jwt.ParseRSAPublicKeyFromPEM([]byte(p.PublicKey))
+		if err != nil {
+			return nil, fmt.Errorf("[LTI] Error parsing public key of %s: %v", p.Issuer, err)
+		}
+		t.keys[p.Issuer] = map[string]*rsa.PublicKey{"": pub}
+	}
+
+	return t, nil
+}
+
+func (t *ltiTool) platform(issuer, clientID string) (LTIPlatform, error) {
+	for _, p := range t.conf.Platforms {
+		if p.Issuer == issuer && (clientID == "" || p.ClientID == clientID) {
+			return p, nil
+		}
+	}
+	return LTIPlatform{}, ErrUnknownPlatform
+}
+
+func (t *ltiTool) newState(p LTIPlatform) (string, string, error) {
+	state, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	now := time.Now()
+	for k, s := range t.states {
+		if now.After(s.expires) {
+			delete(t.states, k)
+		}
+	}
+	t.states[state] = ltiState{platform: p, nonce: nonce, expires: now.Add(ltiStateTTL)}
+
+	return state, nonce, nil
+}
+
+func (t *ltiTool) redeemState(state string) (ltiState, bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	s, ok := t.states[state]
+	if !ok {
+		return ltiState{}, false
+	}
+	delete(t.states, state)
+	return s, time.Now().Before(s.expires)
+}
+
+func (t *ltiTool) newDeepLink(dl ltiDeepLink) (string, error) {
+	id, err := randomString()
+	if err != nil {
+		return "", err
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	now := time.Now()
+	for k, d := range t.deepLinks {
+		if now.After(d.expires) {
+			delete(t.deepLinks, k)
+		}
+	}
+	dl.expires = now.Add(ltiDeepLinkTTL)
+	t.deepLinks[id] = dl
+
+	return id, nil
+}
+
+func (t *ltiTool) redeemDeepLink(id string) (ltiDeepLink, bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	dl, ok := t.deepLinks[id]
+	if !ok {
+		return ltiDeepLink{}, false
+	}
+	delete(t.deepLinks, id)
+	return dl, time.Now().Before(dl.expires)
+}
+
+// Get the platform key used to sign an id_token, the platform key set is fetched
+// again when the key is not known (eg. the platform rotated its keys). The key set is
+// fetched outside of the lock of the tool, a slow platform only delays its own launches
+func (t *ltiTool) platformKey(p LTIPlatform, kid string) (*rsa.PublicKey, error) {
+	if key, fetch, err := t.cachedKey(p, kid); !fetch {
+		return key, err
+	}
+
+	fl := t.fetchLock(p.Issuer)
+	fl.Lock()
+	defer fl.Unlock()
+
+	//The key set may have been fetched by another launch in the meantime
+	if key, fetch, err := t.cachedKey(p, kid); !fetch {
+		return key, err
+	}
+
+	t.m.Lock()
+	t.fetched[p.Issuer] = time.Now()
+	t.m.Unlock()
+
+	keys, err := t.fetchKeySet(p.KeySetURL)
+	if err != nil {
+		return nil, err
+	}
+
+	t.m.Lock()
+	t.keys[p.Issuer] = keys
+	t.m.Unlock()
+
+	key, ok := keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// Get a platform key already known, fetch is true when the key set of the platform has
+// to be fetched again to find it
+func (t *ltiTool) cachedKey(p LTIPlatform, kid string) (*rsa.PublicKey, bool, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if key, ok := t.keys[p.Issuer][kid]; ok {
+		return key, false, nil
+	}
+	if key, ok := t.keys[p.Issuer][""]; ok && p.KeySetURL == "" {
+		return key, false, nil
+	}
+	if p.KeySetURL == "" || time.Since(t.fetched[p.Issuer]) < ltiKeySetFetchDelay {
+		return nil, false, ErrUnknownKey
+	}
+	return nil, true, nil
+}
+
+// Lock serializing the key set fetches of a platform
+func (t *ltiTool) fetchLock(issuer string) *sync.Mutex {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	fl, ok := t.fetching[issuer]
+	if !ok {
+		fl = &sync.Mutex{}
+		t.fetching[issuer] = fl
+	}
+	return fl
+}
+
+func (t *ltiTool) fetchKeySet(keySetURL string) (map[string]*rsa.PublicKey, error) {
+	resp, err := t.http.Get(keySetURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("[LTI] Error fetching key set: %s", resp.Status)
+	}
+
+	var ks jsonWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&ks); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range ks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// Validate the id_token sent by the platform with the launch
+func (t *ltiTool) validateIDToken(rawToken string, s ltiState) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(rawToken, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return t.platformKey(s.platform, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, ErrInvalidTokenFormat
+	}
+
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, fmt.Errorf("%v: missing expiration", ErrInvalidLaunch)
+	}
+	if !claims.VerifyIssuer(s.platform.Issuer, true) {
+		return nil, fmt.Errorf("%v: wrong issuer", ErrInvalidLaunch)
+	}
+	if !audienceContains(claims["aud"], s.platform.ClientID) {
+		return nil, fmt.Errorf("%v: wrong audience", ErrInvalidLaunch)
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != s.nonce {
+		return nil, fmt.Errorf("%v: wrong nonce", ErrInvalidLaunch)
+	}
+	if v, _ := claims[ltiClaimVersion].(string); v != ltiVersion {
+		return nil, fmt.Errorf("%v: unsupported version %q", ErrInvalidLaunch, v)
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, fmt.Errorf("%v: missing subject", ErrInvalidLaunch)
+	}
+
+	deploymentID, _ := claims[ltiClaimDeploymentID].(string)
+	if len(s.platform.DeploymentIDs) > 0 && !containsString(s.platform.DeploymentIDs, deploymentID) {
+		return nil, fmt.Errorf("%v: unknown deployment %q", ErrInvalidLaunch, deploymentID)
+	}
+
+	return claims, nil
+}
+
+// Sign the deep linking response sent back to the platform with the selected challenges
+func (t *ltiTool) deepLinkingResponse(dl ltiDeepLink, title, chals, launchURL string) (string, error) {
+	nonce, err := randomString()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":                dl.platform.ClientID,
+		"aud":                dl.platform.Issuer,
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"nonce":              nonce,
+		ltiClaimMessageType:  ltiMsgDeepLinkingResp,
+		ltiClaimVersion:      ltiVersion,
+		ltiClaimDeploymentID: dl.deploymentID,
+		ltiClaimDLItems: []map[string]interface{}{{
+			"type":   "ltiResourceLink",
+			"title":  title,
+			"url":    launchURL,
+			"custom": map[string]string{requestedChallenges: chals},
+		}},
+	}
+	if dl.data != "" {
+		claims[ltiClaimDLData] = dl.data
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = t.conf.KeyID
+	return token.SignedString(t.key)
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientID
+	case []interface{}:
+		for _, v := range a {
+			if s, ok := v.(string); ok && s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Challenges requested by a resource link launch, taken from the custom parameters
+// or from the target link
+func ltiLaunchChallenges(claims jwt.MapClaims) string {
+	if custom, ok := claims[ltiClaimCustom].(map[string]interface{}); ok {
+		if chals, ok := custom[requestedChallenges].(string); ok && chals != "" {
+			return chals
+		}
+	}
+	if target, ok := claims[ltiClaimTargetLink].(string); ok {
+		if u, err := url.Parse(target); err == nil {
+			return u.Query().Get(requestedChallenges)
+		}
+	}
+	return ""
+}
+
+// Identity used for the clients launched through LTI
+func ltiIdentity(claims jwt.MapClaims) string {
+	iss, _ := claims["iss"].(string)
+	sub, _ := claims["sub"].(string)
+	return fmt.Sprintf("lti:%s/%s", iss, sub)
+}
+
+// OIDC login initiation, the platform sends the user here before the launch,
+// the user is redirected back to the platform authorization endpoint
+func (lm *LearningMaterialAPI) handleLTILogin() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			errorPage(w, r, http.StatusBadRequest, returnError{Content: errorLTILogin})
+			return
+		}
+
+		p, err := lm.lti.platform(r.Form.Get("iss"), r.Form.Get("client_id"))
+		if err != nil {
+			log.Warn().Str("iss", r.Form.Get("iss")).Msg("[LTI] Login from unknown platform")
+			errorPage(w, r, http.StatusBadRequest, returnError{Content: errorLTILogin})
+			return
+		}
+
+		state, nonce, err := lm.lti.newState(p)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, returnError{Content: errorLTILogin})
+			return
+		}
+
+		q := url.Values{
+			"scope":         {"openid"},
+			"response_type": {"id_token"},
+			"response_mode": {"form_post"},
+			"prompt":        {"none"},
+			"client_id":     {p.ClientID},
+			"redirect_uri":  {lm.publicURL(ltiLaunchPath)},
+			"login_hint":    {r.Form.Get("login_hint")},
+			"state":         {state},
+			"nonce":         {nonce},
+		}
+		if hint := r.Form.Get("lti_message_hint"); hint != "" {
+			q.Set("lti_message_hint", hint)
+		}
+
+		http.Redirect(w, r, p.AuthEndpoint+"?"+q.Encode(), http.StatusFound)
+	}
+}
+
+// Launch sent by the platform, it either creates (or resumes) the lab of the user,
+// or lets the instructor pick the challenges for a new resource link (deep linking)
+func (lm *LearningMaterialAPI) handleLTILaunch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			errorPage(w, r, http.StatusMethodNotAllowed, returnError{Content: errorLTILaunch})
+			return
+		}
+
+		s, ok := lm.lti.redeemState(r.FormValue("state"))
+		if !ok {
+			errorPage(w, r, http.StatusUnauthorized, returnError{Content: errorLTILaunch})
+			return
+		}
+
+		claims, err := lm.lti.validateIDToken(r.FormValue("id_token"), s)
+		if err != nil {
+			log.Warn().Str("iss", s.platform.Issuer).Msgf("[LTI] Invalid launch: %v", err)
+			errorPage(w, r, http.StatusUnauthorized, returnError{Content: errorLTILaunch})
+			return
+		}
+
+		switch claims[ltiClaimMessageType] {
+		case ltiMsgResourceLink:
+			lm.ltiResourceLaunch(w, r, claims)
+		case ltiMsgDeepLinking:
+			lm.ltiDeepLinkingLaunch(w, r, s.platform, claims)
+		default:
+			errorPage(w, r, http.StatusBadRequest, returnError{Content: errorLTILaunch})
+		}
+	}
+}
+
+func (lm *LearningMaterialAPI) ltiResourceLaunch(w http.ResponseWriter, r *http.Request, claims jwt.MapClaims) {
+	chals := ltiLaunchChallenges(claims)
+	if _, _, err := lm.GetChallengesFromRequest(chals); chals == "" || err != nil {
+		errorPage(w, r, http.StatusBadRequest, returnError{Content: errorChallengesTag})
+		return
+	}
+
+	client := lm.ClientRequestStore.GetOrCreateClient(ltiIdentity(claims), r.Host)
+
+	//Resume the lab if the user already launched it
+	if _, err := client.GetClientRequest(chals); err != nil {
+		if lm.reachedMaxRequests() {
+			errorPage(w, r, http.StatusServiceUnavailable, returnError{
+				Content:         errorAPIRequests,
+				Toomanyrequests: true,
+			})
+			return
+		}
+		if client.RequestMade() >= lm.conf.API.ClientMaxRequest {
+			errorPage(w, r, http.StatusTooManyRequests, returnError{
+				Content:         errorClientRequests,
+				Toomanyrequests: true,
+			})
+			return
+		}
+		lm.CreateEnvironment(client, chals)
+	}
+
+	token, err := client.CreateToken(lm.conf.API.SignKey)
+	if err != nil {
+		log.Error().Msgf("Error creating session token: %v", err)
+		errorPage(w, r, http.StatusInternalServerError, returnError{Content: errorCreateToken})
+		return
+	}
+	//The lab is framed by the platform, the cookie has to be sent from its pages
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: token, Path: "/", SameSite: http.SameSiteNoneMode, Secure: true, HttpOnly: true})
+
+	host := fmt.Sprintf("%s?%s=%s", ltiLabPath, requestedChallenges, url.QueryEscape(chals))
+	http.Redirect(w, r, host, http.StatusFound)
+}
+
+func (lm *LearningMaterialAPI) ltiDeepLinkingLaunch(w http.ResponseWriter, r *http.Request, p LTIPlatform, claims jwt.MapClaims) {
+	settings, _ := claims[ltiClaimDLSettings].(map[string]interface{})
+	returnURL, _ := settings["deep_link_return_url"].(string)
+	if returnURL == "" {
+		errorPage(w, r, http.StatusBadRequest, returnError{Content: errorLTILaunch})
+		return
+	}
+	data, _ := settings["data"].(string)
+	deploymentID, _ := claims[ltiClaimDeploymentID].(string)
+
+	id, err := lm.lti.newDeepLink(ltiDeepLink{
+		platform:     p,
+		deploymentID: deploymentID,
+		returnURL:    returnURL,
+		data:         data,
+	})
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, returnError{Content: errorLTILaunch})
+		return
+	}
+
+	categories, err := lm.getChallengeCatalog()
+	if err != nil {
+		log.Error().Msgf("[LTI] Error getting the challenges catalog: %v", err)
+		errorPage(w, r, http.StatusInternalServerError, returnError{Content: errorLTILaunch})
+		return
+	}
+
+	tmpl, err := template.ParseFiles(
+		"resources/private/base.tmpl.html",
+		"resources/private/deeplink.tmpl.html",
+	)
+	if err != nil {
+		log.Error().Msgf("error deeplink tmpl: %s", err.Error())
+		errorPage(w, r, http.StatusInternalServerError, returnError{Content: errorLTILaunch})
+		return
+	}
+
+	content := struct {
+		Session    string
+		Categories []Category
+	}{
+		Session:    id,
+		Categories: categories,
+	}
+	if err := tmpl.Execute(w, content); err != nil {
+		log.Error().Msgf("template err deeplink: %s", err.Error())
+	}
+}
+
+// Selection made by the instructor on the deep linking page, the resource link is sent
+// back to the platform
+func (lm *LearningMaterialAPI) handleLTIDeepLink() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			errorPage(w, r, http.StatusMethodNotAllowed, returnError{Content: errorLTIDeepLink})
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			errorPage(w, r, http.StatusBadRequest, returnError{Content: errorLTIDeepLink})
+			return
+		}
+
+		dl, ok := lm.lti.redeemDeepLink(r.Form.Get("session"))
+		if !ok {
+			errorPage(w, r, http.StatusBadRequest, returnError{Content: errorLTIDeepLink})
+			return
+		}
+
+		chals := strings.Join(r.Form[requestedChallenges], ",")
+		if _, _, err := lm.GetChallengesFromRequest(chals); chals == "" || err != nil {
+			errorPage(w, r, http.StatusBadRequest, returnError{Content: errorChallengesTag})
+			return
+		}
+
+		title := r.Form.Get("title")
+		if title == "" {
+			title = "Haaukins Lab"
+		}
+
+		jwtResponse, err := lm.lti.deepLinkingResponse(dl, title, chals, lm.publicURL(ltiLaunchPath))
+		if err != nil {
+			log.Error().Msgf("[LTI] Error signing deep linking response: %v", err)
+			errorPage(w, r, http.StatusInternalServerError, returnError{Content: errorLTIDeepLink})
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(getAutoPostPage(dl.returnURL, "JWT", jwtResponse)))
+	}
+}
+
+// Page of the lab launched through LTI, the lab must have been launched by the platform
+func (lm *LearningMaterialAPI) handleLTILab(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(sessionCookie)
+		if err != nil {
+			errorPage(w, r, http.StatusUnauthorized, returnError{Content: errorLTILab})
+			return
+		}
+		clientID, err := GetTokenFromCookie(cookie.Value, lm.conf.API.SignKey)
+		if err != nil {
+			errorPage(w, r, http.StatusUnauthorized, returnError{Content: errorLTILab})
+			return
+		}
+		client, err := lm.ClientRequestStore.GetClient(clientID)
+		if err != nil {
+			errorPage(w, r, http.StatusUnauthorized, returnError{Content: errorLTILab})
+			return
+		}
+		if _, err := client.GetClientRequest(r.URL.Query().Get(requestedChallenges)); err != nil {
+			errorPage(w, r, http.StatusNotFound, returnError{Content: errorLTILab})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// Public key set of the tool, used by platforms to verify the deep linking responses
+func (lm *LearningMaterialAPI) handleLTIKeySet() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pub := lm.lti.key.PublicKey
+		writeJSON(w, http.StatusOK, jsonWebKeySet{Keys: []jsonWebKey{{
+			Kty: "RSA",
+			Kid: lm.lti.conf.KeyID,
+			Use: "sig",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}}})
+	}
+}
@@ -0,0 +1,430 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	proto "github.com/aau-network-security/haaukins/exercise/ex-proto"
+	"github.com/dgrijalva/jwt-go"
+	"google.golang.org/grpc"
+)
+
+const (
+	testIssuer   = "https://lms.example.org"
+	testClientID = "haaukins-tool"
+	testDeploy   = "deployment-1"
+)
+
+type fakeExerciseStore struct {
+	proto.ExerciseStoreClient
+	tags []string
+}
+
+func (f fakeExerciseStore) GetExerciseByTags(ctx context.Context, in *proto.GetExerciseByTagsRequest, opts ...grpc.CallOption) (*proto.GetExercisesResponse, error) {
+	var exercises []*proto.Exercise
+	for _, t := range in.Tag {
+		if !containsString(f.tags, t) {
+			return nil, errors.New("unknown tag")
+		}
+		exercises = append(exercises, &proto.Exercise{Tag: t, Name: t})
+	}
+	return &proto.GetExercisesResponse{Exercises: exercises}, nil
+}
+
+// fakePlatform is a learning platform signing launches with its own key
+type fakePlatform struct {
+	key *rsa.PrivateKey
+	srv *httptest.Server
+}
+
+func newFakePlatform(t *testing.T) *fakePlatform {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating platform key: %s", err.Error())
+	}
+	p := &fakePlatform{key: key}
+
+	m := http.NewServeMux()
+	m.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, jsonWebKeySet{Keys: []jsonWebKey{{
+			Kty: "RSA",
+			Kid: "platform-key",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	p.srv = httptest.NewServer(m)
+	return p
+}
+
+func (p *fakePlatform) idToken(t *testing.T, key *rsa.PrivateKey, nonce string, extra jwt.MapClaims) string {
+	claims := jwt.MapClaims{
+		"iss":                testIssuer,
+		"aud":                []string{testClientID},
+		"sub":                "student-1",
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(time.Minute).Unix(),
+		"nonce":              nonce,
+		ltiClaimVersion:      ltiVersion,
+		ltiClaimDeploymentID: testDeploy,
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "platform-key"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Error signing id_token: %s", err.Error())
+	}
+	return signed
+}
+
+func newTestLTIAPI(t *testing.T, p *fakePlatform) (*LearningMaterialAPI, func()) {
+	toolKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating tool key: %s", err.Error())
+	}
+	dir, err := ioutil.TempDir("", "lti")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err.Error())
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	keyFile := filepath.Join(dir, "tool.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(toolKey)})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("Error writing tool key: %s", err.Error())
+	}
+
+	conf := &Config{Host: "localhost"}
+	conf.Port.InSecure = 80
+	conf.API.SignKey = "whatever"
+	conf.API.TotalMaxRequest = 10
+	conf.API.ClientMaxRequest = 0
+	conf.LTI = LTIConfig{
+		Enabled:        true,
+		PrivateKeyFile: keyFile,
+		KeyID:          "tool-key",
+		Platforms: []LTIPlatform{{
+			Issuer:        testIssuer,
+			ClientID:      testClientID,
+			AuthEndpoint:  p.srv.URL + "/auth",
+			KeySetURL:     p.srv.URL + "/jwks",
+			DeploymentIDs: []string{testDeploy},
+		}},
+	}
+
+	tool, err := newLTITool(conf.LTI)
+	if err != nil {
+		t.Fatalf("Error creating LTI tool: %s", err.Error())
+	}
+
+	return &LearningMaterialAPI{
+		conf:               conf,
+		ClientRequestStore: NewClientRequestStore(),
+		exClient:           fakeExerciseStore{tags: []string{"xxxx", "yyyy"}},
+		tickets:            newTicketStore(),
+		lti:                tool,
+	}, cleanup
+}
+
+var noRedirect = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Start the OIDC login and return state and nonce sent to the platform
+func ltiLogin(t *testing.T, ts *httptest.Server) (string, string) {
+	q := url.Values{
+		"iss":              {testIssuer},
+		"login_hint":       {"student-1"},
+		"target_link_uri":  {ts.URL + ltiLaunchPath},
+		"lti_message_hint": {"hint"},
+	}
+	resp, err := noRedirect.Get(ts.URL + "/lti/login?" + q.Encode())
+	if err != nil {
+		t.Fatalf("Error getting response: %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Status code Error. Expected [%d], got [%d]", http.StatusFound, resp.StatusCode)
+	}
+
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("Error parsing redirect: %s", err.Error())
+	}
+	for k, v := range map[string]string{"response_type": "id_token", "scope": "openid", "client_id": testClientID, "lti_message_hint": "hint"} {
+		if loc.Query().Get(k) != v {
+			t.Fatalf("Wrong %s sent to the platform: %q", k, loc.Query().Get(k))
+		}
+	}
+	return loc.Query().Get("state"), loc.Query().Get("nonce")
+}
+
+func ltiLaunch(t *testing.T, ts *httptest.Server, state, idToken string) *http.Response {
+	resp, err := noRedirect.PostForm(ts.URL+ltiLaunchPath, url.Values{"state": {state}, "id_token": {idToken}})
+	if err != nil {
+		t.Fatalf("Error getting response: %s", err.Error())
+	}
+	return resp
+}
+
+func TestLTIResourceLaunch(t *testing.T) {
+	p := newFakePlatform(t)
+	defer p.srv.Close()
+	lm, cleanup := newTestLTIAPI(t, p)
+	defer cleanup()
+	ts := httptest.NewServer(lm.Handler())
+	defer ts.Close()
+
+	resourceLink := jwt.MapClaims{
+		ltiClaimMessageType: ltiMsgResourceLink,
+		ltiClaimCustom:      map[string]string{requestedChallenges: "xxxx"},
+	}
+
+	//The student already launched the lab, the launch resumes it
+	client := lm.GetOrCreateClient("lti:"+testIssuer+"/student-1", "localhost")
+	client.NewClientRequest("xxxx")
+
+	state, nonce := ltiLogin(t, ts)
+	resp := ltiLaunch(t, ts, state, p.idToken(t, p.key, nonce, resourceLink))
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Status code Error. Expected [%d], got [%d]", http.StatusFound, resp.StatusCode)
+	}
+	if loc := resp.Header.Get("Location"); loc != ltiLabPath+"?challenges=xxxx" {
+		t.Fatalf("Wrong lab location: %s", loc)
+	}
+
+	var session *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookie {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatal("Session cookie not set by the launch")
+	}
+	if session.SameSite != http.SameSiteNoneMode || !session.Secure || !session.HttpOnly {
+		t.Errorf("Session cookie can't be sent from the frame of the platform: %s", session.Raw)
+	}
+	if id, err := GetTokenFromCookie(session.Value, lm.conf.API.SignKey); err != nil || id != client.ID() {
+		t.Fatalf("Session cookie doesn't belong to the launched client")
+	}
+
+	//The lab is still being created
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+ltiLabPath+"?challenges=xxxx", nil)
+	req.AddCookie(session)
+	labResp, err := noRedirect.Do(req)
+	if err != nil {
+		t.Fatalf("Error getting response: %s", err.Error())
+	}
+	if labResp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Status code Error. Expected [%d], got [%d]", http.StatusServiceUnavailable, labResp.StatusCode)
+	}
+
+	//A new lab can't be created, the client reached the max number of requests
+	state, nonce = ltiLogin(t, ts)
+	resourceLink[ltiClaimCustom] = map[string]string{requestedChallenges: "yyyy"}
+	resp = ltiLaunch(t, ts, state, p.idToken(t, p.key, nonce, resourceLink))
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Status code Error. Expected [%d], got [%d]", http.StatusTooManyRequests, resp.StatusCode)
+	}
+}
+
+func TestLTIInvalidLaunch(t *testing.T) {
+	p := newFakePlatform(t)
+	defer p.srv.Close()
+	lm, cleanup := newTestLTIAPI(t, p)
+	defer cleanup()
+	ts := httptest.NewServer(lm.Handler())
+	defer ts.Close()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err.Error())
+	}
+	resourceLink := jwt.MapClaims{
+		ltiClaimMessageType: ltiMsgResourceLink,
+		ltiClaimCustom:      map[string]string{requestedChallenges: "xxxx"},
+	}
+
+	tt := []struct {
+		name  string
+		token func(nonce string) string
+	}{
+		{name: "Wrong Signature", token: func(nonce string) string { return p.idToken(t, otherKey, nonce, resourceLink) }},
+		{name: "Wrong Nonce", token: func(nonce string) string { return p.idToken(t, p.key, "whatever", resourceLink) }},
+		{name: "Wrong Audience", token: func(nonce string) string {
+			return p.idToken(t, p.key, nonce, jwt.MapClaims{"aud": "whatever", ltiClaimMessageType: ltiMsgResourceLink})
+		}},
+		{name: "Wrong Deployment", token: func(nonce string) string {
+			return p.idToken(t, p.key, nonce, jwt.MapClaims{ltiClaimDeploymentID: "whatever", ltiClaimMessageType: ltiMsgResourceLink})
+		}},
+		{name: "Expired", token: func(nonce string) string {
+			return p.idToken(t, p.key, nonce, jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix(), ltiClaimMessageType: ltiMsgResourceLink})
+		}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			state, nonce := ltiLogin(t, ts)
+			resp := ltiLaunch(t, ts, state, tc.token(nonce))
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("Status code Error. Expected [%d], got [%d]", http.StatusUnauthorized, resp.StatusCode)
+			}
+		})
+	}
+
+	//A state can be used only once
+	state, nonce := ltiLogin(t, ts)
+	client := lm.GetOrCreateClient("lti:"+testIssuer+"/student-1", "localhost")
+	client.NewClientRequest("xxxx")
+	if resp := ltiLaunch(t, ts, state, p.idToken(t, p.key, nonce, resourceLink)); resp.StatusCode != http.StatusFound {
+		t.Fatalf("Status code Error. Expected [%d], got [%d]", http.StatusFound, resp.StatusCode)
+	}
+	if resp := ltiLaunch(t, ts, state, p.idToken(t, p.key, nonce, resourceLink)); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Status code Error. Expected [%d], got [%d]", http.StatusUnauthorized, resp.StatusCode)
+	}
+}
+
+func TestLTIDeepLinkingResponse(t *testing.T) {
+	p := newFakePlatform(t)
+	defer p.srv.Close()
+	lm, cleanup := newTestLTIAPI(t, p)
+	defer cleanup()
+	ts := httptest.NewServer(lm.Handler())
+	defer ts.Close()
+
+	platform, _ := lm.lti.platform(testIssuer, testClientID)
+	session, err := lm.lti.newDeepLink(ltiDeepLink{
+		platform:     platform,
+		deploymentID: testDeploy,
+		returnURL:    p.srv.URL + "/deeplink/return",
+		data:         "opaque",
+	})
+	if err != nil {
+		t.Fatalf("Error creating deep link session: %s", err.Error())
+	}
+
+	resp, err := noRedirect.PostForm(ts.URL+"/lti/deeplink/", url.Values{
+		"session":           {session},
+		"title":             {"Week 1"},
+		requestedChallenges: {"xxxx", "yyyy"},
+	})
+	if err != nil {
+		t.Fatalf("Error getting response: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Status code Error. Expected [%d], got [%d]", http.StatusOK, resp.StatusCode)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(body), p.srv.URL+"/deeplink/return") {
+		t.Fatal("Deep linking response is not posted to the platform")
+	}
+	match := regexp.MustCompile(`name="JWT" value="([^"]+)"`).FindStringSubmatch(string(body))
+	if match == nil {
+		t.Fatal("Deep linking response doesn't contain the JWT")
+	}
+
+	//The platform verifies the response with the tool key set
+	keys, err := lm.lti.fetchKeySet(ts.URL + "/lti/jwks")
+	if err != nil {
+		t.Fatalf("Error fetching tool key set: %s", err.Error())
+	}
+	token, err := jwt.Parse(match[1], func(token *jwt.Token) (interface{}, error) {
+		return keys[token.Header["kid"].(string)], nil
+	})
+	if err != nil {
+		t.Fatalf("Error verifying deep linking response: %s", err.Error())
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if claims[ltiClaimMessageType] != ltiMsgDeepLinkingResp || claims[ltiClaimDLData] != "opaque" || claims["aud"] != testIssuer {
+		t.Fatalf("Wrong deep linking response claims: %v", claims)
+	}
+	items := claims[ltiClaimDLItems].([]interface{})
+	custom := items[0].(map[string]interface{})["custom"].(map[string]interface{})
+	if custom[requestedChallenges] != "xxxx,yyyy" {
+		t.Fatalf("Wrong challenges in the resource link: %v", custom[requestedChallenges])
+	}
+
+	//The selection can be sent only once
+	resp, err = noRedirect.PostForm(ts.URL+"/lti/deeplink/", url.Values{"session": {session}, requestedChallenges: {"xxxx"}})
+	if err != nil {
+		t.Fatalf("Error getting response: %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Status code Error. Expected [%d], got [%d]", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestLTISlowKeySet(t *testing.T) {
+	p := newFakePlatform(t)
+	defer p.srv.Close()
+	lm, cleanup := newTestLTIAPI(t, p)
+	defer cleanup()
+
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		writeJSON(w, http.StatusOK, jsonWebKeySet{})
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	fetched := make(chan error, 1)
+	go func() {
+		_, err := lm.lti.platformKey(LTIPlatform{Issuer: "https://slow.example.org", KeySetURL: slow.URL}, "kid")
+		fetched <- err
+	}()
+
+	//The other platforms are launched while the key set of the slow one is being fetched
+	keys := make(chan error, 1)
+	go func() {
+		if _, _, err := lm.lti.newState(lm.conf.LTI.Platforms[0]); err != nil {
+			keys <- err
+			return
+		}
+		_, err := lm.lti.platformKey(lm.conf.LTI.Platforms[0], "platform-key")
+		keys <- err
+	}()
+	select {
+	case err := <-keys:
+		if err != nil {
+			t.Fatalf("unexpected error getting the platform key: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the other platforms not to wait for the slow key set")
+	}
+
+	select {
+	case <-fetched:
+		t.Fatalf("expected the slow key set to be still fetched")
+	default:
+	}
+	release <- struct{}{}
+	if err := <-fetched; err != ErrUnknownKey {
+		t.Fatalf("expected %v, got %v", ErrUnknownKey, err)
+	}
+}
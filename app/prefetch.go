@@ -0,0 +1,419 @@
+package app
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	proto "github.com/aau-network-security/haaukins/exercise/ex-proto"
+	"github.com/aau-network-security/haaukins/store"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	prefetchAdminPath = "/admin/prefetch/"
+	prefetchInterval  = 5 * time.Minute
+	prefetchParallel  = 2
+	prefetchTimeout   = 30 * time.Minute
+
+	imagePending = "pending"
+	imagePulling = "pulling"
+	imageReady   = "ready"
+	imageFailed  = "failed"
+
+	ovaReady   = "ready"
+	ovaMissing = "missing"
+	ovaInvalid = "invalid"
+)
+
+// imageStatus is the readiness of a container image used by the exercises
+type imageStatus struct {
+	Image     string     `json:"image"`
+	State     string     `json:"state"`
+	Error     string     `json:"error,omitempty"`
+	Ready     *time.Time `json:"ready,omitempty"`
+	Exercises []string   `json:"exercises"`
+}
+
+// ovaStatus is the result of the verification of a frontend OVA
+type ovaStatus struct {
+	Image  string `json:"image"`
+	Path   string `json:"path"`
+	State  string `json:"state"`
+	Error  string `json:"error,omitempty"`
+	SizeMB int64  `json:"size_mb"`
+}
+
+// imageHost is the docker daemon the images are pulled on
+type imageHost interface {
+	HasImage(image string) bool
+	PullImage(ctx context.Context, image string) error
+}
+
+// prefetcher pulls the images of the exercises and verifies the frontend OVAs ahead of the labs,
+// so the first user of a challenge doesn't wait for them. It runs at startup and again on every
+// interval or refresh, pulling the images added to the catalog and the ones which failed
+type prefetcher struct {
+	m         sync.Mutex
+	images    map[string]*imageStatus
+	exercises map[string][]string //exercise tag -> images
+	ovas      []ovaStatus
+
+	host      imageHost
+	catalog   func() ([]store.Exercise, error)
+	ovaDir    string
+	frontends []string //OVA images of the frontends
+	interval  time.Duration
+	parallel  int
+	refresh   chan struct{}
+	stop      chan struct{}
+	once      sync.Once
+}
+
+func newPrefetcher(conf PrefetchConfig, host imageHost, catalog func() ([]store.Exercise, error), ovaDir string, frontends []string) *prefetcher {
+	p := &prefetcher{
+		images:    map[string]*imageStatus{},
+		exercises: map[string][]string{},
+		host:      host,
+		catalog:   catalog,
+		ovaDir:    ovaDir,
+		frontends: frontends,
+		interval:  conf.Interval,
+		parallel:  conf.Parallel,
+		refresh:   make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+	}
+	if p.interval == 0 {
+		p.interval = prefetchInterval
+	}
+	if p.parallel <= 0 {
+		p.parallel = prefetchParallel
+	}
+	return p
+}
+
+// Refresh asks for the catalog to be prefetched again, eg. when it changed
+func (p *prefetcher) Refresh() {
+	if p == nil {
+		return
+	}
+	select {
+	case p.refresh <- struct{}{}:
+	default:
+	}
+}
+
+func (p *prefetcher) loop() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.run()
+		select {
+		case <-ticker.C:
+		case <-p.refresh:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *prefetcher) Close() error {
+	p.once.Do(func() { close(p.stop) })
+	return nil
+}
+
+// Prefetch the images of the catalog not ready yet and verify the OVAs
+func (p *prefetcher) run() {
+	ovas := verifyOVAs(p.ovaDir, p.frontends)
+	for _, o := range ovas {
+		if o.State != ovaReady {
+			log.Warn().Str("ova", o.Path).Str("state", o.State).Msg(o.Error)
+		}
+	}
+
+	exers, err := p.catalog()
+	if err != nil {
+		log.Error().Msgf("Error getting the exercises to prefetch: %v", err)
+		p.m.Lock()
+		p.ovas = ovas
+		p.m.Unlock()
+		return
+	}
+
+	exercises := map[string][]string{}
+	users := map[string][]string{} //image -> exercise tags
+	for _, e := range exers {
+		tag := string(e.Tag)
+		for _, i := range e.Instance {
+			if i.Image == "" {
+				continue
+			}
+			exercises[tag] = append(exercises[tag], i.Image)
+			users[i.Image] = append(users[i.Image], tag)
+		}
+	}
+
+	var pull []string
+	p.m.Lock()
+	p.ovas = ovas
+	p.exercises = exercises
+	for image, s := range p.images {
+		if _, ok := users[image]; !ok {
+			delete(p.images, image)
+		}
+		s.Exercises = users[image]
+	}
+	for image, tags := range users {
+		s, ok := p.images[image]
+		if !ok {
+			s = &imageStatus{Image: image, State: imagePending, Exercises: tags}
+			p.images[image] = s
+		}
+		if s.State == imagePending || s.State == imageFailed {
+			pull = append(pull, image)
+		}
+	}
+	p.m.Unlock()
+
+	sort.Strings(pull)
+	sem := make(chan struct{}, p.parallel)
+	var wg sync.WaitGroup
+	for _, image := range pull {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(image string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			p.pull(image)
+		}(image)
+	}
+	wg.Wait()
+}
+
+func (p *prefetcher) setImage(image, state string, err error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	s, ok := p.images[image]
+	if !ok {
+		return
+	}
+	s.State = state
+	s.Error = ""
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if state == imageReady {
+		now := time.Now()
+		s.Ready = &now
+	}
+}
+
+func (p *prefetcher) pull(image string) {
+	if p.host.HasImage(image) {
+		p.setImage(image, imageReady, nil)
+		return
+	}
+
+	p.setImage(image, imagePulling, nil)
+	log.Info().Str("image", image).Msg("Pulling image")
+
+	ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout)
+	defer cancel()
+	if err := p.host.PullImage(ctx, image); err != nil {
+		log.Error().Str("image", image).Msgf("Error pulling image: %v", err)
+		p.setImage(image, imageFailed, err)
+		return
+	}
+	p.setImage(image, imageReady, nil)
+}
+
+// ExerciseReady tells whether all the images of an exercise are pulled. Unknown exercises are
+// considered ready, the prefetcher may not have seen them yet
+func (p *prefetcher) ExerciseReady(tag string) bool {
+	if p == nil {
+		return true
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	images, ok := p.exercises[tag]
+	if !ok {
+		return true
+	}
+	for _, image := range images {
+		if s, ok := p.images[image]; !ok || s.State != imageReady {
+			return false
+		}
+	}
+	return true
+}
+
+// prefetchReport is the readiness of the images and OVAs
+type prefetchReport struct {
+	Ready  bool          `json:"ready"`
+	Images []imageStatus `json:"images"`
+	OVAs   []ovaStatus   `json:"ovas"`
+}
+
+func (p *prefetcher) Report() prefetchReport {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	r := prefetchReport{Ready: true, Images: []imageStatus{}, OVAs: append([]ovaStatus{}, p.ovas...)}
+	for _, s := range p.images {
+		r.Images = append(r.Images, *s)
+		r.Ready = r.Ready && s.State == imageReady
+	}
+	for _, o := range p.ovas {
+		r.Ready = r.Ready && o.State == ovaReady
+	}
+	sort.Slice(r.Images, func(i, j int) bool { return r.Images[i].Image < r.Images[j].Image })
+	return r
+}
+
+// Path of the OVA of a frontend image in the OVA directory
+func ovaPath(dir, image string) string {
+	path := filepath.Join(dir, image)
+	if !strings.HasSuffix(path, ".ova") {
+		path += ".ova"
+	}
+	return path
+}
+
+// Verify the OVAs of the frontends: an OVA is a tar archive holding the OVF descriptor
+func verifyOVAs(dir string, images []string) []ovaStatus {
+	seen := map[string]bool{}
+	statuses := []ovaStatus{}
+	for _, image := range images {
+		if image == "" || seen[image] {
+			continue
+		}
+		seen[image] = true
+		statuses = append(statuses, verifyOVA(image, ovaPath(dir, image)))
+	}
+	return statuses
+}
+
+func verifyOVA(image, path string) ovaStatus {
+	s := ovaStatus{Image: image, Path: path, State: ovaInvalid}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		s.State = ovaMissing
+		s.Error = "the OVA of the frontend is missing"
+		return s
+	}
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err == nil {
+		s.SizeMB = fi.Size() >> 20
+	}
+
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			s.Error = "the OVA has no OVF descriptor"
+			return s
+		}
+		if err != nil {
+			s.Error = "the OVA is not a valid archive: " + err.Error()
+			return s
+		}
+		if strings.HasSuffix(strings.ToLower(h.Name), ".ovf") {
+			s.State = ovaReady
+			return s
+		}
+	}
+}
+
+// Handle the requests made to `/admin/prefetch/`: `GET` reports the readiness of the images and
+// the OVAs, `POST` prefetches the catalog again
+func (lm *LearningMaterialAPI) handlePrefetch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, lm.prefetch.Report())
+		case http.MethodPost:
+			lm.prefetch.Refresh()
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// Get all the exercises of the exercise service
+func (lm *LearningMaterialAPI) exerciseCatalog() ([]store.Exercise, error) {
+	response, err := lm.exClient.GetExercises(context.TODO(), &proto.Empty{})
+	if err != nil {
+		return nil, err
+	}
+
+	exers := make([]store.Exercise, 0, len(response.Exercises))
+	for _, e := range response.Exercises {
+		raw, err := protobufToJson(e)
+		if err != nil {
+			return nil, err
+		}
+		var exer store.Exercise
+		if err := json.Unmarshal([]byte(raw), &exer); err != nil {
+			return nil, err
+		}
+		exers = append(exers, exer)
+	}
+	return exers, nil
+}
+
+// dockerImageHost pulls the images with the credentials of the docker repositories configured
+type dockerImageHost struct {
+	docker *dockerclient.Client
+	auths  []dockerclient.AuthConfiguration
+}
+
+func newDockerImageHost(auths []dockerclient.AuthConfiguration) (*dockerImageHost, error) {
+	c, err := dockerclient.NewClientFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return &dockerImageHost{docker: c, auths: auths}, nil
+}
+
+func (h *dockerImageHost) HasImage(image string) bool {
+	_, err := h.docker.InspectImage(image)
+	return err == nil
+}
+
+func (h *dockerImageHost) PullImage(ctx context.Context, image string) error {
+	var auth dockerclient.AuthConfiguration
+	for _, a := range h.auths {
+		if a.ServerAddress != "" && strings.HasPrefix(image, a.ServerAddress) {
+			auth = a
+			break
+		}
+	}
+
+	repo, tag := dockerclient.ParseRepositoryTag(image)
+	if tag == "" {
+		tag = "latest"
+	}
+	return h.docker.PullImage(dockerclient.PullImageOptions{
+		Repository: repo,
+		Tag:        tag,
+		Context:    ctx,
+	}, auth)
+}
@@ -0,0 +1,110 @@
+package app
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aau-network-security/haaukins/store"
+)
+
+type fakeImageHost struct {
+	m      sync.Mutex
+	local  map[string]bool
+	broken map[string]bool
+	pulled []string
+}
+
+func (h *fakeImageHost) HasImage(image string) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.local[image]
+}
+
+func (h *fakeImageHost) PullImage(_ context.Context, image string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.pulled = append(h.pulled, image)
+	if h.broken[image] {
+		return errors.New("manifest unknown")
+	}
+	h.local[image] = true
+	return nil
+}
+
+func writeOVA(t *testing.T, path string, files ...string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("unable to create OVA: %v", err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, name := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: 4})
+		tw.Write([]byte("data"))
+	}
+	tw.Close()
+}
+
+func TestPrefetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prefetch")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	writeOVA(t, filepath.Join(dir, "kali.ova"), "kali.ovf", "kali-disk1.vmdk")
+	writeOVA(t, filepath.Join(dir, "windows.ova"), "disk.vmdk")
+
+	host := &fakeImageHost{
+		local:  map[string]bool{"ftp:latest": true},
+		broken: map[string]bool{"web:1.0": true},
+	}
+	catalog := []store.Exercise{
+		{Tag: "ftp", Instance: []store.ExerciseInstanceConfig{{Image: "ftp:latest"}}},
+		{Tag: "sql", Instance: []store.ExerciseInstanceConfig{{Image: "db:5"}, {Image: "web:1.0"}}},
+	}
+	p := newPrefetcher(PrefetchConfig{Enabled: true}, host,
+		func() ([]store.Exercise, error) { return catalog, nil },
+		dir, []string{"kali", "windows", "kali", "parrot"})
+
+	if !p.ExerciseReady("ftp") {
+		t.Errorf("expected exercises not seen yet to be considered ready")
+	}
+
+	p.run()
+	if len(host.pulled) != 2 {
+		t.Errorf("expected only the missing images to be pulled, got %v", host.pulled)
+	}
+	if !p.ExerciseReady("ftp") || p.ExerciseReady("sql") {
+		t.Errorf("expected only the exercise with all its images pulled to be ready")
+	}
+
+	r := p.Report()
+	if r.Ready || len(r.Images) != 3 {
+		t.Fatalf("unexpected report: %+v", r)
+	}
+	if web := r.Images[2]; web.Image != "web:1.0" || web.State != imageFailed || web.Error == "" {
+		t.Errorf("expected the failed pull to be reported, got %+v", web)
+	}
+	states := map[string]string{}
+	for _, o := range r.OVAs {
+		states[o.Image] = o.State
+	}
+	if len(r.OVAs) != 3 || states["kali"] != ovaReady || states["windows"] != ovaInvalid || states["parrot"] != ovaMissing {
+		t.Errorf("unexpected OVA verification: %+v", r.OVAs)
+	}
+
+	//The failed images are pulled again, the ones added to the catalog too
+	delete(host.broken, "web:1.0")
+	catalog = append(catalog, store.Exercise{Tag: "xss", Instance: []store.ExerciseInstanceConfig{{Image: "xss:2"}}})
+	host.pulled = nil
+	p.run()
+	if len(host.pulled) != 2 || !p.ExerciseReady("sql") || !p.ExerciseReady("xss") {
+		t.Errorf("expected the failed and the new images to be pulled, got %v", host.pulled)
+	}
+}
@@ -0,0 +1,400 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	progressAPIPath  = "/api/progress"
+	progressPagePath = "/progress/"
+
+	progressCompleted = "completed"
+	progressAttempted = "attempted"
+)
+
+// labRecord is a lab started by a learner
+type labRecord struct {
+	Request    string     `json:"request"`
+	Challenges []string   `json:"challenges"`
+	Started    time.Time  `json:"started"`
+	Ended      *time.Time `json:"ended,omitempty"`
+}
+
+// learnerProgress is what a learner did across their labs
+type learnerProgress struct {
+	Identity  string               `json:"identity"`
+	Labs      []labRecord          `json:"labs"`
+	TimeSpent map[string]int64     `json:"time_spent"` //seconds spent on each challenge tag
+	Solves    map[string]time.Time `json:"solves"`     //first solve of each flag tag
+}
+
+// progressStore keeps the progress of the learners, keyed by client identity (client ID
+// for browser sessions, LTI subject or API key user). The progress is saved to the progress
+// file, when configured, so it outlives the labs and the API
+type progressStore struct {
+	m        sync.Mutex
+	path     string
+	learners map[string]*learnerProgress
+}
+
+func newProgressStore(path string) (*progressStore, error) {
+	ps := &progressStore{
+		path:     path,
+		learners: map[string]*learnerProgress{},
+	}
+	if path == "" {
+		return ps, nil
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return ps, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &ps.learners); err != nil {
+		return nil, err
+	}
+
+	//The labs still open were lost when the API stopped without closing them, they end at the
+	//last time the progress was saved
+	ended := false
+	for _, lp := range ps.learners {
+		for i, l := range lp.Labs {
+			if l.Ended != nil {
+				continue
+			}
+			t := info.ModTime()
+			if t.Before(l.Started) {
+				t = l.Started
+			}
+			ps.endLab(lp, i, t)
+			ended = true
+		}
+	}
+	if ended {
+		ps.save()
+	}
+	return ps, nil
+}
+
+func (ps *progressStore) learner(identity string) *learnerProgress {
+	lp, ok := ps.learners[identity]
+	if !ok {
+		lp = &learnerProgress{
+			Identity:  identity,
+			Labs:      []labRecord{},
+			TimeSpent: map[string]int64{},
+			Solves:    map[string]time.Time{},
+		}
+		ps.learners[identity] = lp
+	}
+	return lp
+}
+
+// Save the progress, the file is replaced at once so it is never left half written
+func (ps *progressStore) save() {
+	if ps.path == "" {
+		return
+	}
+
+	raw, err := json.Marshal(ps.learners)
+	if err != nil {
+		log.Error().Msgf("Error encoding progress: %v", err)
+		return
+	}
+	tmp := ps.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		log.Error().Msgf("Error writing progress file: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, ps.path); err != nil {
+		log.Error().Msgf("Error replacing progress file: %v", err)
+	}
+}
+
+func (ps *progressStore) LabStarted(identity string, cr *ClientRequest, t time.Time) {
+	if ps == nil {
+		return
+	}
+	ps.m.Lock()
+	defer ps.m.Unlock()
+
+	lp := ps.learner(identity)
+	lp.Labs = append(lp.Labs, labRecord{
+		Request:    cr.ID(),
+		Challenges: strings.Split(cr.Challenges(), ","),
+		Started:    t,
+	})
+	ps.save()
+}
+
+// LabEnded adds the time the lab has been running to each of its challenges
+func (ps *progressStore) LabEnded(identity string, cr *ClientRequest, t time.Time) {
+	if ps == nil {
+		return
+	}
+	ps.m.Lock()
+	defer ps.m.Unlock()
+
+	lp := ps.learner(identity)
+	for i, l := range lp.Labs {
+		if l.Request == cr.ID() && l.Ended == nil {
+			ps.endLab(lp, i, t)
+		}
+	}
+	ps.save()
+}
+
+func (ps *progressStore) endLab(lp *learnerProgress, i int, t time.Time) {
+	l := &lp.Labs[i]
+	l.Ended = &t
+	for _, c := range l.Challenges {
+		lp.TimeSpent[c] += int64(t.Sub(l.Started).Seconds())
+	}
+}
+
+func (ps *progressStore) Solved(identity string, s solve) {
+	if ps == nil {
+		return
+	}
+	ps.m.Lock()
+	defer ps.m.Unlock()
+
+	lp := ps.learner(identity)
+	if _, ok := lp.Solves[s.Tag]; !ok {
+		lp.Solves[s.Tag] = s.Solved
+		ps.save()
+	}
+}
+
+// Get a copy of the progress of a learner, the time of the labs still running is included
+func (ps *progressStore) Get(identity string) learnerProgress {
+	lp := learnerProgress{
+		Identity:  identity,
+		Labs:      []labRecord{},
+		TimeSpent: map[string]int64{},
+		Solves:    map[string]time.Time{},
+	}
+	if ps == nil {
+		return lp
+	}
+	ps.m.Lock()
+	defer ps.m.Unlock()
+
+	stored, ok := ps.learners[identity]
+	if !ok {
+		return lp
+	}
+	lp.Labs = append(lp.Labs, stored.Labs...)
+	for k, v := range stored.TimeSpent {
+		lp.TimeSpent[k] = v
+	}
+	for k, v := range stored.Solves {
+		lp.Solves[k] = v
+	}
+	for _, l := range stored.Labs {
+		if l.Ended != nil {
+			continue
+		}
+		for _, c := range l.Challenges {
+			lp.TimeSpent[c] += int64(time.Since(l.Started).Seconds())
+		}
+	}
+	return lp
+}
+
+// Close ends the labs still running, they are closed together with the API
+func (ps *progressStore) Close() error {
+	ps.m.Lock()
+	defer ps.m.Unlock()
+
+	now := time.Now()
+	for _, lp := range ps.learners {
+		for i, l := range lp.Labs {
+			if l.Ended == nil {
+				ps.endLab(lp, i, now)
+			}
+		}
+	}
+	ps.save()
+	return nil
+}
+
+type progressChallenge struct {
+	Tag       string `json:"tag"`
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	TimeSpent int64  `json:"time_spent"`
+	Solved    int    `json:"solved"`
+	Flags     int    `json:"flags"`
+}
+
+type progressCategory struct {
+	Name       string              `json:"name"`
+	Tag        string              `json:"tag"`
+	Challenges []progressChallenge `json:"challenges"`
+}
+
+type progressReport struct {
+	Identity   string             `json:"identity"`
+	Labs       []labRecord        `json:"labs"`
+	Categories []progressCategory `json:"categories"`
+}
+
+// Group the challenges a learner completed or attempted by the categories of the catalog
+func progressByCategory(lp learnerProgress, catalog []Category) []progressCategory {
+	started := map[string]bool{}
+	for _, l := range lp.Labs {
+		for _, c := range l.Challenges {
+			started[c] = true
+		}
+	}
+
+	categories := []progressCategory{}
+	for _, cat := range catalog {
+		pc := progressCategory{Name: cat.Name, Tag: cat.Tag, Challenges: []progressChallenge{}}
+		for _, c := range cat.Challenges {
+			chal := progressChallenge{
+				Tag:       c.Tag,
+				Name:      c.Name,
+				TimeSpent: lp.TimeSpent[c.Tag],
+				Flags:     len(c.flags),
+			}
+			for _, f := range c.flags {
+				if _, ok := lp.Solves[f]; ok {
+					chal.Solved++
+				}
+			}
+
+			switch {
+			case chal.Flags > 0 && chal.Solved == chal.Flags:
+				chal.Status = progressCompleted
+			case started[c.Tag] || chal.Solved > 0:
+				chal.Status = progressAttempted
+			default:
+				continue
+			}
+			pc.Challenges = append(pc.Challenges, chal)
+		}
+		if len(pc.Challenges) > 0 {
+			sort.SliceStable(pc.Challenges, func(i, j int) bool {
+				return pc.Challenges[i].Status == progressCompleted && pc.Challenges[j].Status != progressCompleted
+			})
+			categories = append(categories, pc)
+		}
+	}
+	return categories
+}
+
+// Get the identity whose progress is requested: the user of the API key (`?user=`) for server
+// to server integrations, the client of the session cookie otherwise. The client ID in the cookie
+// is used when the client is not around anymore (eg. after a restart of the API)
+func (lm *LearningMaterialAPI) progressIdentity(r *http.Request) (string, bool) {
+	if key, ok := lm.requestAPIKey(r); ok {
+		user := r.URL.Query().Get("user")
+		return apiKeyIdentity(key, user), user != ""
+	}
+
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", false
+	}
+	clientID, err := GetTokenFromCookie(cookie.Value, lm.conf.API.SignKey)
+	if err != nil {
+		return "", false
+	}
+	if client, err := lm.ClientRequestStore.GetClient(clientID); err == nil {
+		return client.Identity(), true
+	}
+	return clientID, true
+}
+
+func (lm *LearningMaterialAPI) progressReport(identity string) (progressReport, error) {
+	lp := lm.progress.Get(identity)
+	catalog, err := lm.getChallengeCatalog()
+	if err != nil {
+		return progressReport{}, err
+	}
+	return progressReport{
+		Identity:   identity,
+		Labs:       lp.Labs,
+		Categories: progressByCategory(lp, catalog),
+	}, nil
+}
+
+// Handle the requests made to `/api/progress`, it returns the progress of the learner
+func (lm *LearningMaterialAPI) handleProgress() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		identity, ok := lm.progressIdentity(r)
+		if !ok {
+			writeJSONError(w, http.StatusUnauthorized, errorGetToken)
+			return
+		}
+
+		report, err := lm.progressReport(identity)
+		if err != nil {
+			log.Error().Msgf("Error getting progress: %v", err)
+			writeJSONError(w, http.StatusBadGateway, "error getting the challenges")
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// Handle the requests made to `/progress/`, it shows the challenges the learner completed or attempted
+func (lm *LearningMaterialAPI) handleProgressPage() http.HandlerFunc {
+	tmpl, err := template.New("base.tmpl.html").Funcs(template.FuncMap{
+		"duration": func(s int64) string { return (time.Duration(s) * time.Second).Round(time.Minute).String() },
+	}).ParseFiles(
+		"resources/private/base.tmpl.html",
+		"resources/private/progress.tmpl.html",
+	)
+	if err != nil {
+		log.Error().Msgf("error progress tmpl: %s", err.Error())
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := lm.progressIdentity(r)
+		if !ok {
+			errorPage(w, r, http.StatusUnauthorized, returnError{
+				Content:         errorGetToken,
+				Toomanyrequests: false,
+			})
+			return
+		}
+
+		report, err := lm.progressReport(identity)
+		if err != nil {
+			log.Error().Msgf("Error getting progress: %v", err)
+			errorPage(w, r, http.StatusBadGateway, returnError{
+				Content:         errorGetCR,
+				Toomanyrequests: false,
+			})
+			return
+		}
+		if err := tmpl.Execute(w, report); err != nil {
+			log.Error().Msgf("template err progress: %s", err.Error())
+		}
+	}
+}
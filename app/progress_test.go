@@ -0,0 +1,106 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProgressStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "progress")
+	if err != nil {
+		t.Fatalf("unable to create progress dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "progress.json")
+
+	ps, err := newProgressStore(path)
+	if err != nil {
+		t.Fatalf("unable to create progress store: %v", err)
+	}
+
+	crs := NewClientRequestStore()
+	client := crs.GetOrCreateClient("lti:https://lms.example.org/student", "127.0.0.1")
+	cr := client.NewClientRequest("ftp,sql")
+
+	started := time.Now().Add(-10 * time.Minute)
+	ps.LabStarted(client.Identity(), cr, started)
+	ps.Solved(client.Identity(), solve{Tag: "ftp-login", Solved: started.Add(time.Minute)})
+	ps.LabEnded(client.Identity(), cr, started.Add(5*time.Minute))
+
+	//The progress outlives the store
+	ps, err = newProgressStore(path)
+	if err != nil {
+		t.Fatalf("unable to read progress store: %v", err)
+	}
+	lp := ps.Get(client.Identity())
+	if len(lp.Labs) != 1 || lp.Labs[0].Ended == nil {
+		t.Fatalf("expected one ended lab: %+v", lp.Labs)
+	}
+	if lp.TimeSpent["ftp"] != 300 || lp.TimeSpent["sql"] != 300 {
+		t.Errorf("expected 5 minutes spent on each challenge: %v", lp.TimeSpent)
+	}
+
+	catalog := []Category{
+		{Name: "Network", Tag: "network", Challenges: []Challenge{
+			{Name: "FTP", Tag: "ftp", flags: []string{"ftp-login"}},
+			{Name: "Telnet", Tag: "telnet", flags: []string{"telnet-login"}},
+		}},
+		{Name: "Web", Tag: "web", Challenges: []Challenge{
+			{Name: "SQL", Tag: "sql", flags: []string{"sql-1", "sql-2"}},
+		}},
+		{Name: "Crypto", Tag: "crypto", Challenges: []Challenge{
+			{Name: "RSA", Tag: "rsa", flags: []string{"rsa"}},
+		}},
+	}
+	categories := progressByCategory(lp, catalog)
+	if len(categories) != 2 {
+		t.Fatalf("expected only the categories with progress: %+v", categories)
+	}
+	if c := categories[0].Challenges; len(c) != 1 || c[0].Tag != "ftp" || c[0].Status != progressCompleted {
+		t.Errorf("expected ftp to be completed: %+v", c)
+	}
+	if c := categories[1].Challenges; len(c) != 1 || c[0].Status != progressAttempted || c[0].Solved != 0 {
+		t.Errorf("expected sql to be attempted: %+v", c)
+	}
+}
+
+func TestProgressStoreOpenLab(t *testing.T) {
+	dir, err := ioutil.TempDir("", "progress")
+	if err != nil {
+		t.Fatalf("unable to create progress dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "progress.json")
+
+	ps, err := newProgressStore(path)
+	if err != nil {
+		t.Fatalf("unable to create progress store: %v", err)
+	}
+	crs := NewClientRequestStore()
+	client := crs.GetOrCreateClient("lti:https://lms.example.org/student", "127.0.0.1")
+	started := time.Now().Add(-2 * time.Hour)
+	ps.LabStarted(client.Identity(), client.NewClientRequest("ftp"), started)
+
+	//The API stopped an hour after the lab started without closing it
+	saved := started.Add(time.Hour)
+	if err := os.Chtimes(path, saved, saved); err != nil {
+		t.Fatalf("unable to change the time of the progress file: %v", err)
+	}
+	ps, err = newProgressStore(path)
+	if err != nil {
+		t.Fatalf("unable to read progress store: %v", err)
+	}
+	lp := ps.Get(client.Identity())
+	if len(lp.Labs) != 1 || lp.Labs[0].Ended == nil || !lp.Labs[0].Ended.Equal(saved) {
+		t.Fatalf("expected the open lab to end when the progress was saved: %+v", lp.Labs)
+	}
+	if lp.TimeSpent["ftp"] != 3600 {
+		t.Errorf("expected an hour spent on the challenge: %v", lp.TimeSpent)
+	}
+	if again := ps.Get(client.Identity()); again.TimeSpent["ftp"] != 3600 {
+		t.Errorf("expected the time spent on the ended lab to stay the same: %v", again.TimeSpent)
+	}
+}
@@ -0,0 +1,80 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const provisionRetryDelay = 10 * time.Second
+
+// rollback undoes the steps of a provisioning that failed. Each step done registers its
+// compensating action, they run in reverse order unless the provisioning is committed
+type rollback struct {
+	steps []rollbackStep
+}
+
+type rollbackStep struct {
+	name string
+	undo func() error
+}
+
+func (rb *rollback) Add(name string, undo func() error) {
+	rb.steps = append(rb.steps, rollbackStep{name: name, undo: undo})
+}
+
+// Commit the steps done, nothing is undone anymore
+func (rb *rollback) Commit() {
+	rb.steps = nil
+}
+
+// Undo the steps done so far, the last one first. Every step is undone even when another fails
+func (rb *rollback) Run() {
+	for i := len(rb.steps) - 1; i >= 0; i-- {
+		s := rb.steps[i]
+		if err := s.undo(); err != nil {
+			log.Error().Str("step", s.name).Msgf("Error rolling back: %v", err)
+		}
+	}
+	rb.steps = nil
+}
+
+// Whether creating the lab again may succeed, eg. after a docker pull or a VM import failed.
+// The lab not fitting anywhere or a bad request won't get better with a retry
+func transientError(err error) bool {
+	switch err {
+	case nil, ErrRequestNotFound, ErrLabTooLarge, ErrAdmissionQueueFull, ErrAdmissionTimeout, ErrNoWorker, ErrWorkerFull:
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.ResourceExhausted, codes.InvalidArgument, codes.Unauthenticated, codes.NotFound:
+		return false
+	}
+	return true
+}
+
+// Run the provisioning, it is tried again up to the retries configured on transient errors
+func (lm *LearningMaterialAPI) retryProvision(cr *ClientRequest, provision func() error) error {
+	delay := lm.conf.API.ProvisionRetryDelay
+	if delay == 0 {
+		delay = provisionRetryDelay
+	}
+
+	err := provision()
+	for attempt := 1; attempt <= lm.conf.API.ProvisionRetries && transientError(err); attempt++ {
+		log.Warn().
+			Str("request", cr.ID()).
+			Int("attempt", attempt).
+			Msgf("Error provisioning the lab, retrying: %v", err)
+		time.Sleep(delay * time.Duration(attempt))
+		err = provision()
+	}
+	return err
+}
@@ -0,0 +1,94 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	hlab "github.com/aau-network-security/haaukins/lab"
+)
+
+func TestRollback(t *testing.T) {
+	var undone []string
+	var rb rollback
+	for _, step := range []string{"lab", "guacamole user", "connections"} {
+		step := step
+		rb.Add(step, func() error {
+			undone = append(undone, step)
+			return errors.New("undo failed")
+		})
+	}
+	rb.Run()
+	if len(undone) != 3 || undone[0] != "connections" || undone[2] != "lab" {
+		t.Fatalf("expected every step undone in reverse order, got %v", undone)
+	}
+
+	rb.Add("lab", func() error { t.Fatal("unexpected undo of a committed step"); return nil })
+	rb.Commit()
+	rb.Run()
+}
+
+func TestProvisionFailure(t *testing.T) {
+	a := newAdmission(AdmissionConfig{Enabled: true, QueueTimeout: time.Second})
+	a.stats = func() (hostStats, error) {
+		return hostStats{MemTotalMB: 16384, MemAvailableMB: 16000, CPUs: 4, DiskFreeMB: 100000}, nil
+	}
+	lab := &testLab{startErr: errors.New("image pull failed")}
+	w := newWorker("local", nil, 1, "10.0.0.1", a)
+	w.newLab = func(context.Context, hlab.Config) (hlab.Lab, error) { return lab, nil }
+
+	if _, _, err := w.CreateLab(context.Background(), labSpec{}); err == nil {
+		t.Fatalf("expected the lab to fail to start")
+	}
+	if !lab.closed {
+		t.Errorf("expected the half created lab to be closed")
+	}
+	if r := a.Report(labCost{}); r.Pending.MemoryMB != 0 || r.Labs != 0 {
+		t.Errorf("expected the admission to be released, got %+v", r)
+	}
+
+	//A failed request doesn't hold the slot of the client
+	crs := NewClientRequestStore()
+	client := crs.NewClient("localhost")
+	cr := client.NewClientRequest("ftp")
+	cr.NewError(errors.New("image pull failed"))
+	if client.RequestMade() != 0 || len(crs.GetAllRequests()) != 0 {
+		t.Errorf("expected the failed request not to count against the limits")
+	}
+}
+
+func TestRetryProvision(t *testing.T) {
+	lm := &LearningMaterialAPI{conf: &Config{API: APIConfig{ProvisionRetries: 2, ProvisionRetryDelay: time.Millisecond}}}
+	cr := &ClientRequest{id: "r1"}
+
+	var attempts int
+	err := lm.retryProvision(cr, func() error {
+		attempts++
+		if attempts < 2 {
+			return errors.New("vm import failed")
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("expected a transient error to be retried, got %v after %d attempts", err, attempts)
+	}
+
+	attempts = 0
+	err = lm.retryProvision(cr, func() error {
+		attempts++
+		return ErrNoWorker
+	})
+	if err != ErrNoWorker || attempts != 1 {
+		t.Fatalf("expected %v not to be retried, got %v after %d attempts", ErrNoWorker, err, attempts)
+	}
+
+	attempts = 0
+	lm.retryProvision(cr, func() error {
+		attempts++
+		return errors.New("docker pull failed")
+	})
+	if attempts != 3 {
+		t.Fatalf("expected 2 retries, got %d attempts", attempts)
+	}
+}
@@ -3,7 +3,6 @@ package app
 import (
 	"fmt"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"time"
 
@@ -15,38 +14,90 @@ func (lm *LearningMaterialAPI) proxyHandler() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		baseURL := fmt.Sprintf("http://localhost:%d/guacamole/", lm.guacamole.GetPort())
-		origin, _ := url.Parse(baseURL)
+		cr, shadow, ok := lm.authorizeGuacRequest(r)
+		if !ok {
+			log.Debug().Str("path", r.URL.Path).Str("method", r.Method).Msg("Guacamole request not authorized")
+			if classifyGuacRequest(r) == guacStatic {
+				errorPage(w, r, http.StatusUnauthorized, returnError{
+					Content:         errorGuacSession,
+					Toomanyrequests: false,
+				})
+				return
+			}
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
 
-		director := func(req *http.Request) {
-			req.Header.Add("X-Forwarded-Host", req.Host)
-			req.Header.Add("X-Origin-Host", origin.Host)
-			req.URL.Scheme = "http"
-			req.URL.Host = origin.Host
+		//The admins shadowing a lab don't keep it from being idle
+		if cr != nil && !shadow {
+			cr.touch()
 		}
 
-		proxy := &httputil.ReverseProxy{Director: director}
-		proxy.ServeHTTP(w, r)
+		//Tunnels are cut off as soon as the environment of the client request is closed
+		if cr != nil && classifyGuacRequest(r) == guacTunnel {
+			ctx, done := cr.trackTunnel(r.Context(), shadow)
+			defer done()
+			r = r.WithContext(ctx)
+
+			if r.URL.RawQuery == "connect" && !isWebsocketRequest(r) {
+				w = &tunnelConnectWriter{ResponseWriter: w, bind: func(uuid string) {
+					cr.bindHTTPTunnel(uuid, shadow)
+				}}
+			}
+
+			if cr.recorded && isGuacTunnelConnect(r) {
+				lm.auditRecordingStarted(r, cr)
+			}
+		}
+
+		lm.guacProxy.Forward(w, r, cr)
+	}
+}
+
+//Metrics of the connections proxied to guacamole, it can be called only through admin priviledges
+func (lm *LearningMaterialAPI) proxyMetrics() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if lm.guacProxy == nil {
+			writeJSON(w, http.StatusOK, newProxyMetrics().Report())
+			return
+		}
+		writeJSON(w, http.StatusOK, lm.guacProxy.metrics.Report())
 	}
 }
 
+//Record in the audit log the guacamole connection opened by a recorded client request
+func (lm *LearningMaterialAPI) auditRecordingStarted(r *http.Request, cr *ClientRequest) {
+	e := auditEvent{
+		Action:  auditRecordingStarted,
+		Request: cr.ID(),
+		Details: map[string]string{
+			"challenges": cr.Challenges(),
+			"connection": guacConnectionID(r),
+		},
+	}
+	if client, _, err := lm.ClientRequestStore.GetClientRequestByID(cr.ID()); err == nil {
+		e.Actor = client.Identity()
+		e.Client = client.ID()
+	}
+	lm.audit.Record(e)
+}
+
 //Handle the request made to `/guaclogin/`, it redirects the request to proxyHandler instance
 func (lm *LearningMaterialAPI) guacLogin() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		rChallenges := r.URL.Query().Get(requestedChallenges)
-		clientCookie, _ := r.Cookie(sessionCookie)
-
-		clientID, err := GetTokenFromCookie(clientCookie.Value, lm.conf.API.SignKey)
-		if err != nil { //Error getting the client ID from cookie
-			log.Error().Msgf("Error getting session token: %v", err)
-			errorPage(w, r, http.StatusInternalServerError, returnError{
-				Content:         errorGetToken,
+		//The login is allowed only through one-time tickets
+		lt, ok := lm.tickets.Redeem(r.URL.Query().Get(loginTicketParam))
+		if !ok {
+			errorPage(w, r, http.StatusUnauthorized, returnError{
+				Content:         errorLoginTicket,
 				Toomanyrequests: false,
 			})
 			return
 		}
+		clientID, rChallenges := lt.clientID, lt.chals
 
 		client, err := lm.ClientRequestStore.GetClient(clientID)
 		if err != nil { //Error getting Client
@@ -68,7 +119,7 @@ func (lm *LearningMaterialAPI) guacLogin() http.HandlerFunc {
 			return
 		}
 
-		content, err := lm.guacamole.RawLogin(cr.ID(), cr.ID())
+		content, err := lm.guacamole.RawLogin(cr.ID(), cr.guacPassword)
 		if err != nil {
 			log.Error().Msgf("Unable to login guacamole [%s]: %v", cr.ID(), err)
 			errorPage(w, r, http.StatusInternalServerError, returnError{
@@ -78,11 +129,28 @@ func (lm *LearningMaterialAPI) guacLogin() http.HandlerFunc {
 			return
 		}
 		guacLoginCookie := url.QueryEscape(string(content))
+		cr.guacToken = guacAuthToken(content)
 
-		authC := http.Cookie{Name: "GUAC_AUTH", Value: guacLoginCookie, Path: "/guacamole/"}
+		//The browser might not have a session yet (eg. login links made through API keys)
+		token, err := client.CreateToken(lm.conf.API.SignKey)
+		if err != nil {
+			log.Error().Msgf("Error creating session token: %v", err)
+			errorPage(w, r, http.StatusInternalServerError, returnError{
+				Content:         errorCreateToken,
+				Toomanyrequests: false,
+			})
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: token, Path: "/"})
+
+		//The guacamole login doesn't outlive the lab
+		authC := http.Cookie{Name: "GUAC_AUTH", Value: guacLoginCookie, Path: "/guacamole/", SameSite: http.SameSiteLaxMode}
+		if cr.env != nil {
+			authC.MaxAge = labMaxAge(cr.env.Expires())
+		}
 		http.SetCookie(w, &authC)
 		time.Sleep(10 * time.Second) //wait a little bit more in order to boot kali linux
-		host := fmt.Sprintf("/guacamole/?%s=%s", requestedChallenges, rChallenges)
+		host := fmt.Sprintf("%s?%s=%s", labPagePath, requestedChallenges, url.QueryEscape(rChallenges))
 		http.Redirect(w, r, host, http.StatusFound)
 	}
 }
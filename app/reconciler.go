@@ -0,0 +1,596 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	hlab "github.com/aau-network-security/haaukins/lab"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	reconcileAdminPath = "/admin/reconcile/"
+	reconcileInterval  = 10 * time.Minute
+	reconcileGrace     = 5 * time.Minute
+	reconcileLabel     = "hkn" //label the haaukins library puts on the containers of the labs
+
+	instanceDocker = "docker"
+	instanceVBox   = "vbox"
+)
+
+var errNetworkInUse = errors.New("the network is used by other containers")
+
+// labResources are the containers, networks and VMs created for a lab of this API instance
+type labResources struct {
+	Lab        string    `json:"lab"`
+	Created    time.Time `json:"created"`
+	Starting   bool      `json:"starting,omitempty"` //the lab was being created, its resources may be missing
+	Containers []string  `json:"containers,omitempty"`
+	Networks   []string  `json:"networks,omitempty"`
+	VMs        []string  `json:"vms,omitempty"`
+}
+
+func (r labResources) empty() bool {
+	return len(r.Containers) == 0 && len(r.Networks) == 0 && len(r.VMs) == 0
+}
+
+// hostContainer is a container of the host carrying the label of the lab containers
+type hostContainer struct {
+	ID       string
+	Created  time.Time
+	Networks []string
+}
+
+// resourceHost lists and removes the docker and virtualbox resources of the host
+type resourceHost interface {
+	Containers() ([]string, error)
+	LabelledContainers(label string) ([]hostContainer, error)
+	ContainerNetworks(id string) ([]string, error)
+	Networks() ([]string, error)
+	VMs() ([]string, error)
+	RemoveContainer(id string) error
+	RemoveNetwork(id string) error
+	RemoveVM(id string) error
+}
+
+// reconciler keeps track of the resources of the labs created by this API instance and removes
+// the ones left behind, eg. after a crash or a lab which failed to close. Only the resources it
+// tracked are ever removed, the rest of the host is left alone
+type reconciler struct {
+	m        sync.Mutex
+	path     string
+	labs     map[string]*labResources
+	creating map[string]bool //labs this process is creating, never orphaned whatever their age
+	host     resourceHost
+	worker   *worker //its labs are never orphaned, they are closed through it
+	started  time.Time
+	label    string
+	grace    time.Duration
+	interval time.Duration
+	dryRun   bool
+	stop     chan struct{}
+	once     sync.Once
+}
+
+func newReconciler(conf ReconcilerConfig, host resourceHost, w *worker) (*reconciler, error) {
+	rc := &reconciler{
+		path:     conf.StateFile,
+		labs:     map[string]*labResources{},
+		creating: map[string]bool{},
+		host:     host,
+		worker:   w,
+		started:  time.Now(),
+		label:    conf.Label,
+		grace:    conf.Grace,
+		interval: conf.Interval,
+		dryRun:   conf.DryRun,
+		stop:     make(chan struct{}),
+	}
+	if rc.grace == 0 {
+		rc.grace = reconcileGrace
+	}
+	if rc.interval == 0 {
+		rc.interval = reconcileInterval
+	}
+	if rc.label == "" {
+		rc.label = reconcileLabel
+	}
+	if rc.path == "" {
+		return rc, nil
+	}
+
+	raw, err := ioutil.ReadFile(rc.path)
+	if os.IsNotExist(err) {
+		return rc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &rc.labs); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+// Save the tracked resources, the file is replaced at once so it is never left half written
+func (rc *reconciler) save() {
+	if rc.path == "" {
+		return
+	}
+
+	raw, err := json.Marshal(rc.labs)
+	if err != nil {
+		log.Error().Msgf("Error encoding lab resources: %v", err)
+		return
+	}
+	tmp := rc.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		log.Error().Msgf("Error writing lab resources file: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, rc.path); err != nil {
+		log.Error().Msgf("Error replacing lab resources file: %v", err)
+	}
+}
+
+// Record a lab before it is created, a lab whose creation is interrupted (eg. by a crash) is
+// still known after a restart. Done is called once the creation is over, successful or not
+func (rc *reconciler) Begin(id string) {
+	if rc == nil {
+		return
+	}
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	rc.labs[id] = &labResources{Lab: id, Created: time.Now(), Starting: true}
+	rc.creating[id] = true
+	rc.save()
+}
+
+// The creation of a lab is over, from now on it can be orphaned
+func (rc *reconciler) Done(id string) {
+	if rc == nil {
+		return
+	}
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	delete(rc.creating, id)
+}
+
+// Track the resources of a lab of this host. It is called again each time the resources of
+// the lab change (eg. it is started, restarted or an exercise is reset): the resources are
+// added to the ones tracked before, which the lab may have left behind
+func (rc *reconciler) Track(id string, lab hlab.Lab, started bool) {
+	if rc == nil {
+		return
+	}
+
+	var containers, networks, vms []string
+	for _, i := range lab.InstanceInfo() {
+		switch i.Type {
+		case instanceDocker:
+			containers = append(containers, i.Id)
+			ids, err := rc.host.ContainerNetworks(i.Id)
+			if err != nil {
+				log.Warn().Str("lab", id).Msgf("Error getting the networks of container %s: %v", i.Id, err)
+			}
+			networks = append(networks, ids...)
+		case instanceVBox:
+			vms = append(vms, i.Id)
+		}
+	}
+
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	res, ok := rc.labs[id]
+	if !ok {
+		res = &labResources{Lab: id, Created: time.Now()}
+		rc.labs[id] = res
+	}
+	res.Containers = appendMissing(res.Containers, containers...)
+	res.Networks = appendMissing(res.Networks, networks...)
+	res.VMs = appendMissing(res.VMs, vms...)
+	if started {
+		res.Starting = false
+	}
+	rc.save()
+}
+
+func appendMissing(ids []string, add ...string) []string {
+	for _, id := range add {
+		if !containsString(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Stop tracking a lab which was closed
+func (rc *reconciler) Untrack(id string) {
+	if rc == nil {
+		return
+	}
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	if _, ok := rc.labs[id]; ok {
+		delete(rc.labs, id)
+		rc.save()
+	}
+}
+
+// reconcileReport is what a reconciliation found, and removed unless it was a dry run
+type reconcileReport struct {
+	DryRun  bool           `json:"dry_run"`
+	Tracked int            `json:"tracked"`
+	Orphans []labResources `json:"orphans"`
+	Errors  []string       `json:"errors,omitempty"`
+}
+
+func present(ids []string, on map[string]bool) []string {
+	var found []string
+	for _, id := range ids {
+		if on[id] {
+			found = append(found, id)
+		}
+	}
+	return found
+}
+
+func listed(list func() ([]string, error)) (map[string]bool, error) {
+	ids, err := list()
+	if err != nil {
+		return nil, err
+	}
+	on := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		on[id] = true
+	}
+	return on, nil
+}
+
+// Find the tracked labs which are not on the worker anymore (eg. after a crash or a failed
+// close), with the resources still on the host. The labs created within the grace period are left alone
+func (rc *reconciler) orphans(now time.Time) ([]labResources, []string, error) {
+	containers, err := listed(rc.host.Containers)
+	if err != nil {
+		return nil, nil, err
+	}
+	networks, err := listed(rc.host.Networks)
+	if err != nil {
+		return nil, nil, err
+	}
+	vms, err := listed(rc.host.VMs)
+	if err != nil {
+		return nil, nil, err
+	}
+	labelled, err := rc.host.LabelledContainers(rc.label)
+	if err != nil {
+		return nil, nil, err
+	}
+	live := rc.worker.labIDs()
+
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	for id := range rc.creating {
+		live[id] = true
+	}
+
+	//The networks shared with a lab in use are never removed
+	inUse := map[string]bool{}
+	owned := map[string]bool{}
+	for id, r := range rc.labs {
+		if live[id] || now.Sub(r.Created) < rc.grace {
+			for _, n := range r.Networks {
+				inUse[n] = true
+			}
+		}
+		for _, c := range r.Containers {
+			owned[c] = true
+		}
+	}
+
+	var orphans []labResources
+	var gone []string
+	for id, r := range rc.labs {
+		if live[id] || now.Sub(r.Created) < rc.grace {
+			continue
+		}
+		o := labResources{
+			Lab:        id,
+			Created:    r.Created,
+			Starting:   r.Starting,
+			Containers: present(r.Containers, containers),
+			VMs:        present(r.VMs, vms),
+		}
+		labNetworks := present(r.Networks, networks)
+		//The creation of the lab was interrupted by the end of the previous run: the labelled
+		//containers created since then which no lab tracks are the lab's. Docker has the
+		//creation time of the containers to the second
+		if r.Starting && r.Created.Before(rc.started) {
+			for _, c := range labelled {
+				if owned[c.ID] || c.Created.Before(r.Created.Truncate(time.Second)) || c.Created.After(rc.started) {
+					continue
+				}
+				owned[c.ID] = true
+				o.Containers = append(o.Containers, c.ID)
+				labNetworks = appendMissing(labNetworks, present(c.Networks, networks)...)
+			}
+		}
+		for _, n := range labNetworks {
+			if !inUse[n] {
+				o.Networks = append(o.Networks, n)
+			}
+		}
+		if o.empty() {
+			gone = append(gone, id)
+			continue
+		}
+		orphans = append(orphans, o)
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].Created.Before(orphans[j].Created) })
+	return orphans, gone, nil
+}
+
+// Remove the resources of an orphaned lab
+func (rc *reconciler) remove(o labResources) []string {
+	var errs []string
+	for _, id := range o.Containers {
+		if err := rc.host.RemoveContainer(id); err != nil {
+			errs = append(errs, "container "+id+": "+err.Error())
+		}
+	}
+	for _, id := range o.VMs {
+		if err := rc.host.RemoveVM(id); err != nil {
+			errs = append(errs, "vm "+id+": "+err.Error())
+		}
+	}
+	for _, id := range o.Networks {
+		if err := rc.host.RemoveNetwork(id); err != nil && err != errNetworkInUse {
+			errs = append(errs, "network "+id+": "+err.Error())
+		}
+	}
+	return errs
+}
+
+// Reconcile the tracked resources with the labs in use, the orphans are only reported on a dry run
+func (rc *reconciler) Run(dryRun bool) reconcileReport {
+	report := reconcileReport{DryRun: dryRun, Orphans: []labResources{}}
+
+	orphans, gone, err := rc.orphans(time.Now())
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report
+	}
+	report.Orphans = append(report.Orphans, orphans...)
+
+	rc.m.Lock()
+	report.Tracked = len(rc.labs)
+	rc.m.Unlock()
+
+	if dryRun {
+		return report
+	}
+
+	removed := gone
+	for _, o := range orphans {
+		errs := rc.remove(o)
+		if len(errs) > 0 {
+			report.Errors = append(report.Errors, errs...)
+			continue
+		}
+		removed = append(removed, o.Lab)
+	}
+
+	rc.m.Lock()
+	for _, id := range removed {
+		delete(rc.labs, id)
+	}
+	if len(removed) > 0 {
+		rc.save()
+	}
+	rc.m.Unlock()
+	return report
+}
+
+func (rc *reconciler) reconcile() {
+	r := rc.Run(rc.dryRun)
+	for _, err := range r.Errors {
+		log.Error().Msgf("Error reconciling lab resources: %s", err)
+	}
+	for _, o := range r.Orphans {
+		log.Warn().
+			Str("lab", o.Lab).
+			Bool("dry-run", r.DryRun).
+			Int("containers", len(o.Containers)).
+			Int("networks", len(o.Networks)).
+			Int("vms", len(o.VMs)).
+			Msg("Orphaned lab resources")
+	}
+}
+
+// Reconcile at startup, then every interval until the reconciler is closed
+func (rc *reconciler) loop() {
+	rc.reconcile()
+	if rc.interval < 0 {
+		return
+	}
+
+	ticker := time.NewTicker(rc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rc.reconcile()
+		case <-rc.stop:
+			return
+		}
+	}
+}
+
+func (rc *reconciler) Close() error {
+	rc.once.Do(func() { close(rc.stop) })
+	return nil
+}
+
+// Handle the requests made to `/admin/reconcile/`: `GET` lists the orphaned resources without
+// touching them, `POST` removes them (`?dry-run=true` only lists them)
+func (lm *LearningMaterialAPI) handleReconcile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var dryRun bool
+		switch r.Method {
+		case http.MethodGet:
+			dryRun = true
+		case http.MethodPost:
+			dryRun, _ = strconv.ParseBool(r.URL.Query().Get("dry-run"))
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		report := lm.reconciler.Run(dryRun)
+		if !dryRun {
+			admin, _, _ := r.BasicAuth()
+			labs := make([]string, len(report.Orphans))
+			for i, o := range report.Orphans {
+				labs[i] = o.Lab
+			}
+			lm.audit.Record(auditEvent{
+				Action:  auditResourcesReconciled,
+				Actor:   "admin:" + admin,
+				Details: map[string]string{"labs": strings.Join(labs, ","), "errors": strconv.Itoa(len(report.Errors))},
+			})
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// dockerVBoxHost is the docker daemon and the virtualbox of this host
+type dockerVBoxHost struct {
+	docker *dockerclient.Client
+}
+
+func newDockerVBoxHost() (*dockerVBoxHost, error) {
+	c, err := dockerclient.NewClientFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return &dockerVBoxHost{docker: c}, nil
+}
+
+func (h *dockerVBoxHost) Containers() ([]string, error) {
+	containers, err := h.docker.ListContainers(dockerclient.ListContainersOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(containers))
+	for i, c := range containers {
+		ids[i] = c.ID
+	}
+	return ids, nil
+}
+
+func (h *dockerVBoxHost) LabelledContainers(label string) ([]hostContainer, error) {
+	containers, err := h.docker.ListContainers(dockerclient.ListContainersOptions{
+		All:     true,
+		Filters: map[string][]string{"label": {label}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	labelled := make([]hostContainer, len(containers))
+	for i, c := range containers {
+		labelled[i] = hostContainer{ID: c.ID, Created: time.Unix(c.Created, 0)}
+		for name, n := range c.Networks.Networks {
+			if name == "bridge" || name == "host" || name == "none" {
+				continue
+			}
+			labelled[i].Networks = append(labelled[i].Networks, n.NetworkID)
+		}
+	}
+	return labelled, nil
+}
+
+func (h *dockerVBoxHost) ContainerNetworks(id string) ([]string, error) {
+	c, err := h.docker.InspectContainerWithOptions(dockerclient.InspectContainerOptions{ID: id})
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for name, n := range c.NetworkSettings.Networks {
+		//the default networks of docker are never the lab's own
+		if name == "bridge" || name == "host" || name == "none" {
+			continue
+		}
+		ids = append(ids, n.NetworkID)
+	}
+	return ids, nil
+}
+
+func (h *dockerVBoxHost) Networks() ([]string, error) {
+	networks, err := h.docker.ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(networks))
+	for i, n := range networks {
+		ids[i] = n.ID
+	}
+	return ids, nil
+}
+
+func (h *dockerVBoxHost) RemoveContainer(id string) error {
+	err := h.docker.RemoveContainer(dockerclient.RemoveContainerOptions{ID: id, Force: true, RemoveVolumes: true})
+	if _, ok := err.(*dockerclient.NoSuchContainer); ok {
+		return nil
+	}
+	return err
+}
+
+func (h *dockerVBoxHost) RemoveNetwork(id string) error {
+	n, err := h.docker.NetworkInfo(id)
+	if _, ok := err.(*dockerclient.NoSuchNetwork); ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(n.Containers) > 0 {
+		return errNetworkInUse
+	}
+	return h.docker.RemoveNetwork(id)
+}
+
+// VMs lists the names and the UUIDs of the virtualbox VMs, as `"name" {uuid}` lines
+func (h *dockerVBoxHost) VMs() ([]string, error) {
+	out, err := exec.Command("VBoxManage", "list", "vms").Output()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, line := range strings.Split(string(out), "\n") {
+		i := strings.LastIndex(line, " {")
+		if i < 0 {
+			continue
+		}
+		ids = append(ids, strings.Trim(line[:i], `"`), strings.Trim(line[i+1:], "{}"))
+	}
+	return ids, nil
+}
+
+func (h *dockerVBoxHost) RemoveVM(id string) error {
+	//the VM may be powered off already
+	_ = exec.Command("VBoxManage", "controlvm", id, "poweroff").Run()
+	if out, err := exec.Command("VBoxManage", "unregistervm", id, "--delete").CombinedOutput(); err != nil {
+		return errors.New(strings.TrimSpace(string(out)))
+	}
+	return nil
+}
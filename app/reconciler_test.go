@@ -0,0 +1,385 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	hlab "github.com/aau-network-security/haaukins/lab"
+	"github.com/aau-network-security/haaukins/virtual"
+)
+
+type fakeResourceHost struct {
+	m          sync.Mutex
+	containers map[string][]string  //container -> networks
+	created    map[string]time.Time //labelled containers -> creation time
+	networks   map[string]bool
+	vms        map[string]bool
+}
+
+func keys(m map[string]bool) []string {
+	var ids []string
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (h *fakeResourceHost) Containers() ([]string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	var ids []string
+	for id := range h.containers {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (h *fakeResourceHost) LabelledContainers(string) ([]hostContainer, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	var labelled []hostContainer
+	for id, created := range h.created {
+		if networks, ok := h.containers[id]; ok {
+			labelled = append(labelled, hostContainer{ID: id, Created: created, Networks: networks})
+		}
+	}
+	return labelled, nil
+}
+
+func (h *fakeResourceHost) ContainerNetworks(id string) ([]string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.containers[id], nil
+}
+
+func (h *fakeResourceHost) Networks() ([]string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return keys(h.networks), nil
+}
+
+func (h *fakeResourceHost) VMs() ([]string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return keys(h.vms), nil
+}
+
+func (h *fakeResourceHost) RemoveContainer(id string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	delete(h.containers, id)
+	return nil
+}
+
+func (h *fakeResourceHost) RemoveNetwork(id string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	delete(h.networks, id)
+	return nil
+}
+
+func (h *fakeResourceHost) RemoveVM(id string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	delete(h.vms, id)
+	return nil
+}
+
+func TestReconciler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reconciler")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	state := filepath.Join(dir, "resources.json")
+
+	host := &fakeResourceHost{
+		containers: map[string][]string{
+			"c-live":    {"n-shared"},
+			"c-orphan":  {"n-shared", "n-orphan"},
+			"c-crashed": {"n-crashed"},
+			"c-other":   {"n-other"},
+		},
+		networks: map[string]bool{"n-shared": true, "n-orphan": true, "n-crashed": true, "n-other": true},
+		vms:      map[string]bool{"kali-crashed": true, "kali-live": true, "other-vm": true},
+	}
+
+	//A lab left behind by a crash of the previous run
+	raw, _ := json.Marshal(map[string]labResources{"crashed": {
+		Lab:        "crashed",
+		Created:    time.Now().Add(-time.Hour),
+		Containers: []string{"c-crashed", "c-gone"},
+		Networks:   []string{"n-crashed"},
+		VMs:        []string{"kali-crashed"},
+	}})
+	if err := ioutil.WriteFile(state, raw, 0600); err != nil {
+		t.Fatalf("unable to write state file: %v", err)
+	}
+
+	instances := map[string][]virtual.InstanceInfo{
+		"live":   {{Type: instanceDocker, Id: "c-live"}, {Type: instanceVBox, Id: "kali-live"}},
+		"orphan": {{Type: instanceDocker, Id: "c-orphan"}},
+	}
+	next := make(chan string, 2)
+	w := newWorker("local", nil, 0, "10.0.0.1", nil)
+	w.newLab = func(context.Context, hlab.Config) (hlab.Lab, error) {
+		name := <-next
+		l := &testLab{host: host, instances: instances[name]}
+		if name == "orphan" {
+			l.closeErr = errors.New("close failed")
+		}
+		return l, nil
+	}
+
+	rc, err := newReconciler(ReconcilerConfig{StateFile: state, Grace: time.Hour}, host, w)
+	if err != nil {
+		t.Fatalf("unexpected error creating the reconciler: %v", err)
+	}
+	w.resources = rc
+
+	//Every lab on the worker is live, whether it is in use or not
+	next <- "live"
+	live, _, _, _ := w.createLab(context.Background(), labSpec{})
+	next <- "orphan"
+	_, orphan, _, _ := w.createLab(context.Background(), labSpec{})
+	if err := orphan.Close(); err == nil {
+		t.Fatalf("expected the lab to fail to close")
+	}
+
+	//The labs just created are within the grace period
+	r := rc.Run(true)
+	if len(r.Orphans) != 1 || r.Orphans[0].Lab != "crashed" || r.Tracked != 3 {
+		t.Fatalf("expected only the crashed lab to be orphaned, got %+v", r)
+	}
+	if c := r.Orphans[0].Containers; len(c) != 1 || c[0] != "c-crashed" {
+		t.Errorf("expected only the containers still on the host, got %v", r.Orphans[0].Containers)
+	}
+	if _, ok := host.containers["c-crashed"]; !ok {
+		t.Fatalf("expected a dry run to leave the resources alone")
+	}
+
+	rc.grace = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	r = rc.Run(false)
+	if len(r.Orphans) != 2 || len(r.Errors) != 0 {
+		t.Fatalf("expected the crashed and the unused lab to be removed, got %+v", r)
+	}
+
+	for _, c := range []string{"c-crashed", "c-orphan"} {
+		if _, ok := host.containers[c]; ok {
+			t.Errorf("expected orphaned container %s to be removed", c)
+		}
+	}
+	for _, c := range []string{"c-live", "c-other"} {
+		if _, ok := host.containers[c]; !ok {
+			t.Errorf("expected container %s to be kept", c)
+		}
+	}
+	if host.networks["n-crashed"] || host.networks["n-orphan"] {
+		t.Errorf("expected the orphaned networks to be removed")
+	}
+	if !host.networks["n-shared"] || !host.networks["n-other"] {
+		t.Errorf("expected the networks in use or not created by the API to be kept")
+	}
+	if host.vms["kali-crashed"] || !host.vms["kali-live"] || !host.vms["other-vm"] {
+		t.Errorf("expected only the orphaned VM to be removed, got %v", keys(host.vms))
+	}
+
+	//Only the lab on the worker is left in the state file
+	restarted, err := newReconciler(ReconcilerConfig{StateFile: state}, host, w)
+	if err != nil {
+		t.Fatalf("unexpected error reading the state file: %v", err)
+	}
+	if len(restarted.labs) != 1 || restarted.labs[live] == nil {
+		t.Fatalf("expected only the live lab to be tracked, got %v", restarted.labs)
+	}
+}
+
+func TestReconcilerTracksLabChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reconciler")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	state := filepath.Join(dir, "resources.json")
+
+	host := &fakeResourceHost{containers: map[string][]string{}, networks: map[string]bool{}, vms: map[string]bool{}}
+	w := newWorker("local", nil, 0, "10.0.0.1", nil)
+	rc, err := newReconciler(ReconcilerConfig{StateFile: state, Grace: time.Millisecond}, host, w)
+	if err != nil {
+		t.Fatalf("unexpected error creating the reconciler: %v", err)
+	}
+	w.resources = rc
+
+	newLab := func() *testLab {
+		l := &testLab{
+			host:     host,
+			starting: map[string][]string{"c-start": {"n-lab"}},
+			started:  make(chan struct{}),
+			release:  make(chan error, 1),
+		}
+		w.newLab = func(context.Context, hlab.Config) (hlab.Lab, error) { return l, nil }
+		return l
+	}
+	tracked := func(id string) labResources {
+		restarted, err := newReconciler(ReconcilerConfig{StateFile: state}, host, w)
+		if err != nil {
+			t.Fatalf("unexpected error reading the state file: %v", err)
+		}
+		if restarted.labs[id] == nil {
+			return labResources{}
+		}
+		return *restarted.labs[id]
+	}
+
+	//A lab starting for longer than the grace period is never orphaned, and is in the state file
+	//before its resources are created
+	lab := newLab()
+	created := make(chan string, 1)
+	go func() {
+		id, _, _, _ := w.createLab(context.Background(), labSpec{})
+		created <- id
+	}()
+	<-lab.started
+	time.Sleep(5 * time.Millisecond)
+	if r := rc.Run(false); len(r.Orphans) != 0 {
+		t.Fatalf("expected the lab being created to be left alone, got %+v", r.Orphans)
+	}
+	rc.m.Lock()
+	var starting string
+	for id, r := range rc.labs {
+		if r.Starting {
+			starting = id
+		}
+	}
+	rc.m.Unlock()
+	if res := tracked(starting); !res.Starting {
+		t.Fatalf("expected the lab to be recorded while it is created, got %+v", res)
+	}
+	lab.release <- nil
+	id := <-created
+
+	//The containers created again by a restart are tracked, the old ones are kept
+	l, err := w.lab(id)
+	if err != nil {
+		t.Fatalf("expected the lab on the worker: %v", err)
+	}
+	if err := l.Restart(context.Background()); err != nil {
+		t.Fatalf("unexpected error restarting the lab: %v", err)
+	}
+	res := tracked(id)
+	if res.Starting || !containsString(res.Containers, "c-start") || !containsString(res.Containers, "c-start-restart-1") || !containsString(res.Networks, "n-lab") {
+		t.Fatalf("expected the resources of the restarted lab to be tracked, got %+v", res)
+	}
+
+	//The API crashed: the lab is neither closed nor in use anymore
+	w.m.Lock()
+	delete(w.labs, id)
+	w.m.Unlock()
+	r := rc.Run(false)
+	if len(r.Orphans) != 1 || len(r.Errors) != 0 {
+		t.Fatalf("expected the lab to be orphaned, got %+v", r)
+	}
+	if _, ok := host.containers["c-start-restart-1"]; ok || host.networks["n-lab"] {
+		t.Errorf("expected the resources of the restarted lab to be removed")
+	}
+
+	//The resources created by a lab failing to start are tracked until they are gone
+	lab = newLab()
+	lab.release <- errors.New("start failed")
+	if _, _, _, err := w.createLab(context.Background(), labSpec{}); err == nil {
+		t.Fatalf("expected the lab to fail")
+	}
+	rc.m.Lock()
+	var failed string
+	for id, r := range rc.labs {
+		if containsString(r.Containers, "c-start") {
+			failed = id
+		}
+	}
+	rc.m.Unlock()
+	if failed == "" {
+		t.Fatalf("expected the resources of the failed lab to be tracked")
+	}
+	time.Sleep(5 * time.Millisecond)
+	rc.Run(false)
+	if res := tracked(failed); res.Lab != "" {
+		t.Errorf("expected the failed lab to be dropped once its resources are gone, got %+v", res)
+	}
+}
+
+func TestReconcilerInterruptedCreation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reconciler")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	state := filepath.Join(dir, "resources.json")
+
+	now := time.Now()
+	host := &fakeResourceHost{
+		containers: map[string][]string{
+			"c-interrupted": {"n-interrupted"},
+			"c-before":      {"n-before"},
+			"c-tracked":     {"n-tracked"},
+			"c-unlabelled":  {},
+		},
+		created: map[string]time.Time{
+			"c-interrupted": now.Add(-30 * time.Minute),
+			"c-before":      now.Add(-2 * time.Hour),
+			"c-tracked":     now.Add(-30 * time.Minute),
+		},
+		networks: map[string]bool{"n-interrupted": true, "n-before": true, "n-tracked": true},
+		vms:      map[string]bool{},
+	}
+
+	//The previous run stopped while a lab was created, another one is still on the host
+	raw, _ := json.Marshal(map[string]labResources{
+		"interrupted": {Lab: "interrupted", Created: now.Add(-time.Hour), Starting: true},
+		"running":     {Lab: "running", Created: now.Add(-time.Hour), Containers: []string{"c-tracked"}, Networks: []string{"n-tracked"}},
+	})
+	if err := ioutil.WriteFile(state, raw, 0600); err != nil {
+		t.Fatalf("unable to write state file: %v", err)
+	}
+	w := newWorker("local", nil, 0, "10.0.0.1", nil)
+	rc, err := newReconciler(ReconcilerConfig{StateFile: state}, host, w)
+	if err != nil {
+		t.Fatalf("unexpected error creating the reconciler: %v", err)
+	}
+	w.labs["running"] = &localLab{id: "running"}
+
+	//A lab of this run is being created: the containers it creates are not claimed
+	w.resources = rc
+	rc.Begin("creating")
+	defer rc.Done("creating")
+	host.containers["c-new"] = []string{"n-new"}
+	host.created["c-new"] = time.Now().Add(time.Second)
+
+	r := rc.Run(false)
+	if len(r.Orphans) != 1 || r.Orphans[0].Lab != "interrupted" || len(r.Errors) != 0 {
+		t.Fatalf("expected the interrupted lab to be orphaned, got %+v", r)
+	}
+	if c := r.Orphans[0].Containers; len(c) != 1 || c[0] != "c-interrupted" {
+		t.Errorf("expected the container created while the lab was created, got %v", c)
+	}
+	for _, c := range []string{"c-before", "c-tracked", "c-unlabelled", "c-new"} {
+		if _, ok := host.containers[c]; !ok {
+			t.Errorf("expected container %s to be kept", c)
+		}
+	}
+	if _, ok := host.containers["c-interrupted"]; ok || host.networks["n-interrupted"] {
+		t.Errorf("expected the resources of the interrupted lab to be removed")
+	}
+	if !host.networks["n-before"] || !host.networks["n-tracked"] {
+		t.Errorf("expected the other networks to be kept")
+	}
+}
@@ -0,0 +1,255 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	recordingsAdminPath   = "/admin/recordings/"
+	recordingsPruneTicker = time.Hour
+)
+
+var ErrRecordingNotFound = errors.New("recording not found")
+
+// recordingStore keeps the guacamole session recordings, organised as
+// `<dir>/<client>/<client request>/<recording>`
+type recordingStore struct {
+	conf RecordingsConfig
+	sets challengeSets
+
+	stop chan struct{}
+	once sync.Once
+}
+
+type recording struct {
+	Client   string    `json:"client"`
+	Request  string    `json:"request"`
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+func newRecordingStore(conf RecordingsConfig) (*recordingStore, error) {
+	if err := os.MkdirAll(conf.Dir, 0750); err != nil {
+		return nil, err
+	}
+
+	return &recordingStore{
+		conf: conf,
+		sets: newChallengeSets(conf.ChallengeSets),
+		stop: make(chan struct{}),
+	}, nil
+}
+
+// Records tells if the labs of the given challenges are recorded
+func (rs *recordingStore) Records(chals string) bool {
+	return rs != nil && rs.sets.Match(chals)
+}
+
+// Guacamole parameters enabling the recording of an RDP connection, num is the
+// number of the connection within the lab
+func (rs *recordingStore) connParameters(clientID, requestID string, num int) map[string]string {
+	return map[string]string{
+		"recording-path":        path.Join(rs.conf.GuacdDir, clientID, requestID),
+		"create-recording-path": "true",
+		"recording-name":        fmt.Sprintf("client%d-${GUAC_DATE}-${GUAC_TIME}", num),
+	}
+}
+
+// List the recordings, filtered by client and client request when they are not empty
+func (rs *recordingStore) List(clientID, requestID string) ([]recording, error) {
+	recs := []recording{}
+	err := rs.walk(func(rec recording, _ string) {
+		if clientID != "" && rec.Client != clientID {
+			return
+		}
+		if requestID != "" && rec.Request != requestID {
+			return
+		}
+		recs = append(recs, rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Modified.Before(recs[j].Modified) })
+	return recs, nil
+}
+
+// Path of a recording on disk, the names are checked so that nothing outside the
+// recordings directory can be reached
+func (rs *recordingStore) Path(clientID, requestID, name string) (string, error) {
+	for _, s := range []string{clientID, requestID, name} {
+		if s == "" || s == "." || s == ".." || strings.ContainsAny(s, `/\`) {
+			return "", ErrRecordingNotFound
+		}
+	}
+
+	p := filepath.Join(rs.conf.Dir, clientID, requestID, name)
+	fi, err := os.Stat(p)
+	if err != nil || !fi.Mode().IsRegular() {
+		return "", ErrRecordingNotFound
+	}
+	return p, nil
+}
+
+// Remove the recordings older than max-age, then the oldest ones until the
+// recordings fit in max-size-mb
+func (rs *recordingStore) Prune() error {
+	type file struct {
+		recording
+		path string
+	}
+
+	var files []file
+	if err := rs.walk(func(rec recording, p string) {
+		files = append(files, file{rec, p})
+	}); err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Modified.Before(files[j].Modified) })
+
+	var total int64
+	for _, f := range files {
+		total += f.Size
+	}
+
+	maxSize := rs.conf.MaxSizeMB * 1024 * 1024
+	for _, f := range files {
+		expired := rs.conf.MaxAge > 0 && time.Since(f.Modified) > rs.conf.MaxAge
+		oversize := maxSize > 0 && total > maxSize
+		if !expired && !oversize {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			log.Error().Str("recording", f.path).Msgf("Error removing recording: %v", err)
+			continue
+		}
+		log.Info().Str("recording", f.path).Msg("Recording removed by the retention policy")
+		total -= f.Size
+		//Remove the request and client directories once they are empty
+		os.Remove(filepath.Dir(f.path))
+		os.Remove(filepath.Dir(filepath.Dir(f.path)))
+	}
+	return nil
+}
+
+func (rs *recordingStore) walk(fn func(recording, string)) error {
+	clients, err := ioutil.ReadDir(rs.conf.Dir)
+	if err != nil {
+		return err
+	}
+	for _, c := range clients {
+		if !c.IsDir() {
+			continue
+		}
+		requests, err := ioutil.ReadDir(filepath.Join(rs.conf.Dir, c.Name()))
+		if err != nil {
+			return err
+		}
+		for _, r := range requests {
+			if !r.IsDir() {
+				continue
+			}
+			dir := filepath.Join(rs.conf.Dir, c.Name(), r.Name())
+			files, err := ioutil.ReadDir(dir)
+			if err != nil {
+				return err
+			}
+			for _, f := range files {
+				if !f.Mode().IsRegular() {
+					continue
+				}
+				fn(recording{
+					Client:   c.Name(),
+					Request:  r.Name(),
+					Name:     f.Name(),
+					Size:     f.Size(),
+					Modified: f.ModTime(),
+				}, filepath.Join(dir, f.Name()))
+			}
+		}
+	}
+	return nil
+}
+
+// Prune the recordings periodically, until the store is closed
+func (rs *recordingStore) pruneLoop() {
+	if rs.conf.MaxAge == 0 && rs.conf.MaxSizeMB == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(recordingsPruneTicker)
+	defer ticker.Stop()
+	for {
+		if err := rs.Prune(); err != nil {
+			log.Error().Msgf("Error pruning recordings: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-rs.stop:
+			return
+		}
+	}
+}
+
+func (rs *recordingStore) Close() error {
+	rs.once.Do(func() { close(rs.stop) })
+	return nil
+}
+
+// Handle the requests made to `/admin/recordings/`, without a path the recordings are listed
+// (filtered by the `client` and `request` query parameters), `/admin/recordings/{client}/{request}/{name}`
+// downloads a recording
+func (lm *LearningMaterialAPI) handleRecordings() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if lm.recordings == nil {
+			writeJSONError(w, http.StatusNotFound, "session recording is not enabled")
+			return
+		}
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		rest := strings.Trim(strings.TrimPrefix(r.URL.Path, recordingsAdminPath), "/")
+		if rest == "" {
+			recs, err := lm.recordings.List(r.URL.Query().Get("client"), r.URL.Query().Get("request"))
+			if err != nil {
+				log.Error().Msgf("Error listing recordings: %v", err)
+				writeJSONError(w, http.StatusInternalServerError, "error listing recordings")
+				return
+			}
+			writeJSON(w, http.StatusOK, recs)
+			return
+		}
+
+		parts := strings.Split(rest, "/")
+		if len(parts) != 3 {
+			writeJSONError(w, http.StatusNotFound, ErrRecordingNotFound.Error())
+			return
+		}
+		p, err := lm.recordings.Path(parts[0], parts[1], parts[2])
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", parts[2]))
+		http.ServeFile(w, r, p)
+	}
+}
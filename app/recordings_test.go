@@ -0,0 +1,126 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestRecordingStore(t *testing.T, conf RecordingsConfig) (*recordingStore, func()) {
+	dir, err := ioutil.TempDir("", "recordings")
+	if err != nil {
+		t.Fatalf("unable to create recordings dir: %v", err)
+	}
+	conf.Dir, conf.GuacdDir = dir, "/recordings"
+
+	rs, err := newRecordingStore(conf)
+	if err != nil {
+		t.Fatalf("unable to create recording store: %v", err)
+	}
+	return rs, func() {
+		rs.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func writeRecording(t *testing.T, rs *recordingStore, client, request, name string, size int, modified time.Time) {
+	dir := filepath.Join(rs.conf.Dir, client, request)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		t.Fatalf("unable to create recording dir: %v", err)
+	}
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, make([]byte, size), 0640); err != nil {
+		t.Fatalf("unable to write recording: %v", err)
+	}
+	if err := os.Chtimes(p, modified, modified); err != nil {
+		t.Fatalf("unable to set recording time: %v", err)
+	}
+}
+
+func TestRecordingsChallengeSets(t *testing.T) {
+	rs, cleanup := newTestRecordingStore(t, RecordingsConfig{ChallengeSets: []string{"ftp, SQL", "xss"}})
+	defer cleanup()
+
+	tt := []struct {
+		chals  string
+		record bool
+	}{
+		{"ftp,sql", true},
+		{"sql,ftp", true},
+		{"xss", true},
+		{"ftp", false},
+		{"ftp,sql,xss", false},
+	}
+	for _, tc := range tt {
+		if got := rs.Records(tc.chals); got != tc.record {
+			t.Errorf("Records(%q) = %v, expected %v", tc.chals, got, tc.record)
+		}
+	}
+
+	var disabled *recordingStore
+	if disabled.Records("ftp") {
+		t.Errorf("expected no recording when recordings are disabled")
+	}
+
+	params := rs.connParameters("client", "request", 2)
+	if params["recording-path"] != "/recordings/client/request" {
+		t.Errorf("unexpected recording path: %s", params["recording-path"])
+	}
+}
+
+func TestRecordingsListAndPath(t *testing.T) {
+	rs, cleanup := newTestRecordingStore(t, RecordingsConfig{})
+	defer cleanup()
+
+	now := time.Now()
+	writeRecording(t, rs, "c1", "r1", "client1-a", 10, now.Add(-time.Minute))
+	writeRecording(t, rs, "c1", "r2", "client1-b", 10, now)
+	writeRecording(t, rs, "c2", "r3", "client1-c", 10, now)
+
+	recs, err := rs.List("c1", "")
+	if err != nil {
+		t.Fatalf("unexpected error listing recordings: %v", err)
+	}
+	if len(recs) != 2 || recs[0].Name != "client1-a" {
+		t.Fatalf("unexpected recordings of client c1: %+v", recs)
+	}
+
+	recs, _ = rs.List("", "r3")
+	if len(recs) != 1 || recs[0].Client != "c2" {
+		t.Fatalf("unexpected recordings of request r3: %+v", recs)
+	}
+
+	if _, err := rs.Path("c1", "r1", "client1-a"); err != nil {
+		t.Errorf("expected recording to be found: %v", err)
+	}
+	for _, p := range [][3]string{{"c1", "..", "client1-a"}, {"c1", "r1", "../r2"}, {"c1", "r1", "missing"}} {
+		if _, err := rs.Path(p[0], p[1], p[2]); err != ErrRecordingNotFound {
+			t.Errorf("expected %v to be rejected, got %v", p, err)
+		}
+	}
+}
+
+func TestRecordingsPrune(t *testing.T) {
+	rs, cleanup := newTestRecordingStore(t, RecordingsConfig{MaxAge: time.Hour, MaxSizeMB: 1})
+	defer cleanup()
+
+	now := time.Now()
+	mb := 1024 * 1024
+	writeRecording(t, rs, "c1", "r1", "expired", 10, now.Add(-2*time.Hour))
+	writeRecording(t, rs, "c1", "r2", "oldest", mb/2, now.Add(-30*time.Minute))
+	writeRecording(t, rs, "c2", "r3", "newest", mb/2+1, now)
+
+	if err := rs.Prune(); err != nil {
+		t.Fatalf("unexpected error pruning recordings: %v", err)
+	}
+
+	recs, _ := rs.List("", "")
+	if len(recs) != 1 || recs[0].Name != "newest" {
+		t.Fatalf("expected only the newest recording to be kept: %+v", recs)
+	}
+	if _, err := os.Stat(filepath.Join(rs.conf.Dir, "c1")); !os.IsNotExist(err) {
+		t.Errorf("expected the empty client directory to be removed")
+	}
+}
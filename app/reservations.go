@@ -0,0 +1,431 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	reservationsAdminPath = "/admin/reservations/"
+	reservationCodeParam  = "code"
+	reservationPrewarm    = 10 * time.Minute
+	reservationTicker     = 30 * time.Second
+	reservationCodeChars  = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	reservationCodeLength = 8
+
+	errorReservationCode = "The access code is not valid for these challenges at this time"
+	errorReservationFull = "All the labs of the class are in use"
+)
+
+var (
+	ErrReservationNotFound = errors.New("reservation not found")
+	ErrReservationFull     = errors.New("all the labs of the reservation are in use")
+)
+
+type reservationKey struct{}
+
+// reservation books labs of a challenge set for a class, the students get them with the access code
+type reservation struct {
+	ID         string    `json:"id"`
+	Challenges string    `json:"challenges"`
+	Labs       int       `json:"labs"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Code       string    `json:"code"`
+
+	sets      challengeSets
+	prewarmed bool
+	warm      []Environment
+	redeemed  map[string]bool //clients which got a lab of the reservation
+}
+
+// reservationStore keeps the reservations, it pre-warms their labs shortly before they start
+// and reclaims them once they are over
+type reservationStore struct {
+	m            sync.Mutex
+	reservations map[string]*reservation
+	prewarmLead  time.Duration
+	newEnv       func(chals string) (Environment, error)
+	stop         chan struct{}
+	once         sync.Once
+}
+
+func newReservationStore(prewarmLead time.Duration, newEnv func(chals string) (Environment, error)) *reservationStore {
+	if prewarmLead == 0 {
+		prewarmLead = reservationPrewarm
+	}
+	return &reservationStore{
+		reservations: map[string]*reservation{},
+		prewarmLead:  prewarmLead,
+		newEnv:       newEnv,
+		stop:         make(chan struct{}),
+	}
+}
+
+func reservationCode() (string, error) {
+	code := make([]byte, reservationCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(reservationCodeChars))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = reservationCodeChars[n.Int64()]
+	}
+	return string(code), nil
+}
+
+func (rs *reservationStore) Add(chals string, labs int, start, end time.Time) (*reservation, error) {
+	code, err := reservationCode()
+	if err != nil {
+		return nil, err
+	}
+	r := &reservation{
+		ID:         uuid.New().String(),
+		Challenges: chals,
+		Labs:       labs,
+		Start:      start,
+		End:        end,
+		Code:       code,
+		sets:       newChallengeSets([]string{chals}),
+		redeemed:   map[string]bool{},
+	}
+
+	rs.m.Lock()
+	defer rs.m.Unlock()
+	rs.reservations[r.ID] = r
+	return r, nil
+}
+
+// Remove a reservation, its labs not handed out yet are closed
+func (rs *reservationStore) Remove(id string) error {
+	rs.m.Lock()
+	r, ok := rs.reservations[id]
+	delete(rs.reservations, id)
+	var warm []Environment
+	if ok {
+		warm, r.warm = r.warm, nil
+	}
+	rs.m.Unlock()
+
+	if !ok {
+		return ErrReservationNotFound
+	}
+	closeEnvironments(warm)
+	return nil
+}
+
+func closeEnvironments(envs []Environment) {
+	for _, env := range envs {
+		if err := env.Close(); err != nil {
+			log.Error().Msgf("Error closing pre-warmed environment: %v", err)
+		}
+	}
+}
+
+// The window of a reservation starts when its labs are pre-warmed
+func (rs *reservationStore) inWindow(r *reservation, now time.Time) bool {
+	return !now.Before(r.Start.Add(-rs.prewarmLead)) && now.Before(r.End)
+}
+
+// Number of labs held back from the other users for the reservations in their window
+func (rs *reservationStore) HeldBack() int {
+	if rs == nil {
+		return 0
+	}
+	rs.m.Lock()
+	defer rs.m.Unlock()
+
+	var held int
+	now := time.Now()
+	for _, r := range rs.reservations {
+		if rs.inWindow(r, now) && len(r.redeemed) < r.Labs {
+			held += r.Labs - len(r.redeemed)
+		}
+	}
+	return held
+}
+
+// Find the reservation of an access code for the given challenges, it has to be in its window
+func (rs *reservationStore) Find(code, chals string) (*reservation, bool) {
+	if rs == nil || code == "" {
+		return nil, false
+	}
+	rs.m.Lock()
+	defer rs.m.Unlock()
+
+	now := time.Now()
+	for _, r := range rs.reservations {
+		if strings.EqualFold(r.Code, code) && r.sets.Match(chals) && rs.inWindow(r, now) {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// Redeem a lab of the reservation for the client, a pre-warmed environment is returned when there
+// is one left. A client redeeming again uses the same slot
+func (rs *reservationStore) Redeem(r *reservation, clientID string) (Environment, error) {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+
+	if !r.redeemed[clientID] && len(r.redeemed) >= r.Labs {
+		return nil, ErrReservationFull
+	}
+	r.redeemed[clientID] = true
+
+	if len(r.warm) == 0 {
+		return nil, nil
+	}
+	env := r.warm[0]
+	r.warm = r.warm[1:]
+	return env, nil
+}
+
+// Whether the reservation has a slot for the client
+func (rs *reservationStore) HasRoom(r *reservation, clientID string) bool {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+	return r.redeemed[clientID] || len(r.redeemed) < r.Labs
+}
+
+// Pre-warm the labs of the reservations about to start and reclaim the reservations which are over
+func (rs *reservationStore) tick(now time.Time) {
+	rs.m.Lock()
+	var prewarm []*reservation
+	var expired []*reservation
+	for id, r := range rs.reservations {
+		switch {
+		case !now.Before(r.End):
+			delete(rs.reservations, id)
+			expired = append(expired, r)
+		case rs.inWindow(r, now) && !r.prewarmed:
+			r.prewarmed = true
+			prewarm = append(prewarm, r)
+		}
+	}
+	var warm []Environment
+	for _, r := range expired {
+		warm = append(warm, r.warm...)
+		r.warm = nil
+	}
+	rs.m.Unlock()
+
+	for _, r := range expired {
+		log.Info().Str("reservation", r.ID).Int("redeemed", len(r.redeemed)).Msg("Reservation is over")
+	}
+	closeEnvironments(warm)
+
+	for _, r := range prewarm {
+		go rs.prewarm(r)
+	}
+}
+
+func (rs *reservationStore) prewarm(r *reservation) {
+	log.Info().Str("reservation", r.ID).Int("labs", r.Labs).Msg("Pre-warming the labs of the reservation")
+	for i := 0; i < r.Labs; i++ {
+		env, err := rs.newEnv(r.Challenges)
+		if err != nil {
+			log.Error().Str("reservation", r.ID).Msgf("Error pre-warming a lab: %v", err)
+			continue
+		}
+
+		rs.m.Lock()
+		_, active := rs.reservations[r.ID]
+		full := len(r.redeemed)+len(r.warm) >= r.Labs
+		if active && !full {
+			r.warm = append(r.warm, env)
+		}
+		rs.m.Unlock()
+
+		if !active || full {
+			closeEnvironments([]Environment{env})
+			return
+		}
+	}
+}
+
+func (rs *reservationStore) loop() {
+	ticker := time.NewTicker(reservationTicker)
+	defer ticker.Stop()
+	for {
+		rs.tick(time.Now())
+		select {
+		case <-ticker.C:
+		case <-rs.stop:
+			return
+		}
+	}
+}
+
+// Close the pre-warmed environments of all the reservations
+func (rs *reservationStore) Close() error {
+	rs.once.Do(func() { close(rs.stop) })
+
+	rs.m.Lock()
+	var warm []Environment
+	for _, r := range rs.reservations {
+		warm = append(warm, r.warm...)
+		r.warm = nil
+	}
+	rs.m.Unlock()
+
+	closeEnvironments(warm)
+	return nil
+}
+
+// Pre-warmed environments of all the reservations
+func (rs *reservationStore) Environments() []Environment {
+	if rs == nil {
+		return nil
+	}
+	rs.m.Lock()
+	defer rs.m.Unlock()
+
+	var envs []Environment
+	for _, r := range rs.reservations {
+		envs = append(envs, r.warm...)
+	}
+	return envs
+}
+
+type reservationStatus struct {
+	*reservation
+	Warm     int `json:"warm"`
+	Redeemed int `json:"redeemed"`
+}
+
+func (rs *reservationStore) List() []reservationStatus {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+
+	list := make([]reservationStatus, 0, len(rs.reservations))
+	for _, r := range rs.reservations {
+		list = append(list, reservationStatus{reservation: r, Warm: len(r.warm), Redeemed: len(r.redeemed)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+	return list
+}
+
+// Create an environment for the client, the environments of the reservation in the request
+// context come from its pre-warmed labs
+func (lm *LearningMaterialAPI) createEnvironmentFor(r *http.Request, client Client, chals string) *ClientRequest {
+	res, ok := r.Context().Value(reservationKey{}).(*reservation)
+	if !ok {
+		return lm.CreateEnvironment(client, chals)
+	}
+
+	env, err := lm.reservations.Redeem(res, client.ID())
+	cr := client.NewClientRequest(chals)
+	if err != nil {
+		cr.NewError(err)
+		return cr
+	}
+	log.Info().Str("reservation", res.ID).Str("client", client.ID()).Bool("prewarmed", env != nil).Msg("Lab of a reservation redeemed")
+	if env == nil {
+		go lm.provisionEnvironment(client, cr, chals)
+		return cr
+	}
+	env.Renew()
+	go func() {
+		if err := lm.startEnvironment(client, cr, chals, env); err != nil {
+			cr.NewError(err)
+		}
+	}()
+	return cr
+}
+
+// Handle the requests made to `/admin/reservations/`: `GET` lists the reservations, `POST` books
+// labs with the body `{"challenges": "ftp,sql", "labs": 60, "start": "...", "end": "..."}` and
+// `DELETE /admin/reservations/{id}` removes a reservation
+func (lm *LearningMaterialAPI) handleReservations() http.HandlerFunc {
+
+	type reservationRequest struct {
+		Challenges string    `json:"challenges"`
+		Labs       int       `json:"labs"`
+		Start      time.Time `json:"start"`
+		End        time.Time `json:"end"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, _, _ := r.BasicAuth()
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, reservationsAdminPath), "/")
+
+		switch {
+		case r.Method == http.MethodGet && id == "":
+			writeJSON(w, http.StatusOK, lm.reservations.List())
+
+		case r.Method == http.MethodPost && id == "":
+			var req reservationRequest
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			if req.Labs <= 0 || req.Labs > lm.conf.API.TotalMaxRequest {
+				writeJSONError(w, http.StatusBadRequest, "labs must be between 1 and total-max-requests")
+				return
+			}
+			if !req.End.After(req.Start) || !req.End.After(time.Now()) {
+				writeJSONError(w, http.StatusBadRequest, "the reservation must end after it starts and in the future")
+				return
+			}
+			if _, _, err := lm.GetChallengesFromRequest(req.Challenges); err != nil || req.Challenges == "" {
+				writeJSONError(w, http.StatusBadRequest, errorChallengesTag)
+				return
+			}
+
+			res, err := lm.reservations.Add(req.Challenges, req.Labs, req.Start, req.End)
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, "error creating the reservation")
+				return
+			}
+			lm.audit.Record(auditEvent{
+				Action: auditReservationCreated,
+				Actor:  "admin:" + admin,
+				Details: map[string]string{
+					"reservation": res.ID,
+					"challenges":  res.Challenges,
+					"labs":        strconv.Itoa(res.Labs),
+					"start":       res.Start.Format(time.RFC3339),
+					"end":         res.End.Format(time.RFC3339),
+				},
+			})
+			writeJSON(w, http.StatusCreated, res)
+
+		case r.Method == http.MethodDelete && id != "":
+			if err := lm.reservations.Remove(id); err != nil {
+				writeJSONError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			lm.audit.Record(auditEvent{
+				Action:  auditReservationRemoved,
+				Actor:   "admin:" + admin,
+				Details: map[string]string{"reservation": id},
+			})
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// Create an environment with the challenges of a reservation, not assigned to any client yet
+func (lm *LearningMaterialAPI) newReservedEnvironment(chals string) (Environment, error) {
+	tags, sTags, err := lm.GetChallengesFromRequest(chals)
+	if err != nil {
+		return nil, err
+	}
+	return lm.NewEnvironment(tags, sTags)
+}
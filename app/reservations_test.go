@@ -0,0 +1,107 @@
+package app
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type reservedEnvironment struct {
+	Environment
+	m      sync.Mutex
+	closed bool
+}
+
+func (e *reservedEnvironment) Close() error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.closed = true
+	return nil
+}
+
+func (e *reservedEnvironment) isClosed() bool {
+	e.m.Lock()
+	defer e.m.Unlock()
+	return e.closed
+}
+
+func TestReservations(t *testing.T) {
+	created := make(chan *reservedEnvironment, 10)
+	rs := newReservationStore(10*time.Minute, func(chals string) (Environment, error) {
+		env := &reservedEnvironment{}
+		created <- env
+		return env, nil
+	})
+
+	now := time.Now()
+	later, err := rs.Add("ftp,sql", 2, now.Add(time.Hour), now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error adding a reservation: %v", err)
+	}
+	res, _ := rs.Add("ftp,sql", 2, now.Add(5*time.Minute), now.Add(time.Hour))
+	if len(res.Code) != reservationCodeLength || res.Code == later.Code {
+		t.Fatalf("expected a distinct access code of %d characters, got %s", reservationCodeLength, res.Code)
+	}
+
+	//Only the reservation about to start holds labs back
+	if held := rs.HeldBack(); held != 2 {
+		t.Fatalf("expected 2 labs held back, got %d", held)
+	}
+	if _, ok := rs.Find(later.Code, "ftp,sql"); ok {
+		t.Errorf("expected the code of a reservation not started yet to be refused")
+	}
+	if _, ok := rs.Find(res.Code, "ftp"); ok {
+		t.Errorf("expected the code to be refused for other challenges")
+	}
+	if r, ok := rs.Find(res.Code, "sql,ftp"); !ok || r != res {
+		t.Fatalf("expected the code to be accepted for its challenges")
+	}
+
+	rs.tick(now)
+	warm := []*reservedEnvironment{<-created, <-created}
+	for rs.List()[0].Warm != 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	env, err := rs.Redeem(res, "client-1")
+	if err != nil || env != warm[0] {
+		t.Fatalf("expected the first pre-warmed lab, got %v (%v)", env, err)
+	}
+	if _, err := rs.Redeem(res, "client-1"); err != nil {
+		t.Fatalf("expected the client to redeem its own slot again: %v", err)
+	}
+	if held := rs.HeldBack(); held != 1 {
+		t.Fatalf("expected 1 lab held back after a redemption, got %d", held)
+	}
+	if _, err := rs.Redeem(res, "client-2"); err != nil {
+		t.Fatalf("unexpected error redeeming the second lab: %v", err)
+	}
+	if rs.HasRoom(res, "client-3") {
+		t.Errorf("expected no room left in the reservation")
+	}
+	if _, err := rs.Redeem(res, "client-3"); err != ErrReservationFull {
+		t.Fatalf("expected %v, got %v", ErrReservationFull, err)
+	}
+
+	//The labs not handed out are closed once the reservation is over
+	rs.tick(now.Add(time.Hour))
+	unused := []*reservedEnvironment{<-created, <-created}
+	for len(rs.List()) != 1 || rs.List()[0].Warm != 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	rs.tick(now.Add(2 * time.Hour))
+	if len(rs.List()) != 0 {
+		t.Fatalf("expected the reservations to be reclaimed")
+	}
+	if warm[0].isClosed() {
+		t.Errorf("expected a redeemed lab to be left to its client")
+	}
+	for _, env := range unused {
+		if !env.isClosed() {
+			t.Errorf("expected the unused pre-warmed labs to be closed")
+		}
+	}
+	if err := rs.Remove(later.ID); err != ErrReservationNotFound {
+		t.Errorf("expected %v, got %v", ErrReservationNotFound, err)
+	}
+}
@@ -0,0 +1,99 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	resetAdminPath = "/admin/reset/"
+	resetTimeout   = 10 * time.Minute
+)
+
+// Reset an exercise of the lab of the client request, or the whole lab when no exercise is given.
+// The client request, its guacamole user and the session cookie are kept, only the containers
+// (and the frontends for the whole lab) are restarted. The reset is recorded in the audit log, failed
+// or not. It is not bound to the request asking for it: a lab half restarted because the user went
+// away would be left broken
+func (lm *LearningMaterialAPI) resetLab(cr *ClientRequest, exercise string, force bool, event auditEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), resetTimeout)
+	defer cancel()
+
+	left, err := cr.env.Reset(ctx, exercise, force)
+	if err == ErrMaxResets || err == ErrUnknownExercise {
+		return err
+	}
+
+	if event.Details == nil {
+		event.Details = map[string]string{}
+	}
+	event.Action = auditLabRestarted
+	if exercise != "" {
+		event.Action = auditExerciseReset
+		event.Details["exercise"] = exercise
+	}
+	if err != nil {
+		log.Error().Str("request", cr.ID()).Str("exercise", exercise).Msgf("Error resetting the lab: %v", err)
+		event.Action = auditLabResetFailed
+		event.Details["error"] = err.Error()
+		lm.audit.Record(event)
+		return err
+	}
+	event.Details["resets_left"] = strconv.Itoa(left)
+	lm.audit.Record(event)
+	return nil
+}
+
+// Handle the requests made to `/admin/reset/{request}`, it resets the exercise in `?exercise=`
+// or the whole lab of a client request. Admin resets don't count against the reset budget
+func (lm *LearningMaterialAPI) handleReset() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		client, cr, err := lm.ClientRequestStore.GetClientRequestByID(strings.Trim(strings.TrimPrefix(r.URL.Path, resetAdminPath), "/"))
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if !cr.isReady || cr.env == nil {
+			writeJSONError(w, http.StatusConflict, "the lab is not ready yet")
+			return
+		}
+
+		admin, _, _ := r.BasicAuth()
+		exercise := r.URL.Query().Get("exercise")
+		err = lm.resetLab(cr, exercise, true, auditEvent{
+			Actor:   "admin:" + admin,
+			Client:  client.ID(),
+			Request: cr.ID(),
+			Details: map[string]string{
+				"identity":   client.Identity(),
+				"challenges": cr.Challenges(),
+			},
+		})
+		switch err {
+		case nil:
+		case ErrUnknownExercise:
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		default:
+			writeJSONError(w, http.StatusBadGateway, "error resetting the lab")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"request":     cr.ID(),
+			"exercise":    exercise,
+			"resets_left": cr.env.ResetsLeft(),
+		})
+	}
+}
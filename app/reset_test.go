@@ -0,0 +1,73 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aau-network-security/haaukins/store"
+)
+
+func TestResetLab(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reset")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	audit, err := newAuditLog(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatalf("unable to create the audit log: %v", err)
+	}
+	defer audit.Close()
+
+	lm := &LearningMaterialAPI{
+		conf:               &Config{API: APIConfig{SignKey: "test-key"}},
+		ClientRequestStore: NewClientRequestStore(),
+		audit:              audit,
+	}
+	client := lm.ClientRequestStore.NewClient("127.0.0.1")
+	cr := client.NewClientRequest("ftp")
+	lab := &testLab{}
+	cr.env = &environment{
+		timer:      time.NewTimer(environmentTimer),
+		expires:    time.Now().Add(environmentTimer),
+		maxResets:  1,
+		challenges: []store.Tag{"ftp"},
+		lab:        &localLab{lab: lab},
+	}
+	cr.isReady = true
+
+	reset := func() int {
+		//The user went away before the lab was restarted
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		r := httptest.NewRequest(http.MethodPost, resetAdminPath+cr.ID(), nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		lm.handleReset()(w, r)
+		return w.Code
+	}
+
+	if code := reset(); code != http.StatusOK || lab.restarts != 1 {
+		t.Fatalf("expected the lab to be restarted, got %d with %d restarts", code, lab.restarts)
+	}
+	lab.restartErr = errors.New("docker unavailable")
+	if code := reset(); code != http.StatusBadGateway {
+		t.Fatalf("expected the reset to fail, got %d", code)
+	}
+
+	raw, _ := ioutil.ReadFile(filepath.Join(dir, "audit.log"))
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], auditLabRestarted) {
+		t.Fatalf("expected the restart and the failed reset to be audited, got %q", raw)
+	}
+	if !strings.Contains(lines[1], auditLabResetFailed) || !strings.Contains(lines[1], "docker unavailable") {
+		t.Errorf("expected the failed reset to be audited with its error, got %q", lines[1])
+	}
+}
@@ -0,0 +1,423 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aau-network-security/haaukins/store"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	workerServiceName     = "haaukins.api.LabWorker"
+	workerAuthMetadata    = "authorization"
+	workerCapacityTimeout = 5 * time.Second
+	workerLabLease        = 2 * time.Minute //a remote lab not renewed for this long is closed by its worker
+	workerLeaseRenewal    = workerLabLease / 4
+)
+
+var (
+	ErrNoWorker    = errors.New("no worker has room for the lab")
+	ErrWorkerNoTLS = errors.New("the auth key of the worker is sent only over tls, enable it")
+)
+
+// labWorker is a host the scheduler can run labs on
+type labWorker interface {
+	Name() string
+	Capacity(context.Context) (workerCapacity, error)
+	CreateLab(context.Context, labSpec) (workerLab, string, error)
+}
+
+// labScheduler spreads the labs over the workers, each lab goes to the worker with the most room
+type labScheduler struct {
+	workers []labWorker
+}
+
+type workerStatus struct {
+	Name     string         `json:"name"`
+	Capacity workerCapacity `json:"capacity"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// Capacity of each worker, the workers which can't be reached report an error
+func (s *labScheduler) Status(ctx context.Context) []workerStatus {
+	ctx, cancel := context.WithTimeout(ctx, workerCapacityTimeout)
+	defer cancel()
+
+	statuses := make([]workerStatus, len(s.workers))
+	var wg sync.WaitGroup
+	for i, w := range s.workers {
+		wg.Add(1)
+		go func(i int, w labWorker) {
+			defer wg.Done()
+			c, err := w.Capacity(ctx)
+			statuses[i] = workerStatus{Name: w.Name(), Capacity: c}
+			if err != nil {
+				statuses[i].Error = err.Error()
+			}
+		}(i, w)
+	}
+	wg.Wait()
+	return statuses
+}
+
+// Create a lab on the worker with the most room, the next workers are tried when a worker is full
+func (s *labScheduler) CreateLab(ctx context.Context, spec labSpec) (workerLab, string, error) {
+	statuses := s.Status(ctx)
+	order := make([]int, 0, len(statuses))
+	for i, st := range statuses {
+		if st.Error != "" {
+			log.Warn().Str("worker", st.Name).Msgf("Worker not reachable: %s", st.Error)
+			continue
+		}
+		if st.Capacity.free() == 0 {
+			continue
+		}
+		order = append(order, i)
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := statuses[order[i]].Capacity, statuses[order[j]].Capacity
+		if a.free() != b.free() {
+			return a.free() < 0 || (b.free() >= 0 && a.free() > b.free())
+		}
+		return a.FreeMemoryMB > b.FreeMemoryMB
+	})
+
+	for _, i := range order {
+		w := s.workers[i]
+		lab, host, err := w.CreateLab(ctx, spec)
+		if err == nil {
+			log.Info().Str("worker", w.Name()).Msg("Lab scheduled")
+			return lab, host, nil
+		}
+		if err != ErrWorkerFull && status.Code(err) != codes.ResourceExhausted {
+			return nil, "", err
+		}
+	}
+	return nil, "", ErrNoWorker
+}
+
+// List the workers with their capacity, it can be called only through admin priviledges
+func (lm *LearningMaterialAPI) listWorkers() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, lm.scheduler.Status(r.Context()))
+	}
+}
+
+// jsonCodec encodes the messages of the worker service as JSON, so the service
+// needs no generated code
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return "json" }
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+type workerRequest struct {
+	Lab  string   `json:"lab,omitempty"`
+	Tag  string   `json:"tag,omitempty"`
+	Spec *labSpec `json:"spec,omitempty"`
+}
+
+type workerLabInfo struct {
+	Lab      string            `json:"lab"`
+	Host     string            `json:"host"`
+	RdpPorts []uint            `json:"rdp_ports"`
+	Flags    []store.Challenge `json:"flags"`
+}
+
+// Turn the errors of the worker into gRPC status errors, so the scheduler can tell them apart
+func workerStatusError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case ErrWorkerFull, ErrAdmissionQueueFull, ErrAdmissionTimeout:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case ErrLabNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+func workerMethod(name string, call func(context.Context, *worker, *workerRequest) (interface{}, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := &workerRequest{}
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				resp, err := call(ctx, srv.(*worker), req.(*workerRequest))
+				return resp, workerStatusError(err)
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{
+				Server:     srv,
+				FullMethod: "/" + workerServiceName + "/" + name,
+			}, handler)
+		},
+	}
+}
+
+func workerLabRequest(call func(context.Context, *localLab, *workerRequest) (interface{}, error)) func(context.Context, *worker, *workerRequest) (interface{}, error) {
+	return func(ctx context.Context, w *worker, req *workerRequest) (interface{}, error) {
+		l, err := w.lab(req.Lab)
+		if err != nil {
+			return nil, err
+		}
+		return call(ctx, l, req)
+	}
+}
+
+var workerServiceDesc = grpc.ServiceDesc{
+	ServiceName: workerServiceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		workerMethod("Capacity", func(ctx context.Context, w *worker, _ *workerRequest) (interface{}, error) {
+			return w.Capacity(ctx)
+		}),
+		workerMethod("CreateLab", func(ctx context.Context, w *worker, req *workerRequest) (interface{}, error) {
+			if req.Spec == nil {
+				return nil, errors.New("missing lab spec")
+			}
+			id, l, host, err := w.createLab(ctx, *req.Spec)
+			if err != nil {
+				return nil, err
+			}
+			if err := w.renewLease(id, time.Now()); err != nil {
+				return nil, err
+			}
+			return workerLabInfo{Lab: id, Host: host, RdpPorts: l.RdpConnPorts(), Flags: l.Flags()}, nil
+		}),
+		workerMethod("RestartLab", workerLabRequest(func(ctx context.Context, l *localLab, _ *workerRequest) (interface{}, error) {
+			if err := l.Restart(ctx); err != nil {
+				return nil, err
+			}
+			return l.Flags(), nil
+		})),
+		workerMethod("ResetExercise", workerLabRequest(func(ctx context.Context, l *localLab, req *workerRequest) (interface{}, error) {
+			if err := l.ResetExercise(ctx, req.Tag); err != nil {
+				return nil, err
+			}
+			return l.Flags(), nil
+		})),
+		workerMethod("RenewLab", func(_ context.Context, w *worker, req *workerRequest) (interface{}, error) {
+			return struct{}{}, w.renewLease(req.Lab, time.Now())
+		}),
+		workerMethod("CloseLab", workerLabRequest(func(_ context.Context, l *localLab, _ *workerRequest) (interface{}, error) {
+			return struct{}{}, l.Close()
+		})),
+	},
+	Metadata: "haaukins-api/worker",
+}
+
+// workerServer serves the labs of a worker to a scheduler
+type workerServer struct {
+	*grpc.Server
+	stop chan struct{}
+	once *sync.Once
+}
+
+func (s workerServer) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	s.Stop()
+	return nil
+}
+
+// Close the labs of the schedulers which stopped renewing their lease
+func (s workerServer) expireLeases(w *worker) {
+	t := time.NewTicker(workerLeaseRenewal)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-t.C:
+			w.expireLeases(now)
+		}
+	}
+}
+
+// Serve the labs of the worker over gRPC, the scheduler authenticates with the auth key
+func serveWorker(lis net.Listener, w *worker, conf WorkerServerConfig) (workerServer, error) {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			keys := md.Get(workerAuthMetadata)
+			if len(keys) != 1 || subtle.ConstantTimeCompare([]byte(keys[0]), []byte(conf.AuthKey)) != 1 {
+				return nil, status.Error(codes.Unauthenticated, "invalid auth key")
+			}
+			return handler(ctx, req)
+		}),
+	}
+	if !conf.TLS.Enabled {
+		return workerServer{}, ErrWorkerNoTLS
+	}
+	creds, err := credentials.NewServerTLSFromFile(conf.TLS.CertFile, conf.TLS.CertKey)
+	if err != nil {
+		return workerServer{}, err
+	}
+	opts = append(opts, grpc.Creds(creds))
+
+	s := workerServer{Server: grpc.NewServer(opts...), stop: make(chan struct{}), once: &sync.Once{}}
+	s.RegisterService(&workerServiceDesc, w)
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			log.Error().Msgf("Error serving the worker: %v", err)
+		}
+	}()
+	go s.expireLeases(w)
+	return s, nil
+}
+
+// remoteWorker is a worker on another host, reached over gRPC
+type remoteWorker struct {
+	name string
+	conn *grpc.ClientConn
+}
+
+type workerAuth string
+
+func (k workerAuth) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{workerAuthMetadata: string(k)}, nil
+}
+
+// The auth key is never sent in clear
+func (workerAuth) RequireTransportSecurity() bool {
+	return true
+}
+
+func newRemoteWorker(conf WorkerConfig, opts ...grpc.DialOption) (*remoteWorker, error) {
+	if !conf.TLS.Enabled {
+		return nil, ErrWorkerNoTLS
+	}
+	creds, err := credentials.NewClientTLSFromFile(conf.TLS.CAFile, "")
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithPerRPCCredentials(workerAuth(conf.AuthKey)),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(jsonCodec{}.Name())),
+	)
+
+	conn, err := grpc.Dial(conf.Address, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteWorker{name: conf.Name, conn: conn}, nil
+}
+
+func (rw *remoteWorker) call(ctx context.Context, method string, req *workerRequest, resp interface{}) error {
+	return rw.conn.Invoke(ctx, "/"+workerServiceName+"/"+method, req, resp)
+}
+
+func (rw *remoteWorker) Name() string {
+	return rw.name
+}
+
+func (rw *remoteWorker) Capacity(ctx context.Context) (workerCapacity, error) {
+	var c workerCapacity
+	err := rw.call(ctx, "Capacity", &workerRequest{}, &c)
+	return c, err
+}
+
+func (rw *remoteWorker) CreateLab(ctx context.Context, spec labSpec) (workerLab, string, error) {
+	var info workerLabInfo
+	if err := rw.call(ctx, "CreateLab", &workerRequest{Spec: &spec}, &info); err != nil {
+		return nil, "", err
+	}
+	rl := &remoteLab{worker: rw, info: info, stop: make(chan struct{})}
+	go rl.renewLease()
+	return rl, info.Host, nil
+}
+
+func (rw *remoteWorker) Close() error {
+	return rw.conn.Close()
+}
+
+// remoteLab is a lab running on a remote worker, its flags are refreshed whenever it is restarted.
+// Its lease is renewed until it is closed, the worker closes the labs a scheduler leaves behind
+type remoteLab struct {
+	worker *remoteWorker
+	m      sync.Mutex
+	info   workerLabInfo
+	stop   chan struct{}
+	once   sync.Once
+}
+
+func (rl *remoteLab) renewLease() {
+	t := time.NewTicker(workerLeaseRenewal)
+	defer t.Stop()
+	for {
+		select {
+		case <-rl.stop:
+			return
+		case <-t.C:
+			ctx, cancel := context.WithTimeout(context.Background(), workerCapacityTimeout)
+			err := rl.worker.call(ctx, "RenewLab", &workerRequest{Lab: rl.info.Lab}, &struct{}{})
+			cancel()
+			if status.Code(err) == codes.NotFound {
+				log.Warn().Str("worker", rl.worker.name).Str("lab", rl.info.Lab).Msg("Lab gone from the worker")
+				return
+			}
+			if err != nil {
+				log.Warn().Str("worker", rl.worker.name).Str("lab", rl.info.Lab).Msgf("Error renewing the lease of the lab: %v", err)
+			}
+		}
+	}
+}
+
+func (rl *remoteLab) refresh(ctx context.Context, method, tag string) error {
+	var flags []store.Challenge
+	if err := rl.worker.call(ctx, method, &workerRequest{Lab: rl.info.Lab, Tag: tag}, &flags); err != nil {
+		return err
+	}
+	rl.m.Lock()
+	rl.info.Flags = flags
+	rl.m.Unlock()
+	return nil
+}
+
+func (rl *remoteLab) Restart(ctx context.Context) error {
+	return rl.refresh(ctx, "RestartLab", "")
+}
+
+func (rl *remoteLab) ResetExercise(ctx context.Context, tag string) error {
+	return rl.refresh(ctx, "ResetExercise", tag)
+}
+
+func (rl *remoteLab) Flags() []store.Challenge {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	return rl.info.Flags
+}
+
+func (rl *remoteLab) RdpConnPorts() []uint {
+	return rl.info.RdpPorts
+}
+
+func (rl *remoteLab) Close() error {
+	rl.once.Do(func() { close(rl.stop) })
+	return rl.worker.call(context.Background(), "CloseLab", &workerRequest{Lab: rl.info.Lab}, &struct{}{})
+}
@@ -0,0 +1,209 @@
+package app
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	hlab "github.com/aau-network-security/haaukins/lab"
+	"github.com/aau-network-security/haaukins/store"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Write a self-signed certificate of the test workers, it is its own CA
+func newTestWorkerTLS(t *testing.T) (CertificateConfig, func()) {
+	dir, err := ioutil.TempDir("", "worker-tls")
+	if err != nil {
+		t.Fatalf("unable to create the certificate dir: %v", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate the key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "worker"},
+		DNSNames:              []string{"worker-1", "worker-2", "worker-3"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create the certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to marshal the key: %v", err)
+	}
+
+	conf := CertificateConfig{
+		Enabled:  true,
+		CertFile: filepath.Join(dir, "cert.pem"),
+		CertKey:  filepath.Join(dir, "key.pem"),
+		CAFile:   filepath.Join(dir, "cert.pem"),
+	}
+	ioutil.WriteFile(conf.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(conf.CertKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return conf, func() { os.RemoveAll(dir) }
+}
+
+// Start an in-process worker reached over gRPC, the labs it creates are returned through labs
+func newTestWorker(t *testing.T, name string, maxLabs int, labs chan *testLab) (*worker, *remoteWorker, func()) {
+	w := newWorker(name, nil, maxLabs, "10.0.0."+name, nil)
+	w.newLab = func(context.Context, hlab.Config) (hlab.Lab, error) {
+		l := &testLab{flags: []store.Challenge{{Tag: "ftp", Value: "HKN{" + name + "}"}}, rdpPorts: []uint{5000, 5001}}
+		labs <- l
+		return l, nil
+	}
+
+	tls, removeTLS := newTestWorkerTLS(t)
+	lis := bufconn.Listen(1 << 20)
+	srv, err := serveWorker(lis, w, WorkerServerConfig{AuthKey: "worker-key", TLS: tls})
+	if err != nil {
+		t.Fatalf("unable to serve worker: %v", err)
+	}
+	rw, err := newRemoteWorker(WorkerConfig{Name: name, Address: "worker-" + name, AuthKey: "worker-key", TLS: tls},
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }))
+	if err != nil {
+		t.Fatalf("unable to connect to worker: %v", err)
+	}
+	return w, rw, func() {
+		rw.Close()
+		srv.Close()
+		removeTLS()
+	}
+}
+
+func TestSchedulerRemoteWorkers(t *testing.T) {
+	labs := make(chan *testLab, 10)
+	_, small, closeSmall := newTestWorker(t, "1", 1, labs)
+	defer closeSmall()
+	large, big, closeBig := newTestWorker(t, "2", 3, labs)
+	defer closeBig()
+
+	s := &labScheduler{workers: []labWorker{small, big}}
+	ctx := context.Background()
+	spec := labSpec{Exercises: []store.Exercise{{Tag: "ftp"}}}
+
+	//The worker with the most free slots gets the lab
+	lab, host, err := s.CreateLab(ctx, spec)
+	if err != nil {
+		t.Fatalf("unexpected error scheduling the lab: %v", err)
+	}
+	created := <-labs
+	if host != "10.0.0.2" {
+		t.Fatalf("expected the lab on the worker with the most room, got host %s", host)
+	}
+	if ports := lab.RdpConnPorts(); len(ports) != 2 || ports[0] != 5000 {
+		t.Errorf("unexpected rdp ports: %v", ports)
+	}
+	if flags := lab.Flags(); len(flags) != 1 || flags[0].Value != "HKN{2}" {
+		t.Errorf("unexpected flags: %v", flags)
+	}
+	if err := lab.ResetExercise(ctx, "ftp"); err != nil || len(created.resets) != 1 {
+		t.Errorf("expected the exercise to be reset on the worker: %v", err)
+	}
+
+	//Both have one free slot, then only the small one has room
+	if _, host, _ = s.CreateLab(ctx, spec); host != "10.0.0.2" {
+		t.Fatalf("expected the second lab on worker 2, got %s", host)
+	}
+	<-labs
+	if _, host, _ = s.CreateLab(ctx, spec); host != "10.0.0.1" {
+		t.Fatalf("expected the third lab on worker 1, got %s", host)
+	}
+	<-labs
+	if _, host, _ = s.CreateLab(ctx, spec); host != "10.0.0.2" {
+		t.Fatalf("expected the fourth lab on worker 2, got %s", host)
+	}
+	<-labs
+	if _, _, err := s.CreateLab(ctx, spec); err != ErrNoWorker {
+		t.Fatalf("expected %v with every worker full, got %v", ErrNoWorker, err)
+	}
+
+	if err := lab.Close(); err != nil {
+		t.Fatalf("unexpected error closing the lab: %v", err)
+	}
+	if !created.isClosed() {
+		t.Errorf("expected the lab to be closed on the worker")
+	}
+	if c, _ := large.Capacity(ctx); c.Labs != 2 {
+		t.Errorf("expected the closed lab to free its slot, got %d labs", c.Labs)
+	}
+
+	tls, removeTLS := newTestWorkerTLS(t)
+	defer removeTLS()
+	unreachable, err := newRemoteWorker(WorkerConfig{Name: "3", Address: "worker-3", AuthKey: "worker-key", TLS: tls},
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return nil, context.Canceled }))
+	if err != nil {
+		t.Fatalf("unable to create worker client: %v", err)
+	}
+	defer unreachable.Close()
+	if statuses := (&labScheduler{workers: []labWorker{unreachable}}).Status(ctx); statuses[0].Error == "" {
+		t.Errorf("expected an unreachable worker to report an error")
+	}
+}
+
+func TestRemoteLabLease(t *testing.T) {
+	labs := make(chan *testLab, 10)
+	w, rw, stop := newTestWorker(t, "1", 2, labs)
+	defer stop()
+
+	ctx := context.Background()
+	lab, _, err := rw.CreateLab(ctx, labSpec{Exercises: []store.Exercise{{Tag: "ftp"}}})
+	if err != nil {
+		t.Fatalf("unexpected error creating the lab: %v", err)
+	}
+	created := <-labs
+	id := lab.(*remoteLab).info.Lab
+	defer lab.Close()
+
+	now := time.Now()
+	w.expireLeases(now)
+	if created.isClosed() {
+		t.Fatalf("expected the leased lab to be kept")
+	}
+
+	//The scheduler renews the lease, a lab it doesn't renew anymore is closed by the worker
+	later := now.Add(workerLabLease + time.Minute)
+	if err := rw.call(ctx, "RenewLab", &workerRequest{Lab: id}, &struct{}{}); err != nil {
+		t.Fatalf("unexpected error renewing the lease: %v", err)
+	}
+	w.expireLeases(later)
+	if !created.isClosed() {
+		t.Fatalf("expected the lab to be closed once its lease ran out")
+	}
+	if c, _ := w.Capacity(ctx); c.Labs != 0 {
+		t.Errorf("expected the expired lab to free its slot, got %d labs", c.Labs)
+	}
+	if err := rw.call(ctx, "RenewLab", &workerRequest{Lab: id}, &struct{}{}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected the lease of a closed lab not to be renewed, got %v", err)
+	}
+}
+
+func TestWorkerNeedsTLS(t *testing.T) {
+	if _, err := serveWorker(bufconn.Listen(1<<20), newWorker("1", nil, 1, "", nil), WorkerServerConfig{AuthKey: "worker-key"}); err != ErrWorkerNoTLS {
+		t.Errorf("expected the worker without tls to be refused, got %v", err)
+	}
+	if _, err := newRemoteWorker(WorkerConfig{Name: "1", Address: "worker-1", AuthKey: "worker-key"}); err != ErrWorkerNoTLS {
+		t.Errorf("expected the remote worker without tls to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+package app
+
+import (
+	"bufio"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	serverReadHeaderTimeout = 10 * time.Second
+	serverIdleTimeout       = 2 * time.Minute
+	serverMaxHeaderBytes    = 64 << 10
+	serverMaxFormBytes      = 256 << 10
+	hstsMaxAge              = "31536000" //one year
+	guacamolePath           = "/guacamole/"
+
+	errorInternal = "Something went wrong, please try again later"
+
+	//The pages load bootstrap, jquery and the fonts from their CDN, the captcha from google. The
+	//inline scripts of the templates need 'unsafe-inline'
+	contentSecurityPolicy = "default-src 'self'; " +
+		"script-src 'self' 'unsafe-inline' https://code.jquery.com https://stackpath.bootstrapcdn.com https://www.google.com/recaptcha/ https://www.gstatic.com/recaptcha/; " +
+		"style-src 'self' 'unsafe-inline' https://fonts.googleapis.com; " +
+		"font-src 'self' https://fonts.gstatic.com; " +
+		"img-src 'self' data:; " +
+		"frame-src https://www.google.com/recaptcha/ https://recaptcha.google.com/recaptcha/; " +
+		"object-src 'none'; base-uri 'self'"
+)
+
+// The pages which can be framed: guacamole and the lab pages, eg. by the learning platforms
+var framablePaths = []string{guacamolePath, "/guaclogin/", shadowLoginPath, labPagePath, "/lti/"}
+
+// HTTP server of the API, with the timeouts and limits of the configuration
+func (lm *LearningMaterialAPI) newServer(addr string) *http.Server {
+	conf := lm.conf.Server
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           lm.Handler(),
+		ReadHeaderTimeout: conf.ReadHeaderTimeout,
+		ReadTimeout:       conf.ReadTimeout,
+		WriteTimeout:      conf.WriteTimeout,
+		IdleTimeout:       conf.IdleTimeout,
+		MaxHeaderBytes:    conf.MaxHeaderBytes,
+	}
+	if srv.ReadHeaderTimeout == 0 {
+		srv.ReadHeaderTimeout = serverReadHeaderTimeout
+	}
+	if srv.IdleTimeout == 0 {
+		srv.IdleTimeout = serverIdleTimeout
+	}
+	if srv.MaxHeaderBytes == 0 {
+		srv.MaxHeaderBytes = serverMaxHeaderBytes
+	}
+	return srv
+}
+
+// Origins allowed to frame the labs: the configured ones and the LTI platforms
+func (lm *LearningMaterialAPI) frameAncestors() []string {
+	origins := append([]string{}, lm.conf.Server.FrameAncestors...)
+	if lm.conf.LTI.Enabled {
+		for _, p := range lm.conf.LTI.Platforms {
+			if u, err := url.Parse(p.Issuer); err == nil && u.Scheme != "" && u.Host != "" {
+				origins = append(origins, u.Scheme+"://"+u.Host)
+			}
+		}
+	}
+	return origins
+}
+
+func framable(path string) bool {
+	for _, p := range framablePaths {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tells if the request comes from a page of the API, the session cookie is sent with the
+// requests of the pages of other sites too (eg. of the LTI platforms framing the labs).
+// The origin is taken from the referer by the browsers which don't send it
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func isForm(r *http.Request) bool {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return ct == "application/x-www-form-urlencoded" || ct == "multipart/form-data"
+}
+
+// secure wraps the handler of the API: it sets the security headers, limits the size of the
+// forms posted and renders the error page when a handler panics
+func (lm *LearningMaterialAPI) secure(next http.Handler) http.Handler {
+	maxForm := lm.conf.Server.MaxFormBytes
+	if maxForm == 0 {
+		maxForm = serverMaxFormBytes
+	}
+
+	ancestors := "'self'"
+	if origins := lm.frameAncestors(); len(origins) > 0 {
+		ancestors += " " + strings.Join(origins, " ")
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "same-origin")
+		if lm.conf.TLS.Enabled {
+			h.Set("Strict-Transport-Security", "max-age="+hstsMaxAge+"; includeSubDomains")
+		}
+
+		//Guacamole sets its own policy, only who can frame it is set
+		csp := contentSecurityPolicy + "; "
+		if strings.HasPrefix(r.URL.Path, guacamolePath) {
+			csp = ""
+		}
+		switch {
+		case !framable(r.URL.Path):
+			h.Set("X-Frame-Options", "DENY")
+			h.Set("Content-Security-Policy", csp+"frame-ancestors 'none'")
+		case ancestors == "'self'":
+			h.Set("X-Frame-Options", "SAMEORIGIN")
+			h.Set("Content-Security-Policy", csp+"frame-ancestors 'self'")
+		default:
+			//X-Frame-Options can't list origins, the browsers use frame-ancestors
+			h.Set("Content-Security-Policy", csp+"frame-ancestors "+ancestors)
+		}
+
+		if r.Body != nil && isForm(r) {
+			r.Body = http.MaxBytesReader(w, r.Body, maxForm)
+		}
+
+		rw := &responseWriter{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler { //the response is aborted on purpose, eg. by a proxy
+				panic(err)
+			}
+			log.Error().Str("path", r.URL.Path).Msgf("Panic serving request: %v\n%s", err, debug.Stack())
+			if !rw.wroteHeader && !rw.hijacked {
+				errorPage(rw, r, http.StatusInternalServerError, returnError{
+					Content:         errorInternal,
+					Toomanyrequests: false,
+				})
+			}
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// responseWriter records whether the response was started, the websockets still hijack the
+// connection and the proxied responses are still flushed through it
+type responseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	hijacked    bool
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	rw.wroteHeader = true
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		rw.wroteHeader = true
+		f.Flush()
+	}
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the connection can't be hijacked")
+	}
+	rw.hijacked = true
+	return hj.Hijack()
+}
@@ -0,0 +1,120 @@
+package app
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecureHandler(t *testing.T) {
+	lm := &LearningMaterialAPI{conf: &Config{
+		Server: ServerConfig{MaxFormBytes: 16},
+		LTI:    LTIConfig{Enabled: true, Platforms: []LTIPlatform{{Issuer: "https://moodle.example.org/"}}},
+	}}
+	h := lm.secure(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/panic":
+			panic("boom")
+		case "/form":
+			if _, err := ioutil.ReadAll(r.Body); err != nil {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+			}
+		}
+	}))
+
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(httptest.NewRequest("GET", "/", nil))
+	if w.Header().Get("X-Frame-Options") != "DENY" || !strings.HasSuffix(w.Header().Get("Content-Security-Policy"), "frame-ancestors 'none'") {
+		t.Errorf("expected the home page not to be framed, got %v", w.Header())
+	}
+	if w.Header().Get("Referrer-Policy") == "" || w.Header().Get("Strict-Transport-Security") != "" {
+		t.Errorf("unexpected headers without TLS: %v", w.Header())
+	}
+
+	w = do(httptest.NewRequest("GET", labPagePath, nil))
+	if w.Header().Get("X-Frame-Options") != "" || !strings.HasSuffix(w.Header().Get("Content-Security-Policy"), "frame-ancestors 'self' https://moodle.example.org") {
+		t.Errorf("expected the lab page to be framed by the LTI platform, got %v", w.Header())
+	}
+	w = do(httptest.NewRequest("GET", guacamolePath+"#/client", nil))
+	if csp := w.Header().Get("Content-Security-Policy"); strings.Contains(csp, "script-src") {
+		t.Errorf("expected guacamole to keep its own policy, got %q", csp)
+	}
+
+	form := httptest.NewRequest("POST", "/form", strings.NewReader("exercise="+strings.Repeat("a", 32)))
+	form.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w = do(form); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected the form to be limited, got %d", w.Code)
+	}
+
+	if w = do(httptest.NewRequest("GET", "/panic", nil)); w.Code != http.StatusInternalServerError {
+		t.Errorf("expected the panic to be recovered with an error page, got %d", w.Code)
+	}
+
+	lm.conf.TLS.Enabled = true
+	h = lm.secure(http.NotFoundHandler())
+	if w = do(httptest.NewRequest("GET", "/", nil)); !strings.HasPrefix(w.Header().Get("Strict-Transport-Security"), "max-age=") {
+		t.Errorf("expected HSTS with TLS, got %v", w.Header())
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	tt := []struct {
+		name    string
+		origin  string
+		referer string
+		ok      bool
+	}{
+		{name: "same origin", origin: "https://haaukins.example.org", ok: true},
+		{name: "other origin", origin: "https://attacker.example.org"},
+		{name: "other origin with same referer", origin: "https://attacker.example.org", referer: "https://haaukins.example.org/lab/"},
+		{name: "referer", referer: "https://haaukins.example.org/lab/?challenges=ftp", ok: true},
+		{name: "other referer", referer: "https://attacker.example.org/haaukins.example.org"},
+		{name: "opaque origin", origin: "null"},
+		{name: "none"},
+	}
+	for _, tc := range tt {
+		r := httptest.NewRequest(http.MethodPost, "https://haaukins.example.org/lab/extend", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if tc.referer != "" {
+			r.Header.Set("Referer", tc.referer)
+		}
+		if ok := sameOrigin(r); ok != tc.ok {
+			t.Errorf("%s: expected same origin to be %v, got %v", tc.name, tc.ok, ok)
+		}
+	}
+}
+
+func TestLabActionOrigin(t *testing.T) {
+	lm := &LearningMaterialAPI{
+		conf:               &Config{API: APIConfig{SignKey: "test-key"}},
+		ClientRequestStore: NewClientRequestStore(),
+	}
+	cr, cookie := newTestLab(t, lm, "ftp", nil)
+	cr.startIdle(time.Minute)
+	cr.lastActivity = time.Now().Add(-time.Hour)
+
+	keepalive := func(origin string) int {
+		r := httptest.NewRequest(http.MethodPost, labPagePath+"keepalive?challenges=ftp", nil)
+		r.Header.Set("Origin", origin)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		lm.handleLab()(w, r)
+		return w.Code
+	}
+	if code := keepalive("https://attacker.example.org"); code != http.StatusForbidden || cr.IdleDeadline().After(time.Now()) {
+		t.Fatalf("expected the cross-origin action to be rejected, got %d", code)
+	}
+	if code := keepalive("http://example.com"); code != http.StatusSeeOther || !cr.IdleDeadline().After(time.Now()) {
+		t.Fatalf("expected the action to be run, got %d", code)
+	}
+}
@@ -0,0 +1,329 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	shadowAdminPath = "/admin/shadow/"
+	shadowLoginPath = "/guacshadow/"
+	shadowCookie    = "shadow"
+
+	shadowTicketTTL  = 2 * time.Minute
+	shadowSessionTTL = 2 * time.Hour
+
+	shadowReadOnly = "readonly"
+	shadowControl  = "control"
+)
+
+var (
+	ErrNotConnected       = errors.New("the student is not connected to the lab")
+	ErrConnectionNotFound = errors.New("the lab has no such connection")
+)
+
+// shadowSession lets an admin look at, or take part in, the guacamole session of a
+// client request. It is created by the admin endpoint and started once the link is opened
+type shadowSession struct {
+	requestID  string
+	connection string
+	mode       string
+	key        string //guacamole sharing key
+	guacToken  string
+	expires    time.Time
+}
+
+type shadowStore struct {
+	m        sync.Mutex
+	tickets  map[string]*shadowSession
+	sessions map[string]*shadowSession
+}
+
+func newShadowStore() *shadowStore {
+	return &shadowStore{
+		tickets:  map[string]*shadowSession{},
+		sessions: map[string]*shadowSession{},
+	}
+}
+
+func (ss *shadowStore) expire(now time.Time) {
+	for k, v := range ss.tickets {
+		if now.After(v.expires) {
+			delete(ss.tickets, k)
+		}
+	}
+	for k, v := range ss.sessions {
+		if now.After(v.expires) {
+			delete(ss.sessions, k)
+		}
+	}
+}
+
+// Issue a one-time ticket opening the shadow session
+func (ss *shadowStore) Issue(s *shadowSession) (string, error) {
+	t, err := randomString()
+	if err != nil {
+		return "", err
+	}
+
+	ss.m.Lock()
+	defer ss.m.Unlock()
+
+	now := time.Now()
+	ss.expire(now)
+	s.expires = now.Add(shadowTicketTTL)
+	ss.tickets[t] = s
+	return t, nil
+}
+
+// Redeem returns the shadow session of the ticket and invalidates the ticket
+func (ss *shadowStore) Redeem(t string) (*shadowSession, bool) {
+	ss.m.Lock()
+	defer ss.m.Unlock()
+
+	s, ok := ss.tickets[t]
+	if !ok {
+		return nil, false
+	}
+	delete(ss.tickets, t)
+
+	if time.Now().After(s.expires) {
+		return nil, false
+	}
+	return s, true
+}
+
+// Start the shadow session logged in guacamole with token, the ID of the session is returned
+func (ss *shadowStore) Start(s *shadowSession, token string) (string, error) {
+	id, err := randomString()
+	if err != nil {
+		return "", err
+	}
+
+	ss.m.Lock()
+	defer ss.m.Unlock()
+
+	s.guacToken = token
+	s.expires = time.Now().Add(shadowSessionTTL)
+	ss.sessions[id] = s
+	return id, nil
+}
+
+func (ss *shadowStore) Get(id string) (*shadowSession, bool) {
+	ss.m.Lock()
+	defer ss.m.Unlock()
+
+	s, ok := ss.sessions[id]
+	if !ok || time.Now().After(s.expires) {
+		return nil, false
+	}
+	return s, true
+}
+
+// Check a guacamole request made through a shadow session, the request is allowed only
+// with the guacamole token of the shadow session
+func (lm *LearningMaterialAPI) authorizeShadowRequest(r *http.Request, kind guacRequestKind) (*ClientRequest, bool) {
+	cookie, err := r.Cookie(shadowCookie)
+	if err != nil {
+		return nil, false
+	}
+	s, ok := lm.shadows.Get(cookie.Value)
+	if !ok {
+		return nil, false
+	}
+	_, cr, err := lm.ClientRequestStore.GetClientRequestByID(s.requestID)
+	if err != nil {
+		return nil, false
+	}
+
+	if kind == guacStatic || kind == guacPublic {
+		return nil, true
+	}
+	token := guacRequestToken(r)
+	if token == "" {
+		//HTTP tunnel reads and writes are bound to the tunnel UUID given when it connected
+		if shadow, ok := cr.httpTunnel(guacHTTPTunnelUUID(r)); ok && shadow && kind == guacTunnel {
+			return cr, true
+		}
+		return nil, false
+	}
+	if token != s.guacToken {
+		return nil, false
+	}
+	return cr, true
+}
+
+// Handle the requests made to `/admin/shadow/{request}`, it returns a link which joins the
+// guacamole session of the client request, either read-only (`mode=readonly`, default)
+// or sharing the control (`mode=control`). The connection is chosen with `connection`
+// (1 by default) when the lab has more than one frontend
+func (lm *LearningMaterialAPI) handleShadow() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if lm.guacAdmin == nil {
+			writeJSONError(w, http.StatusServiceUnavailable, "guacamole is not available")
+			return
+		}
+
+		client, cr, err := lm.ClientRequestStore.GetClientRequestByID(strings.Trim(strings.TrimPrefix(r.URL.Path, shadowAdminPath), "/"))
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+
+		mode := r.URL.Query().Get("mode")
+		if mode == "" {
+			mode = shadowReadOnly
+		}
+		if mode != shadowReadOnly && mode != shadowControl {
+			writeJSONError(w, http.StatusBadRequest, "mode must be readonly or control")
+			return
+		}
+		num := 1
+		if c := r.URL.Query().Get("connection"); c != "" {
+			if num, err = strconv.Atoi(c); err != nil || num < 1 {
+				writeJSONError(w, http.StatusBadRequest, "invalid connection")
+				return
+			}
+		}
+
+		key, err := lm.sharingKey(cr, num, mode)
+		switch err {
+		case nil:
+		case ErrConnectionNotFound:
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		case ErrNotConnected:
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		default:
+			log.Error().Str("request", cr.ID()).Msgf("Error sharing guacamole connection: %v", err)
+			writeJSONError(w, http.StatusBadGateway, "error sharing the guacamole connection")
+			return
+		}
+
+		s := &shadowSession{
+			requestID:  cr.ID(),
+			connection: fmt.Sprintf("%s-client%d", cr.ID(), num),
+			mode:       mode,
+			key:        key,
+		}
+		t, err := lm.shadows.Issue(s)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, errorCreateToken)
+			return
+		}
+
+		admin, _, _ := r.BasicAuth()
+		lm.audit.Record(auditEvent{
+			Action:  auditShadowStarted,
+			Actor:   "admin:" + admin,
+			Client:  client.ID(),
+			Request: cr.ID(),
+			Details: map[string]string{
+				"identity":   client.Identity(),
+				"connection": s.connection,
+				"mode":       mode,
+			},
+		})
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"request": cr.ID(),
+			"mode":    mode,
+			"url":     lm.publicURL(shadowLoginPath + "?" + url.Values{loginTicketParam: {t}}.Encode()),
+			"expires": s.expires,
+		})
+	}
+}
+
+// Get a sharing key of the active connection number num of the client request
+func (lm *LearningMaterialAPI) sharingKey(cr *ClientRequest, num int, mode string) (string, error) {
+	name := fmt.Sprintf("%s-client%d", cr.ID(), num)
+
+	conns, err := lm.guacAdmin.Connections()
+	if err != nil {
+		return "", err
+	}
+	var connID string
+	for id, c := range conns {
+		if c.Name == name {
+			connID = id
+			break
+		}
+	}
+	if connID == "" {
+		return "", ErrConnectionNotFound
+	}
+
+	active, err := lm.guacAdmin.ActiveConnections()
+	if err != nil {
+		return "", err
+	}
+	var activeID string
+	var started int64
+	for id, a := range active {
+		//The most recent connection of the student
+		if a.ConnectionIdentifier == connID && a.Username == cr.ID() && a.StartDate >= started {
+			activeID, started = id, a.StartDate
+		}
+	}
+	if activeID == "" {
+		return "", ErrNotConnected
+	}
+
+	profileID, err := lm.guacAdmin.SharingProfile(connID, name+"-"+mode, mode == shadowReadOnly)
+	if err != nil {
+		return "", err
+	}
+	return lm.guacAdmin.SharingKey(activeID, profileID)
+}
+
+// Handle the request made to `/guacshadow/`, it logs the admin in the shared guacamole session
+func (lm *LearningMaterialAPI) shadowLogin() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := lm.shadows.Redeem(r.URL.Query().Get(loginTicketParam))
+		if !ok {
+			errorPage(w, r, http.StatusUnauthorized, returnError{
+				Content:         errorLoginTicket,
+				Toomanyrequests: false,
+			})
+			return
+		}
+
+		content, err := lm.guacAdmin.ShareLogin(s.key)
+		if err != nil {
+			log.Error().Str("request", s.requestID).Msgf("Unable to join guacamole session: %v", err)
+			errorPage(w, r, http.StatusBadGateway, returnError{
+				Content:         errorGuacDown,
+				Toomanyrequests: false,
+			})
+			return
+		}
+
+		id, err := lm.shadows.Start(s, guacAuthToken(content))
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, returnError{
+				Content:         errorCreateToken,
+				Toomanyrequests: false,
+			})
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{Name: shadowCookie, Value: id, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode, Expires: s.expires})
+		http.SetCookie(w, &http.Cookie{Name: "GUAC_AUTH", Value: url.QueryEscape(string(content)), Path: "/guacamole/", SameSite: http.SameSiteLaxMode})
+		http.Redirect(w, r, guacPath, http.StatusFound)
+	}
+}
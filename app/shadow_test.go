@@ -0,0 +1,72 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestShadowSessionAuthorization(t *testing.T) {
+	crs := NewClientRequestStore()
+	client := crs.NewClient("127.0.0.1")
+	cr := client.NewClientRequest("ftp")
+	cr.guacToken = "student-token"
+
+	lm := &LearningMaterialAPI{
+		conf:               &Config{},
+		ClientRequestStore: crs,
+		shadows:            newShadowStore(),
+	}
+
+	ticket, err := lm.shadows.Issue(&shadowSession{requestID: cr.ID(), mode: shadowReadOnly, key: "sharing-key"})
+	if err != nil {
+		t.Fatalf("unable to issue shadow ticket: %v", err)
+	}
+	s, ok := lm.shadows.Redeem(ticket)
+	if !ok || s.key != "sharing-key" {
+		t.Fatalf("expected the shadow ticket to be redeemed")
+	}
+	if _, ok := lm.shadows.Redeem(ticket); ok {
+		t.Fatalf("expected the shadow ticket to be redeemed only once")
+	}
+
+	id, err := lm.shadows.Start(s, "shadow-token")
+	if err != nil {
+		t.Fatalf("unable to start shadow session: %v", err)
+	}
+
+	tt := []struct {
+		name   string
+		path   string
+		cookie string
+		ok     bool
+	}{
+		{name: "static with shadow session", path: "/guacamole/app.js", cookie: id, ok: true},
+		{name: "api with shadow token", path: "/guacamole/api/session/data/mysql/self?token=shadow-token", cookie: id, ok: true},
+		{name: "api with student token", path: "/guacamole/api/session/data/mysql/self?token=student-token", cookie: id},
+		{name: "unknown shadow session", path: "/guacamole/app.js", cookie: "unknown"},
+		{name: "admin api", path: "/guacamole/api/session/data/mysql/users?token=shadow-token", cookie: id},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			r.AddCookie(&http.Cookie{Name: shadowCookie, Value: tc.cookie})
+
+			_, shadow, ok := lm.authorizeGuacRequest(r)
+			if ok != tc.ok {
+				t.Errorf("expected authorized to be %v, got %v", tc.ok, ok)
+			}
+			if ok && !shadow {
+				t.Errorf("expected the request to be made through the shadow session")
+			}
+		})
+	}
+
+	//The shadow session ends together with the lab
+	client.RemoveClientRequest("ftp")
+	r := httptest.NewRequest(http.MethodGet, "/guacamole/app.js", nil)
+	r.AddCookie(&http.Cookie{Name: shadowCookie, Value: id})
+	if _, _, ok := lm.authorizeGuacRequest(r); ok {
+		t.Errorf("expected shadow session to be rejected once the lab is gone")
+	}
+}
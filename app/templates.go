@@ -1,6 +1,9 @@
 package app
 
-import "fmt"
+import (
+	"fmt"
+	"html"
+)
 
 const waitingHTMLTemplate = `
 <html lang="en" dir="ltr">
@@ -152,3 +155,21 @@ func getCaptchaPage(formActionURL, siteKey string) string {
 		  </body>
 		</html>	`, "50%", "50%", "50%", formActionURL, siteKey)
 }
+
+// Page which posts a single value to another site as soon as it is loaded (eg. LTI deep linking response)
+func getAutoPostPage(actionURL, name, value string) string {
+	return fmt.Sprintf(`
+		<html>
+		  <head>
+			<title>Haaukins API</title>
+		  </head>
+		  <body>
+			<form action="%s" method="POST" id="autoPostForm">
+			  <input type="hidden" name="%s" value="%s"/>
+			</form>
+			<script>
+				document.getElementById("autoPostForm").submit();
+			</script>
+		  </body>
+		</html>	`, html.EscapeString(actionURL), html.EscapeString(name), html.EscapeString(value))
+}
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const loginTicketTTL = 2 * time.Minute
+
+// loginTicket lets a browser without a session cookie log in to a single
+// client request, it can be redeemed only once
+type loginTicket struct {
+	clientID string
+	chals    string
+	expires  time.Time
+}
+
+type ticketStore struct {
+	m       sync.Mutex
+	tickets map[string]loginTicket
+}
+
+func newTicketStore() *ticketStore {
+	return &ticketStore{tickets: map[string]loginTicket{}}
+}
+
+// Issue a new ticket for the client request identified by client ID and challenges
+func (ts *ticketStore) Issue(clientID, chals string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	t := hex.EncodeToString(b)
+
+	ts.m.Lock()
+	defer ts.m.Unlock()
+
+	now := time.Now()
+	for k, v := range ts.tickets { //drop the tickets nobody redeemed
+		if now.After(v.expires) {
+			delete(ts.tickets, k)
+		}
+	}
+
+	ts.tickets[t] = loginTicket{
+		clientID: clientID,
+		chals:    chals,
+		expires:  now.Add(loginTicketTTL),
+	}
+	return t, nil
+}
+
+// Redeem returns the ticket and invalidates it, false is returned for unknown or expired tickets
+func (ts *ticketStore) Redeem(t string) (loginTicket, bool) {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+
+	lt, ok := ts.tickets[t]
+	if !ok {
+		return loginTicket{}, false
+	}
+	delete(ts.tickets, t)
+
+	if time.Now().After(lt.expires) {
+		return loginTicket{}, false
+	}
+	return lt, true
+}
+
+// MaxAge of the cookies which last as long as a lab expiring at the given time, in seconds
+func labMaxAge(expires time.Time) int {
+	left := int(time.Until(expires) / time.Second)
+	if left < 1 { //0 would make it a session cookie
+		return 1
+	}
+	return left
+}
@@ -0,0 +1,66 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTicketStore(t *testing.T) {
+	ts := newTicketStore()
+
+	ticket, err := ts.Issue("client-1", "ftp,sql")
+	if err != nil {
+		t.Fatalf("unexpected error issuing a ticket: %v", err)
+	}
+	lt, ok := ts.Redeem(ticket)
+	if !ok || lt.clientID != "client-1" || lt.chals != "ftp,sql" {
+		t.Fatalf("expected the ticket of client-1, got %+v (%t)", lt, ok)
+	}
+
+	//A ticket is redeemed only once
+	if _, ok := ts.Redeem(ticket); ok {
+		t.Errorf("expected the ticket to be redeemed only once")
+	}
+	for _, unknown := range []string{"", "unknown"} {
+		if _, ok := ts.Redeem(unknown); ok {
+			t.Errorf("expected the ticket %q to be unknown", unknown)
+		}
+	}
+
+	expired, err := ts.Issue("client-1", "ftp,sql")
+	if err != nil {
+		t.Fatalf("unexpected error issuing a ticket: %v", err)
+	}
+	ts.m.Lock()
+	lt = ts.tickets[expired]
+	lt.expires = time.Now().Add(-time.Second)
+	ts.tickets[expired] = lt
+	ts.m.Unlock()
+	if _, ok := ts.Redeem(expired); ok {
+		t.Errorf("expected the expired ticket to be refused")
+	}
+
+	//The tickets nobody redeemed are dropped
+	stale, _ := ts.Issue("client-2", "xss")
+	ts.m.Lock()
+	lt = ts.tickets[stale]
+	lt.expires = time.Now().Add(-time.Second)
+	ts.tickets[stale] = lt
+	ts.m.Unlock()
+	ts.Issue("client-3", "xss")
+	ts.m.Lock()
+	_, kept := ts.tickets[stale]
+	ts.m.Unlock()
+	if kept {
+		t.Errorf("expected the expired ticket to be dropped")
+	}
+}
+
+func TestLabMaxAge(t *testing.T) {
+	if age := labMaxAge(time.Now().Add(time.Hour)); age < 3590 || age > 3600 {
+		t.Errorf("expected about an hour, got %ds", age)
+	}
+	if age := labMaxAge(time.Now().Add(-time.Minute)); age != 1 {
+		t.Errorf("expected an expired lab to get a 1s cookie, got %ds", age)
+	}
+}
@@ -2,11 +2,15 @@ package app
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	proto "github.com/aau-network-security/haaukins/exercise/ex-proto"
 	"io"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"text/template"
@@ -157,6 +161,41 @@ func WaitingResponse(w http.ResponseWriter) {
 	return
 }
 
+//Random hex string, used for secrets such as passwords and nonces
+func randomString() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Msgf("Error encoding JSON response: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, statusCode int, msg string) {
+	writeJSON(w, statusCode, map[string]string{"error": msg})
+}
+
+//Absolute URL of a path on the API, as it is reached from outside
+func (lm *LearningMaterialAPI) publicURL(path string) string {
+	scheme, port, defaultPort := "http", lm.conf.Port.InSecure, uint(80)
+	if lm.conf.TLS.Enabled {
+		scheme, port, defaultPort = "https", lm.conf.Port.Secure, 443
+	}
+
+	host := lm.conf.Host
+	if port != 0 && port != defaultPort {
+		host = fmt.Sprintf("%s:%d", host, port)
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, host, path)
+}
+
 func protobufToJson(message bproto.Message) (string, error) {
 	marshaler := jsonpb.Marshaler{
 		EnumsAsInts:  false,
@@ -166,3 +205,77 @@ func protobufToJson(message bproto.Message) (string, error) {
 
 	return marshaler.MarshalToString(message)
 }
+
+//challengeSets matches the challenges of a request against the challenge sets of the configuration
+type challengeSets struct {
+	all  bool
+	sets []map[string]bool
+}
+
+func newChallengeSets(sets []string) challengeSets {
+	var cs challengeSets
+	for _, s := range sets {
+		if strings.TrimSpace(s) == "*" {
+			cs.all = true
+			continue
+		}
+		cs.sets = append(cs.sets, challengeSet(s))
+	}
+	return cs
+}
+
+func challengeSet(chals string) map[string]bool {
+	set := map[string]bool{}
+	for _, c := range strings.Split(chals, ",") {
+		if c = strings.ToLower(strings.TrimSpace(c)); c != "" {
+			set[c] = true
+		}
+	}
+	return set
+}
+
+//Lowercase the challenges and remove the empty and repeated ones, keeping their order
+func cleanChallenges(chals []string) []string {
+	var cleaned []string
+	seen := map[string]bool{}
+	for _, c := range chals {
+		if c = strings.ToLower(strings.TrimSpace(c)); c != "" && !seen[c] {
+			seen[c] = true
+			cleaned = append(cleaned, c)
+		}
+	}
+	return cleaned
+}
+
+//Normalise the challenges requested so the same challenges are the same lab whatever their
+//order or casing, eg. "b,A,b" and "a,b"
+func normalizeChallenges(chals string) string {
+	cleaned := cleanChallenges(strings.Split(chals, ","))
+	sort.Strings(cleaned)
+	return strings.Join(cleaned, ",")
+}
+
+//Match tells if the challenges are exactly one of the challenge sets
+func (cs challengeSets) Match(chals string) bool {
+	if cs.all {
+		return true
+	}
+
+	requested := challengeSet(chals)
+	for _, set := range cs.sets {
+		if len(set) != len(requested) {
+			continue
+		}
+		match := true
+		for c := range requested {
+			if !set[c] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
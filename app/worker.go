@@ -0,0 +1,321 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	hlab "github.com/aau-network-security/haaukins/lab"
+	"github.com/aau-network-security/haaukins/store"
+	"github.com/aau-network-security/haaukins/virtual/docker"
+	"github.com/aau-network-security/haaukins/virtual/vbox"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrWorkerFull  = errors.New("the worker has no room for another lab")
+	ErrLabNotFound = errors.New("lab not found on the worker")
+)
+
+// labSpec is what a worker needs to create a lab
+type labSpec struct {
+	Exercises []store.Exercise       `json:"exercises"`
+	Frontends []store.InstanceConfig `json:"frontends"`
+}
+
+// workerCapacity is how many more labs a worker can take
+type workerCapacity struct {
+	Labs         int    `json:"labs"`
+	MaxLabs      int    `json:"max_labs"` //0 means bounded only by the resources of the host
+	FreeMemoryMB uint64 `json:"free_memory_mb"`
+}
+
+// Number of labs the worker can still take, -1 when it is not bounded
+func (c workerCapacity) free() int {
+	if c.MaxLabs <= 0 {
+		return -1
+	}
+	if c.Labs >= c.MaxLabs {
+		return 0
+	}
+	return c.MaxLabs - c.Labs
+}
+
+// workerLab is a lab running on a worker, either in this process or on another host
+type workerLab interface {
+	Restart(context.Context) error
+	ResetExercise(ctx context.Context, tag string) error
+	Flags() []store.Challenge
+	RdpConnPorts() []uint
+	Close() error
+}
+
+// localLab is a haaukins lab running on this host
+type localLab struct {
+	id       string
+	lease    time.Time //the labs created for the scheduler of another API are closed once it runs out
+	lab      hlab.Lab
+	admitted *admittance
+	changed  func() //the containers or the VMs of the lab were created again
+	closed   func()
+	once     sync.Once
+	err      error
+}
+
+func (l *localLab) Restart(ctx context.Context) error {
+	err := l.lab.Restart(ctx)
+	l.resourcesChanged()
+	return err
+}
+
+func (l *localLab) ResetExercise(ctx context.Context, tag string) error {
+	err := l.lab.Environment().ResetByTag(ctx, tag)
+	l.resourcesChanged()
+	return err
+}
+
+// The resources are tracked again even when the restart failed, part of them may be new
+func (l *localLab) resourcesChanged() {
+	if l.changed != nil {
+		l.changed()
+	}
+}
+
+func (l *localLab) Flags() []store.Challenge {
+	return l.lab.Environment().Challenges()
+}
+
+func (l *localLab) RdpConnPorts() []uint {
+	return l.lab.RdpConnPorts()
+}
+
+// Close the lab, it is closed only once whether by its environment or by the worker
+func (l *localLab) Close() error {
+	l.once.Do(func() {
+		l.err = l.lab.Close()
+		l.admitted.Release()
+		if l.closed != nil {
+			l.closed()
+		}
+	})
+	return l.err
+}
+
+// worker runs the labs on this host, for the API itself or for a scheduler on another host
+type worker struct {
+	name      string
+	maxLabs   int
+	admission *admission
+	newLab    func(context.Context, hlab.Config) (hlab.Lab, error)
+	hostIP    func() (string, error)
+	resources *reconciler
+
+	m    sync.Mutex
+	labs map[string]*localLab
+}
+
+func newWorker(name string, vlib vbox.Library, maxLabs int, hostIP string, adm *admission) *worker {
+	w := &worker{
+		name:      name,
+		maxLabs:   maxLabs,
+		admission: adm,
+		newLab: func(ctx context.Context, conf hlab.Config) (hlab.Lab, error) {
+			lh := hlab.LabHost{
+				Vlib: vlib,
+				Conf: conf,
+			}
+			return lh.NewLab(ctx, 0)
+		},
+		hostIP: func() (string, error) {
+			if hostIP != "" {
+				return hostIP, nil
+			}
+			return docker.NewHost().GetDockerHostIP()
+		},
+		labs: map[string]*localLab{},
+	}
+	return w
+}
+
+func (w *worker) Name() string {
+	return w.name
+}
+
+func (w *worker) Capacity(context.Context) (workerCapacity, error) {
+	w.m.Lock()
+	c := workerCapacity{Labs: len(w.labs), MaxLabs: w.maxLabs}
+	w.m.Unlock()
+
+	if w.admission != nil {
+		r := w.admission.Report(labCost{})
+		if r.Host.MemAvailableMB > r.Pending.MemoryMB {
+			c.FreeMemoryMB = r.Host.MemAvailableMB - r.Pending.MemoryMB
+		}
+	}
+	return c, nil
+}
+
+// Create and start a lab, the host the RDP ports of its frontends are reachable at is returned
+func (w *worker) CreateLab(ctx context.Context, spec labSpec) (workerLab, string, error) {
+	_, lab, host, err := w.createLab(ctx, spec)
+	return lab, host, err
+}
+
+func (w *worker) createLab(ctx context.Context, spec labSpec) (string, *localLab, string, error) {
+	w.m.Lock()
+	full := w.maxLabs > 0 && len(w.labs) >= w.maxLabs
+	w.m.Unlock()
+	if full {
+		return "", nil, "", ErrWorkerFull
+	}
+
+	host, err := w.hostIP()
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	//Wait until the host has room for the lab
+	frontends := make([]labFrontend, len(spec.Frontends))
+	for i, f := range spec.Frontends {
+		frontends[i] = labFrontend{conf: f}
+	}
+	admitted, err := w.admission.Admit(ctx, w.admission.LabCost(spec.Exercises, frontends))
+	if err != nil {
+		log.Warn().Str("worker", w.name).Msgf("Lab not admitted: %v", err)
+		return "", nil, "", err
+	}
+
+	//The steps done are undone when the lab fails to start
+	var rb rollback
+	defer rb.Run()
+	rb.Add("admission", func() error {
+		admitted.Release()
+		return nil
+	})
+
+	//The lab is tracked before its resources are created, they are added as they are known.
+	//A lab which fails to start is left to the reconciler, which drops it once its resources are gone
+	id := uuid.New().String()
+	w.resources.Begin(id)
+	defer w.resources.Done(id)
+
+	lab, err := w.newLab(ctx, hlab.Config{
+		Exercises: spec.Exercises,
+		Frontends: spec.Frontends,
+	})
+	if err != nil {
+		log.Error().Msgf("Error while creating new lab %s", err.Error())
+		return "", nil, "", err
+	}
+	w.resources.Track(id, lab, false)
+	rb.Add("lab", lab.Close)
+
+	if err := lab.Start(ctx); err != nil {
+		log.Error().Msgf("Error while starting lab %s", err.Error())
+		w.resources.Track(id, lab, false)
+		return "", nil, "", err
+	}
+	admitted.Started()
+	rb.Commit()
+	w.resources.Track(id, lab, true)
+
+	l := &localLab{id: id, lab: lab, admitted: admitted}
+	l.changed = func() {
+		//a restart finishing after the lab was closed leaves nothing to track
+		if _, err := w.lab(id); err == nil {
+			w.resources.Track(id, lab, true)
+		}
+	}
+	l.closed = func() {
+		w.m.Lock()
+		delete(w.labs, id)
+		w.m.Unlock()
+		//a lab which failed to close is left to the reconciler
+		if l.err == nil {
+			w.resources.Untrack(id)
+		}
+	}
+
+	w.m.Lock()
+	w.labs[id] = l
+	w.m.Unlock()
+	return id, l, host, nil
+}
+
+func (w *worker) lab(id string) (*localLab, error) {
+	if w == nil {
+		return nil, ErrLabNotFound
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	l, ok := w.labs[id]
+	if !ok {
+		return nil, ErrLabNotFound
+	}
+	return l, nil
+}
+
+// Renew the lease of a lab created for the scheduler of another API
+func (w *worker) renewLease(id string, now time.Time) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	l, ok := w.labs[id]
+	if !ok {
+		return ErrLabNotFound
+	}
+	l.lease = now.Add(workerLabLease)
+	return nil
+}
+
+// Labs on the worker: in use, pre-warmed, leased by another scheduler or being closed
+func (w *worker) labIDs() map[string]bool {
+	ids := map[string]bool{}
+	if w == nil {
+		return ids
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	for id := range w.labs {
+		ids[id] = true
+	}
+	return ids
+}
+
+// Close the labs whose scheduler stopped renewing their lease, eg. because it crashed
+func (w *worker) expireLeases(now time.Time) {
+	w.m.Lock()
+	var expired []*localLab
+	for _, l := range w.labs {
+		if !l.lease.IsZero() && !l.lease.After(now) {
+			expired = append(expired, l)
+		}
+	}
+	w.m.Unlock()
+
+	for _, l := range expired {
+		log.Warn().Str("worker", w.name).Str("lab", l.id).Msg("Lease of the lab expired, closing it")
+		if err := l.Close(); err != nil {
+			log.Error().Str("lab", l.id).Msgf("Error closing the lab: %v", err)
+		}
+	}
+}
+
+// Close the labs still running on the worker
+func (w *worker) Close() error {
+	w.m.Lock()
+	labs := make([]*localLab, 0, len(w.labs))
+	for _, l := range w.labs {
+		labs = append(labs, l)
+	}
+	w.m.Unlock()
+
+	var firstErr error
+	for _, l := range labs {
+		if err := l.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	contextFileEnv     = "HAAUKINS_API_CONTEXT"
+	defaultContextFile = ".haaukins-api/context.yml" //in the home directory
+	adminTimeout       = 5 * time.Minute
+)
+
+var errUsage = errors.New("usage")
+
+// command is a subcommand of the CLI, either a group of subcommands or a command to run
+type command struct {
+	name    string
+	args    string //arguments shown in the usage
+	summary string
+	run     func(path string, args []string) error
+	sub     []*command
+}
+
+func (c *command) exec(path string, args []string) error {
+	if len(c.sub) == 0 {
+		return c.run(path, args)
+	}
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		c.usage(path)
+		return errUsage
+	}
+	for _, s := range c.sub {
+		if s.name == args[0] {
+			return s.exec(path+" "+s.name, args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", path+" "+args[0])
+	c.usage(path)
+	return errUsage
+}
+
+func (c *command) usage(path string) {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command>\n\nCommands:\n", path)
+	for _, s := range c.sub {
+		fmt.Fprintf(os.Stderr, "  %-30s %s\n", strings.TrimSpace(s.name+" "+s.args), s.summary)
+	}
+}
+
+// Flags of a command, the usage lists them after the arguments of the command
+func newFlags(path, args, summary string) *flag.FlagSet {
+	fs := flag.NewFlagSet(path, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] %s\n\n%s\n\nFlags:\n", path, args, summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// Parse the flags of a command, and check it got the number of arguments it expects
+func parseFlags(fs *flag.FlagSet, args []string, nargs int) error {
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() != nargs {
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// cliContext is an API the CLI operates, with the admin credentials
+type cliContext struct {
+	Name     string `yaml:"name"`
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Insecure bool   `yaml:"insecure-skip-verify,omitempty"` //for the APIs with a self-signed certificate
+}
+
+// contextFile keeps the contexts of the APIs, like a kubeconfig
+type contextFile struct {
+	Current  string       `yaml:"current-context"`
+	Contexts []cliContext `yaml:"contexts"`
+}
+
+func contextFilePath() string {
+	if path := os.Getenv(contextFileEnv); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return defaultContextFile
+	}
+	return filepath.Join(home, defaultContextFile)
+}
+
+// Load a context of the context file, the current one when no name is given
+func loadContext(path, name string) (cliContext, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cliContext{}, fmt.Errorf("unable to read context file: %v", err)
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode().Perm()&0077 != 0 {
+		fmt.Fprintf(os.Stderr, "warning: the context file %s holds admin credentials and is readable by others\n", path)
+	}
+
+	var cf contextFile
+	if err := yaml.Unmarshal(raw, &cf); err != nil {
+		return cliContext{}, fmt.Errorf("unable to parse context file: %v", err)
+	}
+	if name == "" {
+		name = cf.Current
+	}
+	for _, c := range cf.Contexts {
+		if c.Name == name || (name == "" && len(cf.Contexts) == 1) {
+			if c.URL == "" {
+				return cliContext{}, fmt.Errorf("the context %q has no url", c.Name)
+			}
+			return c, nil
+		}
+	}
+	return cliContext{}, fmt.Errorf("context %q not found in %s", name, path)
+}
+
+// adminClient calls the admin endpoints of an API with the credentials of a context
+type adminClient struct {
+	ctx  cliContext
+	http *http.Client
+}
+
+// Register the flags selecting the context, the client is ready once the flags are parsed
+func adminFlags(fs *flag.FlagSet) func() (*adminClient, error) {
+	file := fs.String("context-file", contextFilePath(), "file with the contexts of the APIs (env "+contextFileEnv+")")
+	name := fs.String("context", "", "context to use instead of the current one")
+	return func() (*adminClient, error) {
+		ctx, err := loadContext(*file, *name)
+		if err != nil {
+			return nil, err
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if ctx.Insecure {
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+		return &adminClient{ctx: ctx, http: &http.Client{Transport: transport, Timeout: adminTimeout}}, nil
+	}
+}
+
+// Call an admin endpoint, the JSON response is decoded into out when given
+func (c *adminClient) do(method, path string, query url.Values, out interface{}) error {
+	u := strings.TrimRight(c.ctx.URL, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.ctx.Username, c.ctx.Password)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		raw, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		if json.Unmarshal(raw, &apiErr) != nil || apiErr.Error == "" {
+			apiErr.Error = strings.TrimSpace(string(raw))
+		}
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, apiErr.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "context")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "context.yml")
+	ioutil.WriteFile(path, []byte(`
+current-context: prod
+contexts:
+  - name: prod
+    url: https://api.example.org
+    username: admin
+    password: secret
+  - name: staging
+    url: https://staging.example.org
+    username: admin
+    password: staging
+`), 0600)
+
+	for name, want := range map[string]string{"": "https://api.example.org", "staging": "https://staging.example.org"} {
+		ctx, err := loadContext(path, name)
+		if err != nil || ctx.URL != want {
+			t.Errorf("context %q: expected %s, got %+v (%v)", name, want, ctx, err)
+		}
+	}
+	if _, err := loadContext(path, "dev"); err == nil {
+		t.Errorf("expected an unknown context to fail")
+	}
+}
+
+func TestAdminClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "admin" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("challenges") != "ftp,sql" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"challenges not found"}`))
+			return
+		}
+		w.Write([]byte(`{"expires":"2026-10-20T12:00:00Z"}`))
+	}))
+	defer ts.Close()
+
+	c := &adminClient{ctx: cliContext{URL: ts.URL + "/", Username: "admin", Password: "secret"}, http: ts.Client()}
+	var out struct {
+		Expires time.Time `json:"expires"`
+	}
+	if err := c.do("POST", "/admin/envs/c1/extend", map[string][]string{"challenges": {"ftp,sql"}}, &out); err != nil || out.Expires.IsZero() {
+		t.Fatalf("unexpected response: %+v (%v)", out, err)
+	}
+	err := c.do("POST", "/admin/envs/c1/extend", map[string][]string{"challenges": {"xss"}}, &out)
+	if err == nil || !strings.Contains(err.Error(), "challenges not found") {
+		t.Errorf("expected the error of the API, got %v", err)
+	}
+}
+
+func TestExportAudit(t *testing.T) {
+	log := `{"time":"2026-10-18T09:00:00Z","action":"lab.extended","actor":"learner","client":"c1","details":{"challenges":"ftp"}}
+not json
+{"time":"2026-10-19T09:00:00Z","action":"lab.closed","actor":"admin:admin","client":"c1","details":{"challenges":"ftp","expires":"x"}}
+{"time":"2026-10-19T10:00:00Z","action":"lab.extended","actor":"learner","client":"c2"}
+`
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	since, err := parseTime("24h", now)
+	if err != nil || !since.Equal(now.Add(-24*time.Hour)) {
+		t.Fatalf("unexpected since: %v (%v)", since, err)
+	}
+	if _, err := parseTime("yesterday", now); err == nil {
+		t.Errorf("expected an invalid time to fail")
+	}
+
+	var buf bytes.Buffer
+	filter := auditFilter{since: since, client: "c1"}
+	if err := exportAudit(strings.NewReader(log), &buf, filter, "csv"); err != nil {
+		t.Fatalf("unable to export: %v", err)
+	}
+	want := "time,action,actor,client,request,details\n" +
+		"2026-10-19T09:00:00Z,lab.closed,admin:admin,c1,,challenges=ftp expires=x\n"
+	if buf.String() != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, buf.String())
+	}
+
+	buf.Reset()
+	filter = auditFilter{actions: map[string]bool{"lab.extended": true}}
+	if err := exportAudit(strings.NewReader(log), &buf, filter, "json"); err != nil {
+		t.Fatalf("unable to export: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 2 {
+		t.Errorf("expected the 2 extensions, got %v", lines)
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aau-network-security/haaukins-api/app"
+	"github.com/rs/zerolog/log"
+)
+
+const auditFollowInterval = time.Second
+
+func commands() *command {
+	return &command{name: "haaukins-api", sub: []*command{
+		{name: "serve", summary: "run the API", run: serveCmd},
+		{name: "config", summary: "configuration file", sub: []*command{
+			{name: "check", summary: "validate the configuration file", run: configCheckCmd},
+		}},
+		{name: "envs", summary: "environments of the clients", sub: []*command{
+			{name: "list", summary: "list the environments running for each client", run: envsListCmd},
+			{name: "kill", args: "<client> <challenges>", summary: "close a lab of a client", run: envsKillCmd},
+			{name: "extend", args: "<client> <challenges>", summary: "extend a lab of a client", run: envsExtendCmd},
+		}},
+		{name: "catalog", summary: "challenges of the exercise service", sub: []*command{
+			{name: "list", summary: "list the challenges by category", run: catalogListCmd},
+		}},
+		{name: "reconcile", summary: "remove the resources orphaned by the labs", run: reconcileCmd},
+		{name: "audit", summary: "audit log", sub: []*command{
+			{name: "tail", summary: "print the last events, and the new ones with -f", run: auditTailCmd},
+			{name: "export", summary: "export the events as JSON lines or CSV", run: auditExportCmd},
+		}},
+	}}
+}
+
+func loadConfig(path string) (*app.Config, error) {
+	c, err := app.NewConfigFromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read configuration file \"%s\": %s", path, err)
+	}
+	return c, nil
+}
+
+func serveCmd(path string, args []string) error {
+	fs := newFlags(path, "", "Run the API.")
+	confFile := fs.String("config", defaultConfigFile, "configuration file")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	c, err := loadConfig(*confFile)
+	if err != nil {
+		return err
+	}
+
+	api, err := app.New(c, false)
+	if err != nil {
+		return fmt.Errorf("unable to create API: %s", err)
+	}
+
+	handleCancel(func() error {
+		return api.Close()
+	})
+
+	log.Info().Msg("Started API")
+
+	api.Run()
+	return nil
+}
+
+func configCheckCmd(path string, args []string) error {
+	fs := newFlags(path, "", "Validate the configuration file, as the API does at startup.")
+	confFile := fs.String("config", defaultConfigFile, "configuration file")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	if _, err := loadConfig(*confFile); err != nil {
+		return err
+	}
+	fmt.Printf("%s is valid\n", *confFile)
+	return nil
+}
+
+// envs is an element of the list of `/admin/envs/`
+type envs struct {
+	Client      string
+	Host        string
+	Environment []string
+}
+
+func envsListCmd(path string, args []string) error {
+	fs := newFlags(path, "", "List the environments running for each client.")
+	client := adminFlags(fs)
+	asJSON := fs.Bool("json", false, "print the list as JSON")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	c, err := client()
+	if err != nil {
+		return err
+	}
+
+	var list []envs
+	if err := c.do("GET", "/admin/envs/", nil, &list); err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(list)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLIENT\tHOST\tCHALLENGES")
+	for _, e := range list {
+		for _, chals := range e.Environment {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", e.Client, e.Host, chals)
+		}
+	}
+	return tw.Flush()
+}
+
+func envsKillCmd(path string, args []string) error {
+	fs := newFlags(path, "<client> <challenges>", "Close a lab of a client, eg. `envs kill 4b1e... ftp,sql`.")
+	client := adminFlags(fs)
+	if err := parseFlags(fs, args, 2); err != nil {
+		return err
+	}
+	c, err := client()
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"challenges": {fs.Arg(1)}}
+	if err := c.do("DELETE", "/admin/envs/"+url.PathEscape(fs.Arg(0)), query, nil); err != nil {
+		return err
+	}
+	fmt.Printf("The lab %s of the client %s is being closed\n", fs.Arg(1), fs.Arg(0))
+	return nil
+}
+
+func envsExtendCmd(path string, args []string) error {
+	fs := newFlags(path, "<client> <challenges>", "Extend a lab of a client, as the client does from the lab dashboard.")
+	client := adminFlags(fs)
+	if err := parseFlags(fs, args, 2); err != nil {
+		return err
+	}
+	c, err := client()
+	if err != nil {
+		return err
+	}
+
+	var extended struct {
+		Expires time.Time `json:"expires"`
+	}
+	query := url.Values{"challenges": {fs.Arg(1)}}
+	if err := c.do("POST", "/admin/envs/"+url.PathEscape(fs.Arg(0))+"/extend", query, &extended); err != nil {
+		return err
+	}
+	fmt.Printf("The lab %s of the client %s expires at %s\n", fs.Arg(1), fs.Arg(0), extended.Expires.Local().Format(time.RFC1123))
+	return nil
+}
+
+func catalogListCmd(path string, args []string) error {
+	fs := newFlags(path, "", "List the challenges of the exercise service by category, the secret ones are not included.")
+	confFile := fs.String("config", defaultConfigFile, "configuration file")
+	asJSON := fs.Bool("json", false, "print the catalog as JSON")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	c, err := loadConfig(*confFile)
+	if err != nil {
+		return err
+	}
+	categories, err := app.ChallengeCatalog(c)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(categories)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CATEGORY\tTAG\tNAME\tDIFFICULTY\tFLAGS")
+	for _, cat := range categories {
+		for _, chal := range cat.Challenges {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\n", cat.Tag, chal.Tag, chal.Name, chal.Difficulty, chal.Flags)
+		}
+	}
+	return tw.Flush()
+}
+
+func reconcileCmd(path string, args []string) error {
+	fs := newFlags(path, "", "Remove the containers, networks and VMs orphaned by the labs of the API.")
+	client := adminFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "only list the orphaned resources")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	c, err := client()
+	if err != nil {
+		return err
+	}
+
+	var report struct {
+		Tracked int `json:"tracked"`
+		Orphans []struct {
+			Lab        string   `json:"lab"`
+			Containers []string `json:"containers"`
+			Networks   []string `json:"networks"`
+			VMs        []string `json:"vms"`
+		} `json:"orphans"`
+		Errors []string `json:"errors"`
+	}
+	query := url.Values{"dry-run": {fmt.Sprint(*dryRun)}}
+	if err := c.do("POST", "/admin/reconcile/", query, &report); err != nil {
+		return err
+	}
+
+	verb := "Removed"
+	if *dryRun {
+		verb = "Orphaned"
+	}
+	for _, o := range report.Orphans {
+		fmt.Printf("%s lab %s: %d containers, %d networks, %d VMs\n", verb, o.Lab, len(o.Containers), len(o.Networks), len(o.VMs))
+	}
+	fmt.Printf("%d labs tracked, %d orphaned\n", report.Tracked, len(report.Orphans))
+	for _, e := range report.Errors {
+		fmt.Fprintf(os.Stderr, "error: %s\n", e)
+	}
+	if len(report.Errors) > 0 {
+		return fmt.Errorf("%d resources couldn't be removed", len(report.Errors))
+	}
+	return nil
+}
+
+// auditEvent is a line of the audit log
+type auditEvent struct {
+	Time    time.Time         `json:"time"`
+	Action  string            `json:"action"`
+	Actor   string            `json:"actor"`
+	Client  string            `json:"client,omitempty"`
+	Request string            `json:"request,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+func (e auditEvent) details() string {
+	keys := make([]string, 0, len(e.Details))
+	for k := range e.Details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + e.Details[k]
+	}
+	return strings.Join(pairs, " ")
+}
+
+func (e auditEvent) String() string {
+	s := fmt.Sprintf("%s %-22s %s", e.Time.Local().Format(time.RFC3339), e.Action, e.Actor)
+	if e.Client != "" {
+		s += " client=" + e.Client
+	}
+	if e.Request != "" {
+		s += " request=" + e.Request
+	}
+	if d := e.details(); d != "" {
+		s += " " + d
+	}
+	return s
+}
+
+// auditFilter selects the events exported
+type auditFilter struct {
+	since, until time.Time
+	actions      map[string]bool
+	client       string
+}
+
+func (f auditFilter) match(e auditEvent) bool {
+	return (f.since.IsZero() || !e.Time.Before(f.since)) &&
+		(f.until.IsZero() || e.Time.Before(f.until)) &&
+		(len(f.actions) == 0 || f.actions[e.Action]) &&
+		(f.client == "" || e.Client == f.client)
+}
+
+// Parse a time given either as RFC 3339 or as a duration before now, eg. 24h
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or a duration", s)
+	}
+	return t, nil
+}
+
+// Path of the audit file, given or from the configuration file
+func auditFile(file, confFile string) (string, error) {
+	if file != "" {
+		return file, nil
+	}
+	c, err := loadConfig(confFile)
+	if err != nil {
+		return "", err
+	}
+	if c.API.AuditFile == "" {
+		return "", fmt.Errorf("no audit-file in %s, the audit events are only in the API log", confFile)
+	}
+	return c.API.AuditFile, nil
+}
+
+// Read the events of the audit log, the malformed lines are skipped
+func readAudit(r io.Reader, fn func(auditEvent) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		var e auditEvent
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			continue
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+func auditTailCmd(path string, args []string) error {
+	fs := newFlags(path, "", "Print the last events of the audit log.")
+	confFile := fs.String("config", defaultConfigFile, "configuration file, to find the audit file")
+	file := fs.String("file", "", "audit file, instead of the one of the configuration file")
+	n := fs.Int("n", 20, "number of events")
+	follow := fs.Bool("f", false, "keep printing the new events")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	auditPath, err := auditFile(*file, *confFile)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(auditPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var last []auditEvent
+	err = readAudit(f, func(e auditEvent) error {
+		last = append(last, e)
+		if len(last) > *n {
+			last = last[1:]
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range last {
+		fmt.Println(e)
+	}
+	if !*follow {
+		return nil
+	}
+
+	//The events are appended as whole lines, a partial line is kept until it is complete
+	r := bufio.NewReader(f)
+	var partial string
+	for {
+		line, err := r.ReadString('\n')
+		partial += line
+		if err == io.EOF {
+			time.Sleep(auditFollowInterval)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var e auditEvent
+		if json.Unmarshal([]byte(partial), &e) == nil {
+			fmt.Println(e)
+		}
+		partial = ""
+	}
+}
+
+func auditExportCmd(path string, args []string) error {
+	fs := newFlags(path, "", "Export the events of the audit log, eg. `audit export -since 168h -format csv -o week.csv`.")
+	confFile := fs.String("config", defaultConfigFile, "configuration file, to find the audit file")
+	file := fs.String("file", "", "audit file, instead of the one of the configuration file")
+	since := fs.String("since", "", "export the events from this time, RFC 3339 or a duration before now")
+	until := fs.String("until", "", "export the events before this time, RFC 3339 or a duration before now")
+	actions := fs.String("action", "", "comma separated actions to export, eg. lab.extended,lab.closed")
+	clientID := fs.String("client", "", "export only the events of this client")
+	format := fs.String("format", "json", "json (JSON lines) or csv")
+	out := fs.String("o", "", "output file, the standard output by default")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if *format != "json" && *format != "csv" {
+		fs.Usage()
+		return errUsage
+	}
+
+	now := time.Now()
+	filter := auditFilter{client: *clientID}
+	var err error
+	if filter.since, err = parseTime(*since, now); err != nil {
+		return err
+	}
+	if filter.until, err = parseTime(*until, now); err != nil {
+		return err
+	}
+	if *actions != "" {
+		filter.actions = map[string]bool{}
+		for _, a := range strings.Split(*actions, ",") {
+			filter.actions[strings.TrimSpace(a)] = true
+		}
+	}
+
+	auditPath, err := auditFile(*file, *confFile)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(auditPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	return exportAudit(f, w, filter, *format)
+}
+
+// Write the events matching the filter as JSON lines or CSV
+func exportAudit(r io.Reader, w io.Writer, filter auditFilter, format string) error {
+	cw := csv.NewWriter(w)
+	enc := json.NewEncoder(w)
+	if format == "csv" {
+		cw.Write([]string{"time", "action", "actor", "client", "request", "details"})
+	}
+
+	err := readAudit(r, func(e auditEvent) error {
+		if !filter.match(e) {
+			return nil
+		}
+		if format == "csv" {
+			return cw.Write([]string{e.Time.Format(time.RFC3339), e.Action, e.Actor, e.Client, e.Request, e.details()})
+		}
+		return enc.Encode(e)
+	})
+	cw.Flush()
+	if err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
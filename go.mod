@@ -10,5 +10,6 @@ require (
 	github.com/google/uuid v1.1.2
 	github.com/gorilla/websocket v1.4.1
 	github.com/rs/zerolog v1.19.0
+	google.golang.org/grpc v1.38.0
 	gopkg.in/yaml.v2 v2.3.0
 )
@@ -1,12 +1,11 @@
 package main
 
 import (
-	"flag"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
-	"github.com/aau-network-security/haaukins-api/app"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -34,27 +33,16 @@ func main() {
 	zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 
-	confFilePtr := flag.String("config", defaultConfigFile, "configuration file")
-	flag.Parse()
-
-	c, err := app.NewConfigFromFile(*confFilePtr)
-	if err != nil {
-		log.Error().Msgf("unable to read configuration file \"%s\": %s\n", *confFilePtr, err)
-		return
+	//Without a command the API is served, as before the subcommands: `haaukins-api -config config.yml`
+	args := os.Args[1:]
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "--help" {
+		args = append([]string{"serve"}, args...)
 	}
 
-	api, err := app.New(c, false)
-	if err != nil {
-		log.Error().Msgf("unable to create API: %s\n", err)
-		return
+	if err := commands().exec("haaukins-api", args); err != nil {
+		if err != errUsage {
+			log.Error().Msgf("%s", err)
+		}
+		os.Exit(1)
 	}
-
-	handleCancel(func() error {
-		return api.Close()
-	})
-
-	log.Info().Msg("Started API")
-
-	api.Run()
-
 }
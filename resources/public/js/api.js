@@ -37,36 +37,80 @@ function connectToWS() {
     };
 }
 
+let catalog = []
+
 function receiveMsg(evt) {
-    let frontendChallenges
     let messages = evt.data.split('\n');
     for (let i = 0; i < messages.length; i++) {
         let msg = messages[i];
         let json = JSON.parse(msg);
-        if (json.msg === "challenges_categories"){
-            frontendChallenges = json.values;
+        switch (json.msg) {
+            case "challenges_categories":
+                catalog = json.values || [];
+                break;
+            case "challenges_added":
+            case "challenges_updated":
+                json.values.forEach(change => putChallenge(change));
+                break;
+            case "challenges_removed":
+                json.values.forEach(change => removeChallenge(change));
+                break;
         }
     }
-    showChallenges(frontendChallenges)
+    showChallenges(catalog)
+}
+
+function putChallenge(change) {
+    let category = catalog.find(c => c.tag === change.category)
+    if (!category) {
+        category = {name: change.category_name, tag: change.category, challenges: []}
+        catalog.push(category)
+    }
+    let i = category.challenges.findIndex(c => c.tag === change.tag)
+    i < 0 ? category.challenges.push(change.challenge) : category.challenges[i] = change.challenge;
+}
+
+function removeChallenge(change) {
+    let category = catalog.find(c => c.tag === change.category)
+    if (!category) {
+        return
+    }
+    category.challenges = category.challenges.filter(c => c.tag !== change.tag)
+    if (category.challenges.length === 0) {
+        catalog = catalog.filter(c => c !== category)
+    }
 }
 
 function showChallenges(frontendChallenges){
     const nav_pills = document.getElementById('challenges-category-nav')
     const challenges_tab = document.getElementById('challenges-tab')
+
+    //The catalog is drawn again on every change, keeping the selected challenges and category
+    let checked = new Set()
+    document.querySelectorAll('input[name="challenge"]:checked').forEach(c => checked.add(c.value))
+    let active = nav_pills.querySelector('.nav-link.active')
+    let activeTag = active ? active.getAttribute('href').substring(1) : ''
+    if (!frontendChallenges.some(c => c.tag === activeTag)) {
+        activeTag = frontendChallenges.length > 0 ? frontendChallenges[0].tag : ''
+    }
+    nav_pills.innerHTML = ''
+    challenges_tab.innerHTML = ''
+
     let count = 0
     for ( let i = 0; i < frontendChallenges.length; i ++ ) {
+        let isActive = frontendChallenges[i].tag === activeTag
         let category = document.createElement('a');
         category.href = '#' + frontendChallenges[i].tag
         category.innerText = frontendChallenges[i].name
         category.setAttribute('data-toggle', 'pill')
         category.setAttribute('id', frontendChallenges[i].tag + '-tab')
         category.classList.add('nav-link')
-        i == 0 ? category.classList.add('active') : "" ;
+        isActive ? category.classList.add('active') : "" ;
         nav_pills.appendChild(category)
 
         let cat_tab = document.createElement('div')
         cat_tab.classList.add('tab-pane','fade')
-        i == 0 ? cat_tab.classList.add('active','show') : "";
+        isActive ? cat_tab.classList.add('active','show') : "";
         cat_tab.setAttribute('id', frontendChallenges[i].tag)
         cat_tab.setAttribute('role', 'tabpanel')
         cat_tab.setAttribute('aria-labelledby', frontendChallenges[i].tag + '-tab')
@@ -75,9 +119,9 @@ function showChallenges(frontendChallenges){
         for ( let j = 0; j < frontendChallenges[i].challenges.length; j ++ ){
             count++
             let challenge = frontendChallenges[i].challenges[j]
-            let nav_tabs = document.getElementById(frontendChallenges[i].tag)
             let div = createChallengeCheckBox(count, challenge)
-            nav_tabs.appendChild(div)
+            div.querySelector('input').checked = checked.has(challenge.tag)
+            cat_tab.appendChild(div)
         }
     }
 }
@@ -97,6 +141,10 @@ function createChallengeCheckBox(n, challenge){
     label.setAttribute('for', 'challenge' + n)
     label.classList.add('custom-control-label')
     label.innerText = challenge.name
+    if (challenge.ready === false) {
+        label.innerText += ' (preparing)'
+        label.setAttribute('title', 'The first lab with this challenge takes longer to start')
+    }
 
     div.appendChild(input)
     div.appendChild(label)